@@ -2,8 +2,6 @@ package main
 
 import (
 	"context"
-	"crypto/sha256"
-	"encoding/hex"
 	"errors"
 	"flag"
 	"fmt"
@@ -24,6 +22,7 @@ import (
 	"github.com/junwookheo/bcsos/blockchainnode/network"
 	"github.com/junwookheo/bcsos/blockchainnode/storage"
 	"github.com/junwookheo/bcsos/blockchainnode/testmgrcli"
+	"github.com/junwookheo/bcsos/common/blockchain"
 	"github.com/junwookheo/bcsos/common/config"
 	"github.com/junwookheo/bcsos/common/dtype"
 	"github.com/junwookheo/bcsos/common/listener"
@@ -37,6 +36,8 @@ var upgrader = websocket.Upgrader{
 var DATA_DIR string = "./db_nodes"
 var db_path string = DATA_DIR + "/dev.db"
 var wallet_path string = DATA_DIR + "/dev.wallet"
+var consensus string = "POW"
+var quota int = 0
 
 var (
 	ni  *network.NodeInfo
@@ -69,7 +70,15 @@ func flagParse() (string, int, int) {
 	pmode := flag.String("mode", "ST", "ST: Test storage (Server generates tr and ap object), MI: Test Miner(generate tr and access object in local)")
 	psc := flag.Int("sc", 0, "Storage class : 0 to 4")
 	pport := flag.Int("port", 0, "Port number of local if 0, it will use a free port")
+	pconsensus := flag.String("consensus", "POW", "POW: Proof of Work, POA: round-robin Proof of Authority")
+	pquota := flag.Int("quota", 0, "Byte quota of local storage, 0 uses quota_bytes of the storage class in the config")
+	config.AddFlags()
 	flag.Parse()
+	if err := config.LoadFlags(); err != nil {
+		log.Panicf("Config error : %v", err)
+	}
+	consensus = strings.ToUpper(*pconsensus)
+	quota = *pquota
 	if *pport == 0 {
 		port, err := getFreePort()
 		if err != nil {
@@ -100,15 +109,11 @@ func initNode() {
 	w := wm.GetWallet()
 	//w := wallet.NewWallet(wallet_path)
 
-	// hash := hex.EncodeToString(w.GetAddress()[:])
 	// Hash of Bitcoin address is used for content-addressing
-	bhash := sha256.Sum256(w.GetAddress()[:])
-	hash := hex.EncodeToString(bhash[:])
-	log.Printf("==>%v", hash)
-
 	// init nodeInfo
 	ni = network.NodeInfoInst()
-	ni.SetLocalddrParam(mode, sc, port, hash)
+	ni.SetLocalddrParam(mode, sc, port, w)
+	log.Printf("==>%v", ni.GetLocalddr().Hash)
 
 	// init testmgrcli
 	tmc = testmgrcli.TestMgrCliInst()
@@ -150,6 +155,7 @@ func commandProc(cmd *dtype.Command) {
 		switch cmd.Subcmd {
 		case "Test":
 			if cmd.Arg1 == "Start" {
+				setConsensus(cmd.Signers)
 				el.Notify("Start")
 			} else if cmd.Arg1 == "Stop" {
 				el.Notify("Stop")
@@ -162,6 +168,17 @@ func commandProc(cmd *dtype.Command) {
 	}
 }
 
+// setConsensus sets the consensus engine before the test starts
+// Public keys of PoA signers are sent by the simulator with the start command
+func setConsensus(signers [][]byte) {
+	if consensus != "POA" {
+		return
+	}
+
+	log.Printf("PoA signers : %v", len(signers))
+	blockchain.SetConsensus(blockchain.NewPoA(signers, wm.GetWallet()))
+}
+
 func KillProcess() {
 	p, err := os.FindProcess(os.Getpid())
 
@@ -298,7 +315,7 @@ func TransactionProc() {
 						mining.SimulateTransaction(id)
 						id++
 					} else {
-						time.Sleep(time.Duration(config.BLOCK_CREATE_PERIOD) * time.Second)
+						time.Sleep(time.Duration(config.ConfigInst().BlockCreatePeriod) * time.Second)
 						// log.Printf("Mode : %v", local.Mode)
 					}
 				} else {
@@ -320,6 +337,8 @@ func main() {
 	m := mux.NewRouter()
 	initNode()
 	sm = storage.StorageMgrInst(db_path)
+	sm.SetQuota(quota)
+	sm.LoadReputation()
 	mi = mining.MiningInst()
 
 	m.Handle("/", http.FileServer(http.Dir("static")))
@@ -331,6 +350,9 @@ func main() {
 	mi.SetHttpRouter(m)
 
 	sm.ObjectbyAccessPatternProc()
+	sm.SyncBlockProc()
+	sm.ReplicationProc()
+	mi.ReorgProc()
 	PeerListProc()
 	TransactionProc()
 	EndTestProc()
@@ -1,7 +1,11 @@
 package mining
 
 import (
+	"context"
+	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"math/rand"
@@ -19,12 +23,13 @@ import (
 	"github.com/junwookheo/bcsos/common/dtype"
 )
 
-const TPERIOD int = config.BLOCK_CREATE_PERIOD * 1000000000
+// tperiod returns the block create period in nanoseconds
+func tperiod() int {
+	return config.ConfigInst().BlockCreatePeriod * 1000000000
+}
 
 type Mining struct {
 	tp    map[string]*blockchain.Transaction
-	st    *datalib.BcQueue // list of broadcast new transactions
-	sb    *datalib.BcQueue // list of broadcast new blocks
 	mutex sync.Mutex
 }
 
@@ -88,8 +93,14 @@ func (mi *Mining) ShowTransactionsFromPool() {
 }
 
 func (mi *Mining) sendBlock(b *blockchain.Block, node *dtype.NodeInfo) {
+	if err := network.PeerMgrInst().Notify(node, network.MSG_NEW_BLOCK, b); err != nil {
+		log.Printf("BroadcasNewBlock error : %v", err)
+	}
+}
+
+// sendBlockSim sends a new block to the simulation server which does not keep peer connections
+func (mi *Mining) sendBlockSim(b *blockchain.Block, node *dtype.NodeInfo) {
 	url := fmt.Sprintf("ws://%v:%v/broadcastnewblock", node.IP, node.Port)
-	// log.Printf("Send ping with local info : %v", url)
 
 	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
 	if err != nil {
@@ -104,16 +115,13 @@ func (mi *Mining) sendBlock(b *blockchain.Block, node *dtype.NodeInfo) {
 	}
 }
 
+// BroadcastNewBlock announces the block to peers, they request it if they have not seen it
 func (mi *Mining) BroadcastNewBlock(b *blockchain.Block) {
+	network.GossipInst().Announce(network.INV_BLOCK, hex.EncodeToString(b.Header.Hash))
+
 	var nodes [(config.MAX_SC) * config.MAX_SC_PEER]dtype.NodeInfo
 	nm := network.NodeMgrInst()
 	nm.GetSCNNodeListAll(&nodes)
-	for _, node := range nodes {
-		if node.IP != "" {
-			mi.sendBlock(b, &node)
-			// log.Printf("Broadcast Transaction : %v", node)
-		}
-	}
 
 	// When a node receives a new block, it carries out Proof of Storage
 	// it start from 120 * 5 min
@@ -135,16 +143,66 @@ func (mi *Mining) UpdateTransactionPool(block *blockchain.Block) {
 	}
 }
 
+// ReorgProc puts transactions of detached blocks back to the transaction pool
+// when the heaviest chain is changed
+func (mi *Mining) ReorgProc() {
+	reorgs := make(chan *datalib.Reorg)
+	sm := storage.StorageMgrInst("")
+	sm.AddReorgListener(reorgs)
+
+	go func(reorgs <-chan *datalib.Reorg) {
+		for reorg := range reorgs {
+			included := make(map[string]bool)
+			for _, b := range reorg.Attached {
+				for _, tr := range b.Transactions {
+					included[hex.EncodeToString(tr.Hash)] = true
+				}
+			}
+
+			cnt := 0
+			for _, b := range reorg.Detached {
+				for _, tr := range b.Transactions {
+					key := hex.EncodeToString(tr.Hash)
+					if !included[key] && mi.AddTransactionToPool(key, tr) {
+						cnt++
+					}
+				}
+			}
+			log.Printf("Reorg : %v transactions are back to the pool", cnt)
+		}
+	}(reorgs)
+}
+
+// watchHighestBlock cancels the work if the highest block is not the hash anymore
+func (mi *Mining) watchHighestBlock(ctx context.Context, cancel context.CancelFunc, hash string) {
+	sm := storage.StorageMgrInst("")
+	ticker := time.NewTicker(time.Duration(tperiod() / 100))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, curhash := sm.GetHighestBlockHash(); curhash != hash {
+				cancel()
+				return
+			}
+		}
+	}
+}
+
 func (mi *Mining) StartMiningNewBlock(status *string) {
 	for {
 		// This sleep is needed for updating a new block after sending the mining block
-		time.Sleep(time.Nanosecond * time.Duration(TPERIOD/10))
+		time.Sleep(time.Nanosecond * time.Duration(tperiod()/10))
 
 		// _, prehash := mi.cm.GetHighestBlockHash()
 		sm := storage.StorageMgrInst("")
 		_, prehash := sm.GetHighestBlockHash()
 
-		delay := TPERIOD - int(time.Now().UnixNano())%TPERIOD
+		period := tperiod()
+		delay := period - int(time.Now().UnixNano())%period
 		time.Sleep(time.Nanosecond * time.Duration(delay))
 
 		if *status == "Stop" {
@@ -158,15 +216,35 @@ func (mi *Mining) StartMiningNewBlock(status *string) {
 			continue
 		}
 
+		// Mining on an old tip is useless until initial block download is done
+		if !sm.IsSynced() {
+			continue
+		}
+
+		// Only the producer of the height can create a block
+		c := blockchain.GetConsensus()
+		w := WalletMgrInst("").GetWallet()
+		if !c.IsProducer(height+1, w.PublicKey) {
+			continue
+		}
+
 		trs := mi.GetTransactionsFromPool()
 
 		if len(trs) != 0 {
 			hash, _ := hex.DecodeString(curhash)
-			b := blockchain.CreateBlock(trs, hash, height+1)
+			b := blockchain.NewBlock(trs, hash, height+1, sm.NextDifficulty(hash))
+
+			// Sealing is cancelled if a new block is received during the work
+			ctx, cancel := context.WithCancel(context.Background())
+			go mi.watchHighestBlock(ctx, cancel, curhash)
+			err := c.Seal(ctx, b)
+			cancel()
+			if err != nil {
+				log.Printf("Seal block(%v) error : %v", height+1, err)
+				continue
+			}
 
-			// Too much forks happen so add random delay
-			ms := rand.Intn(100) * 10
-			time.Sleep(time.Millisecond * time.Duration(ms))
+			time.Sleep(c.Delay())
 			// Send block to local node
 			ni := network.NodeInfoInst()
 			local := ni.GetLocalddr()
@@ -180,7 +258,7 @@ func (mi *Mining) StartMiningNewBlock(status *string) {
 
 			log.Printf("==>mining a new block(%v):%v %v", height+1, hex.EncodeToString(b.Header.Hash), curhash)
 			mi.sendBlock(b, local)
-			mi.sendBlock(b, server) // Send a new block to simulation server
+			mi.sendBlockSim(b, server) // Send a new block to simulation server
 		}
 
 	}
@@ -199,59 +277,98 @@ func (mi *Mining) newBlockHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	defer ws.Close()
 
-	var block blockchain.Block
-	if err := ws.ReadJSON(&block); err != nil {
+	_, data, err := ws.ReadMessage()
+	if err != nil {
 		log.Printf("Read json error : %v", err)
+		return
 	}
 
-	mi.mutex.Lock()
-	if mi.sb.Find(hex.EncodeToString(block.Header.Hash)) {
-		// log.Printf("===END bc Block: %v", hex.EncodeToString(block.Header.Hash))
-		mi.mutex.Unlock()
-		return
+	if _, err := mi.newBlockMessage(data); err != nil {
+		log.Printf("Read json error : %v", err)
 	}
+}
 
-	mi.sb.Push(hex.EncodeToString(block.Header.Hash))
-	mi.mutex.Unlock()
+// newBlockMessage is a new block pushed to the node
+func (mi *Mining) newBlockMessage(payload json.RawMessage) (interface{}, error) {
+	var block blockchain.Block
+	if err := json.Unmarshal(payload, &block); err != nil {
+		return nil, err
+	}
 
-	mi.UpdateTransactionPool(&block)
+	// The block is processed if it is not received before
+	if network.GossipInst().Seen(network.INV_BLOCK, hex.EncodeToString(block.Header.Hash), len(payload)) {
+		mi.processBlock(&block)
+	}
+	return nil, nil
+}
 
-	// log.Printf("===FWD bc block : %v", hex.EncodeToString(block.Header.Hash))
-	go mi.BroadcastNewBlock(&block)
+// gossipBlock processes a block requested to the peer announcing it
+func (mi *Mining) gossipBlock(payload json.RawMessage) error {
+	var block blockchain.Block
+	if err := json.Unmarshal(payload, &block); err != nil {
+		return err
+	}
 
-	sm := storage.StorageMgrInst("")
-	sm.AddNewBlock(&block)
+	mi.processBlock(&block)
+	return nil
 }
 
-// Update peers list
-func (mi *Mining) BroadcasTransaction(t *blockchain.Transaction) {
-	sendTransaction := func(node *dtype.NodeInfo) {
-		url := fmt.Sprintf("ws://%v:%v/broadcastransaction", node.IP, node.Port)
-		//log.Printf("BroadcasTransaction to : %v", url)
+// blockHash returns the hash of a block requested to a peer, the seal binds the hash to the block when it is processed
+func blockHash(payload json.RawMessage) (string, error) {
+	var block blockchain.Block
+	if err := json.Unmarshal(payload, &block); err != nil {
+		return "", err
+	}
 
-		ws, _, err := websocket.DefaultDialer.Dial(url, nil)
-		if err != nil {
-			log.Printf("Broadcastransaction error : %v", err)
-			return
-		}
-		defer ws.Close()
+	return hex.EncodeToString(block.Header.Hash), nil
+}
 
-		if err := ws.WriteJSON(t); err != nil {
-			log.Printf("Write json error : %v", err)
-			return
-		}
+// getBlock returns the block kept by the node to peers requesting it
+func (mi *Mining) getBlock(hash string) (interface{}, bool) {
+	b := storage.StorageMgrInst("").GetLocalBlock(hash)
+
+	return b, b != nil
+}
+
+// processBlock stores a valid block and forwards it with orphans connected by it.
+// Invalid blocks are neither forwarded nor stored.
+// If the parent is unknown, it is requested to other nodes
+func (mi *Mining) processBlock(block *blockchain.Block) {
+	sm := storage.StorageMgrInst("")
+	blocks, err := sm.ProcessBlock(block)
+	if errors.Is(err, blockchain.ErrUnknownParent) {
+		log.Printf("Orphan block(%v) : %v", block.Header.Height, hex.EncodeToString(block.Header.Hash))
+		go mi.requestParentBlock(block)
+		return
+	} else if err != nil {
+		log.Printf("Reject block(%v) %v : %v, total rejected %v", block.Header.Height, hex.EncodeToString(block.Header.Hash), err, sm.GetInvalidBlocks())
+		return
 	}
 
-	var nodes [(config.MAX_SC) * config.MAX_SC_PEER]dtype.NodeInfo
-	nm := network.NodeMgrInst()
-	nm.GetSCNNodeListAll(&nodes)
-	for _, node := range nodes {
-		if node.IP != "" {
-			sendTransaction(&node)
-			// log.Printf("Broadcast Transaction : %v", node)
-		}
+	for _, b := range blocks {
+		mi.UpdateTransactionPool(b)
+
+		// log.Printf("===FWD bc block : %v", hex.EncodeToString(b.Header.Hash))
+		go mi.BroadcastNewBlock(b)
+	}
+}
 
+func (mi *Mining) requestParentBlock(block *blockchain.Block) {
+	sm := storage.StorageMgrInst("")
+	prehash := hex.EncodeToString(block.Header.PrvHash)
+	parent := sm.RequestBlock(prehash)
+	if parent == nil {
+		log.Printf("Not found parent block(%v) : %v", block.Header.Height-1, prehash)
+		return
 	}
+
+	network.GossipInst().Seen(network.INV_BLOCK, prehash, 0)
+	mi.processBlock(parent)
+}
+
+// BroadcasTransaction announces the transaction to peers, they request it if they have not seen it
+func (mi *Mining) BroadcasTransaction(t *blockchain.Transaction) {
+	network.GossipInst().Announce(network.INV_TRANSACTION, hex.EncodeToString(t.Hash))
 }
 
 // broadcastTrascationHandler is called when a new transaction is received from nodes
@@ -267,30 +384,72 @@ func (mi *Mining) broadcastTrascationHandler(w http.ResponseWriter, r *http.Requ
 	}
 	defer ws.Close()
 
-	var tr blockchain.Transaction
-	if err := ws.ReadJSON(&tr); err != nil {
+	_, data, err := ws.ReadMessage()
+	if err != nil {
 		log.Printf("Read json error : %v", err)
+		return
 	}
 
-	if !tr.Verify() {
-		log.Printf("===Verification failed : %v", hex.EncodeToString(tr.Hash))
-		log.Panicln("===Verification failed")
-		return
+	if _, err := mi.transactionMessage(data); err != nil {
+		log.Printf("Read json error : %v", err)
 	}
+}
 
-	mi.mutex.Lock()
-	if mi.st.Find(hex.EncodeToString(tr.Hash)) {
-		// log.Printf("===END TR : %v", hex.EncodeToString(tr.Hash))
-		mi.mutex.Unlock()
-		return
+// transactionMessage is a new transaction pushed to the node
+func (mi *Mining) transactionMessage(payload json.RawMessage) (interface{}, error) {
+	var tr blockchain.Transaction
+	if err := json.Unmarshal(payload, &tr); err != nil {
+		return nil, err
+	}
+
+	// The transaction is processed if it is not received before
+	if network.GossipInst().Seen(network.INV_TRANSACTION, hex.EncodeToString(tr.Hash), len(payload)) {
+		return nil, mi.receiveTransaction(&tr)
+	}
+	return nil, nil
+}
+
+// gossipTransaction processes a transaction requested to the peer announcing it
+func (mi *Mining) gossipTransaction(payload json.RawMessage) error {
+	var tr blockchain.Transaction
+	if err := json.Unmarshal(payload, &tr); err != nil {
+		return err
+	}
+
+	return mi.receiveTransaction(&tr)
+}
+
+// transactionHash returns the hash computed from the content of a transaction requested to a peer
+func transactionHash(payload json.RawMessage) (string, error) {
+	var tr blockchain.Transaction
+	if err := json.Unmarshal(payload, &tr); err != nil {
+		return "", err
 	}
 
-	mi.st.Push(hex.EncodeToString(tr.Hash))
-	mi.mutex.Unlock()
+	return hex.EncodeToString(tr.GetHash()), nil
+}
+
+// getTransaction returns the transaction in the pool to peers requesting it
+func (mi *Mining) getTransaction(hash string) (interface{}, bool) {
+	mi.mutex.Lock()
+	defer mi.mutex.Unlock()
+
+	tr, ok := mi.tp[hash]
+	return tr, ok
+}
+
+// receiveTransaction stores a new transaction into the pool and announces it
+// A transaction failing verification is dropped.
+func (mi *Mining) receiveTransaction(tr *blockchain.Transaction) error {
+	if !tr.Verify() {
+		log.Printf("===Verification failed : %v", hex.EncodeToString(tr.Hash))
+		return fmt.Errorf("%w : transaction %v", blockchain.ErrBadSignature, hex.EncodeToString(tr.Hash))
+	}
 
-	mi.AddTransactionToPool(hex.EncodeToString(tr.Hash), &tr)
+	mi.AddTransactionToPool(hex.EncodeToString(tr.Hash), tr)
 	// log.Printf("===FWD TR : %v", hex.EncodeToString(tr.Hash))
-	mi.BroadcasTransaction(&tr)
+	mi.BroadcasTransaction(tr)
+	return nil
 }
 
 // Request Proof of Storage
@@ -312,43 +471,44 @@ func (mi *Mining) requestProofStorage(b *blockchain.Block, nodes [(config.MAX_SC
 		return
 	}
 
-	url := fmt.Sprintf("ws://%v:%v/proofstorage", node.IP, node.Port)
-	// log.Printf("Send ping with local info : %v", url)
-
-	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
-	if err != nil {
-		log.Printf("BroadcasNewBlock error : %v", err)
+	// The block to be proven is selected by the new block and the target node
+	sm := storage.StorageMgrInst("")
+	baddr, _ := hex.DecodeString(node.Hash)
+	seed := sha256.Sum256(append(append([]byte{}, b.Header.Hash...), baddr...))
+	bh := sm.ChallengeBlock(seed[:], node.SC)
+	if bh == nil {
 		return
 	}
-	defer ws.Close()
 
 	req := dtype.ReqPoStorage{}
-	req.Hash = hex.EncodeToString(b.Header.Hash)
+	req.Hash = hex.EncodeToString(bh.Hash)
 	req.Timestamp = b.Header.Timestamp
+	req.Num = config.NUM_POS_LEAVES
 
-	if err := ws.WriteJSON(req); err != nil {
-		log.Printf("Write json error : %v", err)
-		return
+	// Every audit is recorded, a failed proof is a penalty of the node
+	start := time.Now()
+	pproof, err := queryProofStorage(node, &req)
+	if err == nil {
+		err = sm.VerifyProofStorage(&req, node, pproof)
 	}
+	sm.RecordPoSAudit(node, req.Hash, time.Since(start), err)
 
-	var pproof dtype.ResPoStorage
-	if err := ws.ReadJSON(&pproof); err != nil {
-		log.Printf("Write json error : %v", err)
+	if err != nil {
+		nm := network.NodeMgrInst()
+		nm.ReportMisbehavior(node, fmt.Sprintf("Fail PoStorage(%v) : %v", bh.Height, err))
 		return
 	}
 
-	// log.Printf("=====Prover PoS : %v", pproof)
-
-	sm := storage.StorageMgrInst("")
-	vproof := sm.ProofStorageProc(&req, node)
-
-	// log.Printf("=====Verifier PoS : %v", vproof)
+	log.Printf("Success PoStorage : %v-%v(%v)", node.Port, bh.Height, len(pproof.Leaves))
+}
 
-	if vproof.Proof != pproof.Proof {
-		log.Panicf("Fail PoStorage : %v-%v", vproof.Proof, pproof.Proof)
+func queryProofStorage(node *dtype.NodeInfo, req *dtype.ReqPoStorage) (*dtype.ResPoStorage, error) {
+	var pproof dtype.ResPoStorage
+	if err := network.PeerMgrInst().Request(node, network.MSG_PROOF_STORE, req, &pproof); err != nil {
+		return nil, err
 	}
 
-	log.Printf("Success PoStorage : %v-%v", node.Port, vproof.Proof)
+	return &pproof, nil
 }
 
 func (mi *Mining) GetTargetNodePoS(nodes [config.MAX_SC * config.MAX_SC_PEER]dtype.NodeInfo) *dtype.NodeInfo {
@@ -449,6 +609,14 @@ func (mi *Mining) GetTargetNodePoS(nodes [config.MAX_SC * config.MAX_SC_PEER]dty
 func (mi *Mining) SetHttpRouter(m *mux.Router) {
 	m.HandleFunc("/broadcastnewblock", mi.newBlockHandler)
 	m.HandleFunc("/broadcastransaction", mi.broadcastTrascationHandler)
+
+	p := network.PeerMgrInst()
+	p.Handle(network.MSG_NEW_BLOCK, mi.newBlockMessage)
+	p.Handle(network.MSG_TRANSACTION, mi.transactionMessage)
+
+	g := network.GossipInst()
+	g.Register(network.INV_BLOCK, mi.getBlock, blockHash, mi.gossipBlock)
+	g.Register(network.INV_TRANSACTION, mi.getTransaction, transactionHash, mi.gossipTransaction)
 	// m.HandleFunc("/chaininfo", mi.chainInfoHandler)
 }
 
@@ -456,8 +624,6 @@ func MiningInst() *Mining {
 	oncemining.Do(func() {
 		mi = &Mining{
 			tp:    make(map[string]*blockchain.Transaction),
-			st:    datalib.NewBcQueue(config.BLOCK_CREATE_PERIOD * 2),
-			sb:    datalib.NewBcQueue(6 * 2), // Light nodes in Bitcoin has 6
 			mutex: sync.Mutex{},
 		}
 	})
@@ -83,7 +83,7 @@ func TestBlockchainPoStorage(t *testing.T) {
 		}
 
 		serial.Deserialize(data, &bh)
-		tth = bh.Timestamp - int64(config.TSCX[0]*float32(1e9))
+		tth = bh.Timestamp - int64(config.ConfigInst().TSCX[0]*float32(1e9))
 		log.Printf("add block : %v, %v, %v", i, bh.Height, time.Unix((tth/1000)/1e6, ((tth/1000)%1e6)*1e3))
 		log.Printf("%v - %v", hex.EncodeToString(bh.Hash), hex.EncodeToString(bh.PrvHash))
 		i++
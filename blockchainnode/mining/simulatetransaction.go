@@ -73,7 +73,7 @@ func sendTransactionwithLocal(t *blockchain.Transaction) {
 }
 
 func SimulateTransaction(id int) {
-	t := rand.Intn(config.BLOCK_CREATE_PERIOD * 1000)
+	t := rand.Intn(config.ConfigInst().BlockCreatePeriod * 1000)
 	time.Sleep(time.Duration(t) * time.Millisecond)
 
 	if rand.Intn(2) != 0 {
@@ -81,5 +81,5 @@ func SimulateTransaction(id int) {
 		sendTransactionwithLocal(tr)
 	}
 
-	time.Sleep(time.Duration(config.BLOCK_CREATE_PERIOD*1000-t) * time.Millisecond)
+	time.Sleep(time.Duration(config.ConfigInst().BlockCreatePeriod*1000-t) * time.Millisecond)
 }
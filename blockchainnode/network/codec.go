@@ -0,0 +1,97 @@
+package network
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+
+	"github.com/gorilla/websocket"
+	"github.com/junwookheo/bcsos/common/config"
+	"github.com/junwookheo/bcsos/common/dtype"
+)
+
+// Codecs of dtype.Message
+// The JSON codec sends a message as a text frame.
+// The binary envelope codec sends a binary frame of version(2 bytes), ID, type and error as uvarint length prefixed fields
+// followed by the payload. Only the envelope is binary, the payload is the JSON given by handlers as it is.
+
+var ErrMalformed = errors.New("malformed message")
+
+type Codec interface {
+	FrameType() int
+	Marshal(msg *dtype.Message) ([]byte, error)
+	Unmarshal(data []byte, msg *dtype.Message) error
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) FrameType() int {
+	return websocket.TextMessage
+}
+
+func (jsonCodec) Marshal(msg *dtype.Message) ([]byte, error) {
+	return json.Marshal(msg)
+}
+
+func (jsonCodec) Unmarshal(data []byte, msg *dtype.Message) error {
+	return json.Unmarshal(data, msg)
+}
+
+// binaryEnvelopeCodec saves the field names and quoting of the envelope, not the size of the JSON payload
+type binaryEnvelopeCodec struct{}
+
+func (binaryEnvelopeCodec) FrameType() int {
+	return websocket.BinaryMessage
+}
+
+func (binaryEnvelopeCodec) Marshal(msg *dtype.Message) ([]byte, error) {
+	data := make([]byte, 2, 2+3*binary.MaxVarintLen64+len(msg.Type)+len(msg.Error)+len(msg.Payload))
+	binary.BigEndian.PutUint16(data, msg.Version)
+
+	var buf [binary.MaxVarintLen64]byte
+	data = append(data, buf[:binary.PutUvarint(buf[:], msg.ID)]...)
+	for _, f := range []string{msg.Type, msg.Error} {
+		data = append(data, buf[:binary.PutUvarint(buf[:], uint64(len(f)))]...)
+		data = append(data, f...)
+	}
+
+	return append(data, msg.Payload...), nil
+}
+
+func (binaryEnvelopeCodec) Unmarshal(data []byte, msg *dtype.Message) error {
+	if len(data) < 2 {
+		return ErrMalformed
+	}
+	msg.Version = binary.BigEndian.Uint16(data)
+	data = data[2:]
+
+	id, n := binary.Uvarint(data)
+	if n <= 0 {
+		return ErrMalformed
+	}
+	msg.ID = id
+	data = data[n:]
+
+	fields := [2]string{}
+	for i := range fields {
+		l, n := binary.Uvarint(data)
+		if n <= 0 || uint64(len(data)-n) < l {
+			return ErrMalformed
+		}
+		fields[i] = string(data[n : n+int(l)])
+		data = data[n+int(l):]
+	}
+	msg.Type, msg.Error = fields[0], fields[1]
+
+	msg.Payload = nil
+	if len(data) != 0 {
+		msg.Payload = append(json.RawMessage{}, data...)
+	}
+
+	return nil
+}
+
+var codecs = map[string]Codec{
+	config.CODEC_JSON:   jsonCodec{},
+	config.CODEC_BINARY: binaryEnvelopeCodec{},
+}
@@ -0,0 +1,56 @@
+package network
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/junwookheo/bcsos/common/config"
+	"github.com/junwookheo/bcsos/common/dtype"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCodec(t *testing.T) {
+	msgs := []dtype.Message{
+		{Version: config.PROTOCOL_VERSION, Type: MSG_FIND_NODE, ID: 1, Payload: json.RawMessage(`{"Target":"ab"}`)},
+		{Version: config.PROTOCOL_VERSION, Type: MSG_REPLY, ID: 1 << 40, Error: "failed"},
+		{Version: 0xffff, Type: MSG_NEW_BLOCK, ID: 0, Payload: json.RawMessage(`[1,2,3]`)},
+	}
+
+	for name, codec := range codecs {
+		for _, msg := range msgs {
+			data, err := codec.Marshal(&msg)
+			assert.Nil(t, err, name)
+
+			dec := dtype.Message{}
+			assert.Nil(t, codec.Unmarshal(data, &dec), name)
+			assert.Equal(t, msg, dec, name)
+		}
+	}
+
+	// The binary envelope is more compact than JSON
+	b, _ := binaryEnvelopeCodec{}.Marshal(&msgs[0])
+	j, _ := jsonCodec{}.Marshal(&msgs[0])
+	assert.Less(t, len(b), len(j))
+
+	// Truncated frames are rejected
+	dec := dtype.Message{}
+	for i := 0; i < len(b)-len(msgs[0].Payload); i++ {
+		assert.Equal(t, ErrMalformed, binaryEnvelopeCodec{}.Unmarshal(b[:i], &dec), i)
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	v, codec, err := negotiate(&dtype.Handshake{MinVersion: config.PROTOCOL_MIN_VERSION, MaxVersion: config.PROTOCOL_VERSION + 1, Codec: config.CODEC_BINARY})
+	assert.Nil(t, err)
+	assert.Equal(t, config.PROTOCOL_VERSION, v)
+	assert.Equal(t, config.CODEC_BINARY, codec)
+
+	_, codec, err = negotiate(&dtype.Handshake{MinVersion: config.PROTOCOL_MIN_VERSION, MaxVersion: config.PROTOCOL_VERSION, Codec: "XML"})
+	assert.Nil(t, err)
+	assert.Equal(t, config.CODEC_JSON, codec)
+
+	_, _, err = negotiate(&dtype.Handshake{MinVersion: config.PROTOCOL_VERSION + 1, MaxVersion: config.PROTOCOL_VERSION + 2})
+	assert.ErrorIs(t, err, ErrVersion)
+	_, _, err = negotiate(&dtype.Handshake{MinVersion: 0, MaxVersion: config.PROTOCOL_MIN_VERSION - 1})
+	assert.ErrorIs(t, err, ErrVersion)
+}
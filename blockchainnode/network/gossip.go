@@ -0,0 +1,313 @@
+package network
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/junwookheo/bcsos/common/config"
+	"github.com/junwookheo/bcsos/common/dtype"
+)
+
+// Inventory gossip of new blocks and transactions
+// A node announces the hash of a new object to GossipFanout random peers by MSG_INV instead of pushing the object,
+// a peer requests objects it has not seen by MSG_GET_DATA and announces them again after they are accepted.
+// Hashes are kept in a seen-set for GOSSIP_SEEN_TTL with the peers known to have the object, which are not announced to.
+
+// Inventory types
+const (
+	INV_BLOCK       string = "block"
+	INV_TRANSACTION string = "transaction"
+)
+
+// InventoryGetter returns the object of the hash if the local node has it
+type InventoryGetter func(hash string) (interface{}, bool)
+
+// InventoryHasher decodes an object answered by a peer and returns its hash
+type InventoryHasher func(payload json.RawMessage) (string, error)
+
+// InventoryReceiver handles an object requested to a peer
+type InventoryReceiver func(payload json.RawMessage) error
+
+type seenEntry struct {
+	expire int64
+	peers  map[string]bool // addresses of nodes known to have the object
+}
+
+type seenSet struct {
+	entries map[string]*seenEntry
+	ttl     int64
+	sweep   int64 // the next time to remove expired entries
+}
+
+func newSeenSet(ttl time.Duration) *seenSet {
+	return &seenSet{entries: make(map[string]*seenEntry), ttl: int64(ttl), sweep: time.Now().UnixNano() + int64(ttl)}
+}
+
+// mark returns false if the key was seen before, expired keys are removed every ttl
+func (s *seenSet) mark(key string, now int64) bool {
+	if s.sweep <= now {
+		for k, e := range s.entries {
+			if e.expire <= now {
+				delete(s.entries, k)
+			}
+		}
+		s.sweep = now + s.ttl
+	}
+
+	if e, ok := s.entries[key]; ok && now < e.expire {
+		return false
+	}
+
+	s.entries[key] = &seenEntry{expire: now + s.ttl, peers: make(map[string]bool)}
+	return true
+}
+
+func (s *seenSet) addPeer(key string, addr string) {
+	if e, ok := s.entries[key]; ok {
+		e.peers[addr] = true
+	}
+}
+
+func (s *seenSet) forget(key string) {
+	delete(s.entries, key)
+}
+
+type Gossip struct {
+	pm        *PeerMgr
+	local     *dtype.NodeInfo
+	peers     func() []dtype.NodeInfo // candidates to announce to
+	seen      *seenSet
+	getters   map[string]InventoryGetter
+	hashers   map[string]InventoryHasher
+	receivers map[string]InventoryReceiver
+	stat      dtype.GossipStat
+	mutex     sync.Mutex
+}
+
+var (
+	gossip     *Gossip
+	oncegossip sync.Once
+)
+
+// NewGossip returns gossip of the local node through the peer manager
+func NewGossip(pm *PeerMgr, local *dtype.NodeInfo, peers func() []dtype.NodeInfo) *Gossip {
+	g := &Gossip{
+		pm:        pm,
+		local:     local,
+		peers:     peers,
+		seen:      newSeenSet(time.Duration(config.GOSSIP_SEEN_TTL) * time.Second),
+		getters:   make(map[string]InventoryGetter),
+		hashers:   make(map[string]InventoryHasher),
+		receivers: make(map[string]InventoryReceiver),
+		mutex:     sync.Mutex{},
+	}
+	pm.Handle(MSG_INV, g.invMessage)
+	pm.Handle(MSG_GET_DATA, g.getDataMessage)
+
+	return g
+}
+
+func GossipInst() *Gossip {
+	oncegossip.Do(func() {
+		gossip = NewGossip(PeerMgrInst(), NodeInfoInst().GetLocalddr(), func() []dtype.NodeInfo {
+			var nodes [(config.MAX_SC) * config.MAX_SC_PEER]dtype.NodeInfo
+			NodeMgrInst().GetSCNNodeListAll(&nodes)
+
+			peers := []dtype.NodeInfo{}
+			for _, node := range nodes {
+				if node.IP != "" {
+					peers = append(peers, node)
+				}
+			}
+			return peers
+		})
+	})
+
+	return gossip
+}
+
+// Register sets functions to get, hash and receive objects of the inventory type
+func (g *Gossip) Register(invType string, get InventoryGetter, hash InventoryHasher, receive InventoryReceiver) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	g.getters[invType] = get
+	g.hashers[invType] = hash
+	g.receivers[invType] = receive
+}
+
+func invKey(invType string, hash string) string {
+	return invType + ":" + hash
+}
+
+func address(node *dtype.NodeInfo) string {
+	return fmt.Sprintf("%v:%v", node.IP, node.Port)
+}
+
+// Seen marks the object pushed by a peer as seen, it returns false if it was seen before
+// size is the bytes of the object, they are counted as duplicates if it was seen.
+func (g *Gossip) Seen(invType string, hash string, size int) bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	g.stat.Received++
+	g.stat.Bytes += int64(size)
+	if g.seen.mark(invKey(invType, hash), time.Now().UnixNano()) {
+		return true
+	}
+
+	g.stat.Duplicates++
+	g.stat.DuplicateBytes += int64(size)
+	return false
+}
+
+// Announce sends the hash of an object accepted by the local node to GossipFanout random peers not known to have it
+func (g *Gossip) Announce(invType string, hash string) {
+	key := invKey(invType, hash)
+	known := map[string]bool{address(g.local): true}
+
+	g.mutex.Lock()
+	g.seen.mark(key, time.Now().UnixNano())
+	for addr := range g.seen.entries[key].peers {
+		known[addr] = true
+	}
+	g.mutex.Unlock()
+
+	peers := []dtype.NodeInfo{}
+	for _, node := range g.peers() {
+		if addr := address(&node); !known[addr] {
+			known[addr] = true
+			peers = append(peers, node)
+		}
+	}
+	rand.Shuffle(len(peers), func(i, j int) { peers[i], peers[j] = peers[j], peers[i] })
+	if fanout := config.ConfigInst().GossipFanout; fanout < len(peers) {
+		peers = peers[:fanout]
+	}
+
+	inv := dtype.Inventory{Sender: *g.local, Type: invType, Hashes: []string{hash}}
+	for _, node := range peers {
+		if err := g.pm.Notify(&node, MSG_INV, &inv); err != nil {
+			log.Printf("Announce %v error : %v", invType, err)
+			continue
+		}
+
+		g.mutex.Lock()
+		g.stat.InvSent++
+		g.seen.addPeer(key, address(&node))
+		g.mutex.Unlock()
+	}
+}
+
+// invMessage requests objects announced which are not seen to the sender
+// Request : inventory of new objects
+// Response : none
+func (g *Gossip) invMessage(payload json.RawMessage) (interface{}, error) {
+	inv := dtype.Inventory{}
+	if err := json.Unmarshal(payload, &inv); err != nil {
+		return nil, err
+	}
+
+	g.mutex.Lock()
+	if _, ok := g.receivers[inv.Type]; !ok {
+		g.mutex.Unlock()
+		return nil, fmt.Errorf("unknown inventory type : %v", inv.Type)
+	}
+
+	now := time.Now().UnixNano()
+	missing := []string{}
+	for _, hash := range inv.Hashes {
+		key := invKey(inv.Type, hash)
+		g.stat.InvReceived++
+		if g.seen.mark(key, now) {
+			missing = append(missing, hash)
+		} else {
+			g.stat.InvDuplicates++
+		}
+		g.seen.addPeer(key, address(&inv.Sender))
+	}
+	g.mutex.Unlock()
+
+	if len(missing) != 0 {
+		g.fetch(&inv.Sender, inv.Type, missing)
+	}
+
+	return nil, nil
+}
+
+// fetch requests objects to the node, objects not received are forgotten so that other announcements are accepted
+// An object of another hash is also forgotten and the node is reported as misbehaving.
+func (g *Gossip) fetch(node *dtype.NodeInfo, invType string, hashes []string) {
+	g.mutex.Lock()
+	hashOf := g.hashers[invType]
+	receive := g.receivers[invType]
+	g.stat.Requested += len(hashes)
+	g.mutex.Unlock()
+
+	objs := map[string]json.RawMessage{}
+	if err := g.pm.Request(node, MSG_GET_DATA, &dtype.ReqGetData{Type: invType, Hashes: hashes}, &objs); err != nil {
+		log.Printf("Get %v error : %v", invType, err)
+	}
+
+	for _, hash := range hashes {
+		obj, ok := objs[hash]
+		if ok {
+			if h, err := hashOf(obj); err != nil || h != hash {
+				NodeMgrInst().ReportMisbehavior(node, fmt.Sprintf("%v %v answered as %v, %v", invType, hash, h, err))
+				ok = false
+			}
+		}
+
+		g.mutex.Lock()
+		if !ok {
+			g.seen.forget(invKey(invType, hash))
+			g.mutex.Unlock()
+			continue
+		}
+		g.stat.Received++
+		g.stat.Bytes += int64(len(obj))
+		g.mutex.Unlock()
+
+		if err := receive(obj); err != nil {
+			log.Printf("Receive %v %v error : %v", invType, hash, err)
+		}
+	}
+}
+
+// getDataMessage returns objects kept by the local node
+// Request : inventory type and hashes
+// Response : objects by hash
+func (g *Gossip) getDataMessage(payload json.RawMessage) (interface{}, error) {
+	req := dtype.ReqGetData{}
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return nil, err
+	}
+
+	g.mutex.Lock()
+	get, ok := g.getters[req.Type]
+	g.mutex.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown inventory type : %v", req.Type)
+	}
+
+	objs := map[string]interface{}{}
+	for _, hash := range req.Hashes {
+		if obj, ok := get(hash); ok {
+			objs[hash] = obj
+		}
+	}
+
+	return objs, nil
+}
+
+// Status returns the gossip statistics of the node
+func (g *Gossip) Status() dtype.GossipStat {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	return g.stat
+}
@@ -0,0 +1,156 @@
+package network
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/junwookheo/bcsos/common/config"
+	"github.com/junwookheo/bcsos/common/dtype"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSeenSet(t *testing.T) {
+	s := newSeenSet(time.Second)
+	now := time.Now().UnixNano()
+	assert.True(t, s.mark("a", now))
+	assert.False(t, s.mark("a", now+1))
+	assert.True(t, s.mark("b", now+int64(time.Second)/2))
+
+	// Expired keys are seen again and removed by the sweep
+	later := now + int64(time.Second)
+	assert.True(t, s.mark("a", later))
+	assert.Equal(t, 2, len(s.entries))
+	assert.True(t, s.mark("c", later+int64(time.Second)))
+	assert.Equal(t, 1, len(s.entries))
+}
+
+// gossipNode keeps objects received and announces them again
+type gossipNode struct {
+	g     *Gossip
+	objs  map[string]string
+	mutex sync.Mutex
+}
+
+func (n *gossipNode) get(hash string) (interface{}, bool) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	obj, ok := n.objs[hash]
+	return obj, ok
+}
+
+func (n *gossipNode) has(hash string) bool {
+	_, ok := n.get(hash)
+	return ok
+}
+
+func (n *gossipNode) add(hash string, obj string) {
+	n.mutex.Lock()
+	n.objs[hash] = obj
+	n.mutex.Unlock()
+
+	n.g.Announce(INV_TRANSACTION, hash)
+}
+
+func TestGossip(t *testing.T) {
+	defer setIdentity(t)()
+	defer config.SetConfig(config.DefaultConfig())
+
+	// Peers of each node are all the others
+	var pms []*PeerMgr
+	var infos []dtype.NodeInfo
+	for i := 0; i < 4; i++ {
+		pm := NewPeerMgr()
+		s, info := peerServer(pm)
+		defer s.Close()
+		defer pm.Close()
+		info.Hash = NodeInfoInst().GetLocalddr().Hash
+		pms = append(pms, pm)
+		infos = append(infos, info)
+	}
+
+	var nodes []*gossipNode
+	for i := range infos {
+		n := &gossipNode{objs: make(map[string]string)}
+		n.g = NewGossip(pms[i], &infos[i], func() []dtype.NodeInfo { return infos })
+		n.g.Register(INV_TRANSACTION, n.get, func(payload json.RawMessage) (string, error) {
+			var obj string
+			err := json.Unmarshal(payload, &obj)
+			return obj, err
+		}, func(payload json.RawMessage) error {
+			var obj string
+			if err := json.Unmarshal(payload, &obj); err != nil {
+				return err
+			}
+			n.add(obj, obj)
+			return nil
+		})
+		nodes = append(nodes, n)
+	}
+
+	// The object reaches all nodes and each node receives it once
+	c := config.DefaultConfig()
+	c.GossipFanout = len(nodes) - 1
+	assert.Nil(t, config.SetConfig(c))
+	nodes[0].add("01", "01")
+	assert.Eventually(t, func() bool {
+		for _, n := range nodes {
+			if !n.has("01") {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+
+	total := dtype.GossipStat{}
+	for _, n := range nodes {
+		st := n.g.Status()
+		total.Received += st.Received
+		total.Duplicates += st.Duplicates
+	}
+	assert.Equal(t, len(nodes)-1, total.Received)
+	assert.Equal(t, 0, total.Duplicates)
+
+	// The object is announced to GossipFanout peers, the peer does not receive it as the announcer does not have it
+	c.GossipFanout = 1
+	assert.Nil(t, config.SetConfig(c))
+	sent := nodes[0].g.Status().InvSent
+	nodes[0].g.Announce(INV_TRANSACTION, "02")
+	assert.Equal(t, sent+1, nodes[0].g.Status().InvSent)
+	assert.Eventually(t, func() bool {
+		requested := 0
+		for _, n := range nodes {
+			requested += n.g.Status().Requested
+		}
+		return requested == len(nodes)
+	}, 5*time.Second, 10*time.Millisecond)
+	for _, n := range nodes[1:] {
+		assert.False(t, n.has("02"))
+	}
+
+	// An object of another hash is not received and the announcement is forgotten
+	liarPM := NewPeerMgr()
+	ls, liar := peerServer(liarPM)
+	defer ls.Close()
+	defer liarPM.Close()
+	liar.Hash = NodeInfoInst().GetLocalddr().Hash
+	lg := NewGossip(liarPM, &liar, func() []dtype.NodeInfo { return nil })
+	lg.Register(INV_TRANSACTION, func(hash string) (interface{}, bool) { return "99", true }, nil, nil)
+
+	before := NodeMgrInst().GetMisbehavior(liar.Hash)
+	inv, _ := json.Marshal(dtype.Inventory{Sender: liar, Type: INV_TRANSACTION, Hashes: []string{"04"}})
+	_, err := nodes[1].g.invMessage(inv)
+	assert.Nil(t, err)
+	assert.False(t, nodes[1].has("04"))
+	assert.False(t, nodes[1].has("99"))
+	assert.Equal(t, before+1, NodeMgrInst().GetMisbehavior(liar.Hash))
+	assert.True(t, nodes[1].g.Seen(INV_TRANSACTION, "04", 0))
+
+	// An object pushed again is counted as duplicate bytes
+	g := nodes[1].g
+	assert.False(t, g.Seen(INV_TRANSACTION, "01", 8))
+	assert.True(t, g.Seen(INV_TRANSACTION, "03", 8))
+	assert.Equal(t, int64(8), g.Status().DuplicateBytes)
+}
@@ -1,15 +1,22 @@
 package network
 
 import (
+	"errors"
+	"log"
 	"sync"
 
 	"github.com/junwookheo/bcsos/common/config"
 	"github.com/junwookheo/bcsos/common/dtype"
+	"github.com/junwookheo/bcsos/common/wallet"
 )
 
+var ErrNoWallet = errors.New("no wallet of the local node")
+
+// NodeInfo keeps the local information signed by the wallet of the node, it is signed again whenever it changes
 type NodeInfo struct {
 	local dtype.NodeInfo
 	sim   dtype.NodeInfo
+	w     *wallet.Wallet
 }
 
 var (
@@ -30,15 +37,37 @@ func (ni *NodeInfo) GetLocalddr() *dtype.NodeInfo {
 	return &ni.local
 }
 
-func (ni *NodeInfo) SetLocalddrParam(mode string, sc int, port int, hash string) {
+// SetLocalddrParam sets the local information, the hash is derived from the public key of the wallet
+func (ni *NodeInfo) SetLocalddrParam(mode string, sc int, port int, w *wallet.Wallet) {
 	ni.local.Mode = mode
 	ni.local.SC = sc
 	ni.local.Port = port
-	ni.local.Hash = hash
+	ni.w = w
+	ni.sign()
 }
 
 func (ni *NodeInfo) SetLocalddrIP(ip string) {
 	ni.local.IP = ip
+	ni.sign()
+}
+
+func (ni *NodeInfo) sign() {
+	if ni.w == nil {
+		return
+	}
+
+	if err := ni.local.Sign(ni.w); err != nil {
+		log.Printf("Sign local node error : %v", err)
+	}
+}
+
+// Sign returns the signature of data by the wallet of the local node
+func (ni *NodeInfo) Sign(data []byte) ([]byte, error) {
+	if ni.w == nil {
+		return nil, ErrNoWallet
+	}
+
+	return ni.w.Sign(data)
 }
 
 func NodeInfoInst() *NodeInfo {
@@ -1,20 +1,27 @@
 package network
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"log"
-	"net/http"
+	"math/big"
+	"sort"
 	"sync"
 
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
 	"github.com/junwookheo/bcsos/common/config"
 	"github.com/junwookheo/bcsos/common/dtype"
+	"github.com/junwookheo/bcsos/common/wallet"
 )
 
 type NodeMgr struct {
-	scn   scnInfo //[]dtype.NodeInfo
-	mutex sync.Mutex
+	scn          scnInfo        //[]dtype.NodeInfo
+	misbehaviors map[string]int // the number of misbehaviors by node hash
+	providers    *providerStore
+	mutex        sync.Mutex
 }
 
 var (
@@ -22,100 +29,225 @@ var (
 	once sync.Once
 )
 
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
+// pingNode sends local information to the simulator and receives nodes registered
+func pingNode(node *dtype.NodeInfo, local *dtype.NodeInfo) ([]dtype.NodeInfo, error) {
+	url := fmt.Sprintf("ws://%v:%v/ping", node.IP, node.Port)
+
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer ws.Close()
+
+	if err := ws.WriteJSON(local); err != nil {
+		return nil, err
+	}
+
+	var nodes []dtype.NodeInfo
+	if err := ws.ReadJSON(&nodes); err != nil {
+		return nil, err
+	}
+
+	return nodes, nil
+}
+
+// randomHash returns a random content address to refresh buckets
+func randomHash() string {
+	buf := make([]byte, wallet.ADDR_BITS/8)
+	rand.Read(buf)
+
+	return hex.EncodeToString(buf)
 }
 
 // Update peers list
+// The simulator bootstraps empty routing tables, then the local node and a random target are looked up in each storage class
 func (n *NodeMgr) UpdatePeerList(sim *dtype.NodeInfo, local *dtype.NodeInfo) {
-	sendPing := func(node dtype.NodeInfo) {
-		url := fmt.Sprintf("ws://%v:%v/ping", node.IP, node.Port)
-		//log.Printf("Send ping with local info : %v", url)
+	cfg := config.ConfigInst()
+	for sc := 0; sc < cfg.NumSC; sc++ {
+		if n.scn.Size(sc) != 0 {
+			continue
+		}
 
-		ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+		nodes, err := pingNode(sim, local)
 		if err != nil {
-			if node.Hash != "" {
-				n.scn.DeleteSCNNode(node)
-				log.Printf("Remove node because ping error : %v", err)
-			}
+			log.Printf("Bootstrap error : %v", err)
 			return
 		}
-		defer ws.Close()
+		for _, nh := range nodes {
+			n.scn.AddNSCNNode(nh)
+		}
+		break
+	}
 
-		if err := ws.WriteJSON(local); err != nil {
-			log.Printf("Write json error : %v", err)
-			return
+	for sc := 0; sc < cfg.NumSC; sc++ {
+		n.FindNode(sc, local.Hash)
+		n.FindNode(sc, randomHash())
+	}
+
+	//n.scn.ShowSCNNodeList()
+}
+
+// sortByDistance sorts nodes by XOR distance to target
+func sortByDistance(nodes []dtype.NodeInfo, target string) {
+	dists := make(map[string]*big.Int, len(nodes))
+	for _, node := range nodes {
+		dists[node.Hash] = wallet.DistanceXor(target, node.Hash)
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return dists[nodes[i].Hash].Cmp(dists[nodes[j].Hash]) < 0
+	})
+}
+
+// lookup queries nodes of the storage class closest to target iteratively
+// KAD_ALPHA closest nodes not queried yet are queried in parallel until the k closest nodes have been queried or query is done.
+// It returns the k closest nodes and the number of nodes queried.
+func (n *NodeMgr) lookup(sc int, target string, query func(node *dtype.NodeInfo) ([]dtype.NodeInfo, bool, error)) ([]dtype.NodeInfo, int) {
+	local := NodeInfoInst().GetLocalddr()
+	k := config.ConfigInst().NumSCPeer
+
+	shortlist := n.scn.FindClosest(sc, target)
+	queried := map[string]bool{}
+	failed := map[string]bool{}
+	done := false
+	for !done {
+		var next []dtype.NodeInfo
+		for _, node := range shortlist {
+			if len(next) == config.KAD_ALPHA {
+				break
+			}
+			if !queried[node.Hash] {
+				queried[node.Hash] = true
+				next = append(next, node)
+			}
+		}
+		if len(next) == 0 {
+			break
 		}
 
-		var nodes []dtype.NodeInfo
-		if err := ws.ReadJSON(&nodes); err != nil {
-			log.Printf("Read json error : %v", err)
-			return
+		results := make([][]dtype.NodeInfo, len(next))
+		dones := make([]bool, len(next))
+		errs := make([]error, len(next))
+		var wg sync.WaitGroup
+		for i := range next {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				results[i], dones[i], errs[i] = query(&next[i])
+			}(i)
 		}
-		//log.Printf("Read json nodes : %v", nodes)
-		for _, nh := range nodes {
-			if nh.Hash != "" && nh.Hash != local.Hash {
-				n.scn.AddNSCNNode(nh)
+		wg.Wait()
+
+		for i, node := range next {
+			if errs[i] != nil {
+				log.Printf("Remove node because lookup error : %v", errs[i])
+				n.scn.DeleteSCNNode(node)
+				failed[node.Hash] = true
+				continue
+			}
+
+			done = done || dones[i]
+			n.scn.AddNSCNNode(node)
+			for _, found := range results[i] {
+				if err := n.scn.AddNSCNNode(found); err != nil {
+					log.Printf("Ignore node found : %v", err)
+					continue
+				}
+				if (sc != ALL_SC && found.SC != sc) || found.Hash == "" || found.Hash == local.Hash || failed[found.Hash] || indexOf(shortlist, found.Hash) != -1 {
+					continue
+				}
+				shortlist = append(shortlist, found)
 			}
 		}
-	}
 
-	checked := false
-	for i := 0; i < config.MAX_SC; i++ {
-		var nodes [config.MAX_SC_PEER]dtype.NodeInfo
-		if n.scn.GetSCNNodeList(i, &nodes) {
-			for _, node := range nodes {
-				sendPing(node)
-				checked = true
+		closest := []dtype.NodeInfo{}
+		for _, node := range shortlist {
+			if !failed[node.Hash] {
+				closest = append(closest, node)
 			}
 		}
+		sortByDistance(closest, target)
+		if k < len(closest) {
+			closest = closest[:k]
+		}
+		shortlist = closest
 	}
 
-	if !checked {
-		sendPing(*sim)
-	}
+	return shortlist, len(queried)
+}
 
-	//n.scn.ShowSCNNodeList()
+// FindNode looks up k nodes of the storage class closest to target, sc is ALL_SC for all storage classes
+func (n *NodeMgr) FindNode(sc int, target string) []dtype.NodeInfo {
+	req := dtype.ReqFindNode{Sender: *NodeInfoInst().GetLocalddr(), SC: sc, Target: target}
+	nodes, _ := n.lookup(sc, target, func(node *dtype.NodeInfo) ([]dtype.NodeInfo, bool, error) {
+		found, err := queryFindNode(node, &req)
+		return found, false, err
+	})
+
+	return nodes
 }
 
-// Send response to connector with its local information
-func (n *NodeMgr) pingHandler(w http.ResponseWriter, r *http.Request) {
-	upgrader.CheckOrigin = func(r *http.Request) bool { return true }
-	ws, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		log.Println("pingHandler", err)
-		return
+func queryFindNode(node *dtype.NodeInfo, req *dtype.ReqFindNode) ([]dtype.NodeInfo, error) {
+	var nodes []dtype.NodeInfo
+	err := PeerMgrInst().Request(node, MSG_FIND_NODE, req, &nodes)
+
+	return nodes, err
+}
+
+// findNodeMessage returns nodes closest to the target in the storage class
+// Request : sender, storage class and target
+// Response : k closest peers and the local node if it is in the storage class
+func (n *NodeMgr) findNodeMessage(payload json.RawMessage) (interface{}, error) {
+	req := dtype.ReqFindNode{}
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return nil, err
 	}
-	defer ws.Close()
 
-	peer := dtype.NodeInfo{}
-	if err := ws.ReadJSON(&peer); err != nil {
-		log.Printf("Read json error : %v", err)
-		return
+	if err := n.scn.AddNSCNNode(req.Sender); err != nil {
+		return nil, err
 	}
-	//log.Printf("receive peer addr : %v", peer)
 
-	// Received peer info so add it to peer list
-	ni := NodeInfoInst()
-	local := ni.GetLocalddr()
-	nm := NodeMgrInst()
+	local := NodeInfoInst().GetLocalddr()
+	nodes := n.scn.FindClosest(req.SC, req.Target)
+	if req.SC == ALL_SC || local.SC == req.SC {
+		nodes = append(nodes, *local)
+	}
 
+	return nodes, nil
+}
+
+// ping adds the peer and returns peers of all storage classes, the peer not verified is refused
+func (n *NodeMgr) ping(peer *dtype.NodeInfo) (*[(config.MAX_SC) * config.MAX_SC_PEER]dtype.NodeInfo, error) {
+	local := NodeInfoInst().GetLocalddr()
 	if peer.Hash != "" && peer.Hash != local.Hash {
-		nm.AddNSCNNode(peer)
+		if err := n.AddNSCNNode(*peer); err != nil {
+			return nil, err
+		}
 	}
 
-	// Send peers info to the connector
 	var nodes [(config.MAX_SC) * config.MAX_SC_PEER]dtype.NodeInfo
-	nm.GetSCNNodeListAll(&nodes)
-	if err := ws.WriteJSON(nodes); err != nil {
-		log.Printf("Write json error : %v", err)
-		return
+	n.GetSCNNodeListAll(&nodes)
+
+	return &nodes, nil
+}
+
+// pingMessage is the ping of peer connections
+// Request : local information of the peer
+// Response : peers of all storage classes
+func (n *NodeMgr) pingMessage(payload json.RawMessage) (interface{}, error) {
+	peer := dtype.NodeInfo{}
+	if err := json.Unmarshal(payload, &peer); err != nil {
+		return nil, err
 	}
+
+	return n.ping(&peer)
+}
+
+func (n *NodeMgr) AddNSCNNode(node dtype.NodeInfo) error {
+	return n.scn.AddNSCNNode(node)
 }
 
-func (n *NodeMgr) AddNSCNNode(node dtype.NodeInfo) {
-	n.scn.AddNSCNNode(node)
+func (n *NodeMgr) SetReputation(hash string, score float64) {
+	n.scn.SetReputation(hash, score)
 }
 
 func (n *NodeMgr) GetSCNNodeListbyDistance(sc int, oid string, nodes *[config.MAX_SC_PEER]dtype.NodeInfo) bool {
@@ -126,8 +258,30 @@ func (n *NodeMgr) GetSCNNodeListAll(nodes *[(config.MAX_SC) * config.MAX_SC_PEER
 	n.scn.GetSCNNodeListAll(nodes)
 }
 
+// ReportMisbehavior records the node which sent an invalid response
+func (n *NodeMgr) ReportMisbehavior(node *dtype.NodeInfo, reason string) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	n.misbehaviors[node.Hash]++
+	log.Printf("Misbehaving node(%v) %v:%v : %v", n.misbehaviors[node.Hash], node.IP, node.Port, reason)
+}
+
+func (n *NodeMgr) GetMisbehavior(hash string) int {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	return n.misbehaviors[hash]
+}
+
 func (n *NodeMgr) SetHttpRouter(m *mux.Router) {
-	m.HandleFunc("/ping", n.pingHandler)
+	p := PeerMgrInst()
+	m.HandleFunc("/peer", p.PeerHandler)
+
+	p.Handle(MSG_PING, n.pingMessage)
+	p.Handle(MSG_FIND_NODE, n.findNodeMessage)
+	p.Handle(MSG_FIND_VALUE, n.findValueMessage)
+	p.Handle(MSG_ADD_PROVIDER, n.addProviderMessage)
 }
 
 func (n *NodeMgr) GetTargetList(sc int, nodes *[config.MAX_SC_PEER]dtype.NodeInfo) bool {
@@ -137,8 +291,14 @@ func (n *NodeMgr) GetTargetList(sc int, nodes *[config.MAX_SC_PEER]dtype.NodeInf
 func NodeMgrInst() *NodeMgr {
 	once.Do(func() {
 		nm = &NodeMgr{
-			scn:   *NewSCNInfo(),
-			mutex: sync.Mutex{},
+			scn:          *NewSCNInfo(),
+			misbehaviors: make(map[string]int),
+			providers:    newProviderStore(),
+			mutex:        sync.Mutex{},
+		}
+		nm.scn.ping = func(node dtype.NodeInfo) bool {
+			var nodes []dtype.NodeInfo
+			return PeerMgrInst().Request(&node, MSG_PING, NodeInfoInst().GetLocalddr(), &nodes) == nil
 		}
 	})
 
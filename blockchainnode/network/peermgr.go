@@ -0,0 +1,574 @@
+package network
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/junwookheo/bcsos/common/config"
+	"github.com/junwookheo/bcsos/common/dtype"
+	"github.com/junwookheo/bcsos/common/wallet"
+)
+
+// Peer connections
+// A node keeps one long-lived websocket to each peer at /peer and messages are sent in dtype.Message envelopes.
+// The dialer sends MSG_HELLO first and the connection is refused if protocol versions of both nodes do not overlap,
+// the highest common version and the codec negotiated are used for the other messages.
+// Both nodes sign the challenge of each other in the handshake, so a node cannot claim the hash of another node.
+// Requests are multiplexed by ID and a reply has the ID of its request, a notification has ID 0 and no reply.
+// An accepted connection is kept by the address the peer signed, so both nodes send messages over one connection.
+// A broken connection is redialed on the next message with exponential backoff.
+
+// Message types between peers
+const (
+	MSG_HELLO        string = "hello"
+	MSG_REPLY        string = "reply"
+	MSG_PING         string = "ping"
+	MSG_FIND_NODE    string = "findnode"
+	MSG_FIND_VALUE   string = "findvalue"
+	MSG_ADD_PROVIDER string = "addprovider"
+	MSG_NEW_BLOCK    string = "newblock"
+	MSG_TRANSACTION  string = "transaction"
+	MSG_GET_OBJECT   string = "getobject"
+	MSG_PROOF_STORE  string = "proofstorage"
+	MSG_INV          string = "inv"
+	MSG_GET_DATA     string = "getdata"
+	MSG_GET_BLOCK    string = "getblock"
+	MSG_GET_HEADERS  string = "getheaders"
+	MSG_PUT_SHARD    string = "putshard"
+	MSG_GET_SHARD    string = "getshard"
+	MSG_AUDIT        string = "auditreplica"
+	MSG_PUT_REPLICA  string = "putreplica"
+)
+
+var ErrConnClosed = errors.New("peer connection closed")
+var ErrBackoff = errors.New("peer connection is backing off")
+var ErrVersion = errors.New("incompatible protocol version")
+
+// MessageHandler handles the payload of a request, the result is the payload of the reply
+type MessageHandler func(payload json.RawMessage) (interface{}, error)
+
+type peerConn struct {
+	ws      *websocket.Conn
+	peer    dtype.NodeInfo // verified in the handshake
+	codec   Codec
+	version uint16
+	wmutex  sync.Mutex // websocket supports one writer at a time
+	pending map[uint64]chan *dtype.Message
+	nextID  uint64
+	closed  bool
+	mutex   sync.Mutex
+}
+
+// backoff delays dialing a peer after failures
+type backoff struct {
+	fails int
+	next  time.Time
+}
+
+type PeerMgr struct {
+	conns    map[string]*peerConn // connections by address of the peer
+	backoffs map[string]*backoff
+	handlers map[string]MessageHandler
+	mutex    sync.Mutex
+}
+
+var (
+	pm     *PeerMgr
+	oncepm sync.Once
+)
+
+// upgrader accepts peers of any origin, it is not changed by handlers as they run concurrently
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	CheckOrigin:     func(r *http.Request) bool { return true },
+}
+
+func NewPeerMgr() *PeerMgr {
+	return &PeerMgr{
+		conns:    make(map[string]*peerConn),
+		backoffs: make(map[string]*backoff),
+		handlers: make(map[string]MessageHandler),
+		mutex:    sync.Mutex{},
+	}
+}
+
+func PeerMgrInst() *PeerMgr {
+	oncepm.Do(func() {
+		pm = NewPeerMgr()
+	})
+
+	return pm
+}
+
+// Handle registers the handler of the message type
+func (p *PeerMgr) Handle(msgType string, h MessageHandler) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.handlers[msgType] = h
+}
+
+func newPeerConn(ws *websocket.Conn, codec Codec, version uint16, peer dtype.NodeInfo) *peerConn {
+	return &peerConn{ws: ws, peer: peer, codec: codec, version: version, pending: make(map[uint64]chan *dtype.Message), nextID: 1}
+}
+
+// negotiate returns the highest version supported by both nodes and the codec, JSON if the codec is unknown
+func negotiate(hs *dtype.Handshake) (uint16, string, error) {
+	version := config.PROTOCOL_VERSION
+	if hs.MaxVersion < version {
+		version = hs.MaxVersion
+	}
+	if version < config.PROTOCOL_MIN_VERSION || version < hs.MinVersion {
+		return 0, "", fmt.Errorf("%w : peer %v~%v, local %v~%v", ErrVersion, hs.MinVersion, hs.MaxVersion, config.PROTOCOL_MIN_VERSION, config.PROTOCOL_VERSION)
+	}
+
+	if _, ok := codecs[hs.Codec]; !ok {
+		return version, config.CODEC_JSON, nil
+	}
+
+	return version, hs.Codec, nil
+}
+
+// newChallenge returns random bytes the other node signs in the handshake
+func newChallenge() []byte {
+	buf := make([]byte, 32)
+	rand.Read(buf)
+
+	return buf
+}
+
+// accept answers the handshake of the dialer
+func accept(ws *websocket.Conn) (*peerConn, error) {
+	deadline := time.Now().Add(time.Duration(config.PEER_TIMEOUT) * time.Second)
+	ws.SetReadDeadline(deadline)
+	ws.SetWriteDeadline(deadline)
+
+	msg := dtype.Message{}
+	if err := ws.ReadJSON(&msg); err != nil {
+		return nil, err
+	}
+
+	hs := dtype.Handshake{}
+	var version uint16
+	var codec string
+	var err error
+	if msg.Type != MSG_HELLO {
+		err = fmt.Errorf("%w : %v before %v", ErrVersion, msg.Type, MSG_HELLO)
+	} else if err = json.Unmarshal(msg.Payload, &hs); err == nil {
+		if version, codec, err = negotiate(&hs); err == nil {
+			err = hs.Node.Verify()
+		}
+	}
+
+	reply := dtype.Message{Version: version, Type: MSG_REPLY, ID: msg.ID}
+	res := dtype.Handshake{MinVersion: version, MaxVersion: version, Codec: codec, Node: *NodeInfoInst().GetLocalddr(), Challenge: newChallenge()}
+	if err == nil {
+		res.Signature, err = NodeInfoInst().Sign(hs.Challenge)
+	}
+	if err != nil {
+		reply.Version, reply.Error = config.PROTOCOL_VERSION, err.Error()
+		ws.WriteJSON(&reply)
+		return nil, err
+	}
+
+	reply.Payload, _ = json.Marshal(res)
+	if err := ws.WriteJSON(&reply); err != nil {
+		return nil, err
+	}
+
+	// The dialer proves it owns the key of its node
+	proof := dtype.Handshake{}
+	if err := ws.ReadJSON(&msg); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(msg.Payload, &proof); err != nil {
+		return nil, err
+	}
+	if msg.Type != MSG_HELLO || !wallet.VerifySignature(hs.Node.PubKey, res.Challenge, proof.Signature) {
+		return nil, fmt.Errorf("%w : bad handshake signature of %v", dtype.ErrNodeIdentity, hs.Node.Hash)
+	}
+	ws.SetReadDeadline(time.Time{})
+
+	return newPeerConn(ws, codecs[codec], version, hs.Node), nil
+}
+
+// handshake sends MSG_HELLO to the node accepting the connection
+// The node is refused if it is not the node dialed.
+func handshake(ws *websocket.Conn, node *dtype.NodeInfo) (*peerConn, error) {
+	deadline := time.Now().Add(time.Duration(config.PEER_TIMEOUT) * time.Second)
+	ws.SetReadDeadline(deadline)
+	ws.SetWriteDeadline(deadline)
+
+	hs := dtype.Handshake{MinVersion: config.PROTOCOL_MIN_VERSION, MaxVersion: config.PROTOCOL_VERSION, Codec: config.ConfigInst().WireCodec,
+		Node: *NodeInfoInst().GetLocalddr(), Challenge: newChallenge()}
+	payload, _ := json.Marshal(hs)
+	if err := ws.WriteJSON(&dtype.Message{Version: config.PROTOCOL_VERSION, Type: MSG_HELLO, ID: 1, Payload: payload}); err != nil {
+		return nil, err
+	}
+
+	reply := dtype.Message{}
+	if err := ws.ReadJSON(&reply); err != nil {
+		return nil, err
+	}
+	if reply.Error != "" {
+		return nil, errors.New(reply.Error)
+	}
+	res := dtype.Handshake{}
+	if err := json.Unmarshal(reply.Payload, &res); err != nil {
+		return nil, err
+	}
+
+	codec, ok := codecs[res.Codec]
+	if !ok || res.MaxVersion < config.PROTOCOL_MIN_VERSION || config.PROTOCOL_VERSION < res.MaxVersion {
+		return nil, fmt.Errorf("%w : version %v, codec %v", ErrVersion, res.MaxVersion, res.Codec)
+	}
+	if err := res.Node.Verify(); err != nil {
+		return nil, err
+	}
+	if node.Hash != "" && node.Hash != res.Node.Hash {
+		return nil, fmt.Errorf("%w : %v instead of %v", dtype.ErrNodeIdentity, res.Node.Hash, node.Hash)
+	}
+	if !wallet.VerifySignature(res.Node.PubKey, hs.Challenge, res.Signature) {
+		return nil, fmt.Errorf("%w : bad handshake signature of %v", dtype.ErrNodeIdentity, res.Node.Hash)
+	}
+
+	sig, err := NodeInfoInst().Sign(res.Challenge)
+	if err != nil {
+		return nil, err
+	}
+	payload, _ = json.Marshal(dtype.Handshake{Signature: sig})
+	if err := ws.WriteJSON(&dtype.Message{Version: res.MaxVersion, Type: MSG_HELLO, ID: 2, Payload: payload}); err != nil {
+		return nil, err
+	}
+	ws.SetReadDeadline(time.Time{})
+
+	return newPeerConn(ws, codec, res.MaxVersion, res.Node), nil
+}
+
+func (c *peerConn) write(msg *dtype.Message) error {
+	msg.Version = c.version
+	data, err := c.codec.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	c.wmutex.Lock()
+	defer c.wmutex.Unlock()
+
+	c.ws.SetWriteDeadline(time.Now().Add(time.Duration(config.PEER_TIMEOUT) * time.Second))
+	return c.ws.WriteMessage(c.codec.FrameType(), data)
+}
+
+// read returns the next message, the connection is broken if the message is not of the version negotiated
+func (c *peerConn) read(msg *dtype.Message) error {
+	_, data, err := c.ws.ReadMessage()
+	if err != nil {
+		return err
+	}
+
+	if err := c.codec.Unmarshal(data, msg); err != nil {
+		return err
+	}
+	if msg.Version != c.version {
+		return fmt.Errorf("%w : %v, negotiated %v", ErrVersion, msg.Version, c.version)
+	}
+
+	return nil
+}
+
+// register returns the ID of a new request and the channel of its reply
+func (c *peerConn) register() (uint64, chan *dtype.Message, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.closed {
+		return 0, nil, ErrConnClosed
+	}
+
+	id := c.nextID
+	c.nextID++
+	ch := make(chan *dtype.Message, 1)
+	c.pending[id] = ch
+
+	return id, ch, nil
+}
+
+func (c *peerConn) unregister(id uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	delete(c.pending, id)
+}
+
+func (c *peerConn) deliver(msg *dtype.Message) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if ch, ok := c.pending[msg.ID]; ok {
+		ch <- msg
+		delete(c.pending, msg.ID)
+	}
+}
+
+// close fails all pending requests
+func (c *peerConn) close() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.closed {
+		return
+	}
+	c.closed = true
+	c.ws.Close()
+	for id, ch := range c.pending {
+		close(ch)
+		delete(c.pending, id)
+	}
+}
+
+// serve reads messages until the connection is broken, requests are handled concurrently
+func (p *PeerMgr) serve(c *peerConn) {
+	defer c.close()
+
+	for {
+		msg := dtype.Message{}
+		if err := c.read(&msg); err != nil {
+			if errors.Is(err, ErrVersion) || errors.Is(err, ErrMalformed) {
+				log.Printf("Read message error of %v:%v : %v", c.peer.IP, c.peer.Port, err)
+			}
+			return
+		}
+
+		if msg.Type == MSG_REPLY {
+			c.deliver(&msg)
+			continue
+		}
+
+		go p.dispatch(c, &msg)
+	}
+}
+
+// handle runs the handler, a panic of the handler is returned as an error so that a bad message does not stop the node
+func (p *PeerMgr) handle(h MessageHandler, payload json.RawMessage) (res interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			res, err = nil, fmt.Errorf("handler panic : %v", r)
+		}
+	}()
+
+	return h(payload)
+}
+
+func (p *PeerMgr) dispatch(c *peerConn, msg *dtype.Message) {
+	p.mutex.Lock()
+	h, ok := p.handlers[msg.Type]
+	p.mutex.Unlock()
+
+	reply := dtype.Message{Type: MSG_REPLY, ID: msg.ID}
+	if !ok {
+		reply.Error = fmt.Sprintf("unknown message type : %v", msg.Type)
+	} else if res, err := p.handle(h, msg.Payload); err != nil {
+		reply.Error = err.Error()
+	} else if reply.Payload, err = json.Marshal(res); err != nil {
+		reply.Error = err.Error()
+	}
+
+	if msg.ID == 0 {
+		if reply.Error != "" {
+			log.Printf("Handle %v error : %v", msg.Type, reply.Error)
+		}
+		return
+	}
+
+	if err := c.write(&reply); err != nil {
+		log.Printf("Write reply error : %v", err)
+	}
+}
+
+// PeerHandler accepts a connection from a peer
+func (p *PeerMgr) PeerHandler(w http.ResponseWriter, r *http.Request) {
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println("PeerHandler", err)
+		return
+	}
+	ws.SetReadLimit(config.PEER_READ_LIMIT)
+
+	c, err := accept(ws)
+	if err != nil {
+		log.Printf("Peer handshake error : %v", err)
+		ws.Close()
+		return
+	}
+
+	// The peer is reached by the connection it opened, unless both nodes dialed at the same time
+	addr := address(&c.peer)
+	p.mutex.Lock()
+	if _, ok := p.conns[addr]; !ok {
+		p.conns[addr] = c
+		delete(p.backoffs, addr)
+	}
+	p.mutex.Unlock()
+
+	p.run(addr, c)
+}
+
+// run serves the connection and removes it when it is broken
+func (p *PeerMgr) run(addr string, c *peerConn) {
+	p.serve(c)
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.conns[addr] == c {
+		delete(p.conns, addr)
+	}
+}
+
+// conn returns the connection to the node, it is dialed if there is no connection
+func (p *PeerMgr) conn(ctx context.Context, node *dtype.NodeInfo) (*peerConn, error) {
+	addr := address(node)
+
+	p.mutex.Lock()
+	c, ok := p.conns[addr]
+	b := p.backoffs[addr]
+	p.mutex.Unlock()
+	// The node at the address can be another node than the one connected
+	if ok && (node.Hash == "" || node.Hash == c.peer.Hash) {
+		return c, nil
+	}
+	if b != nil && time.Now().Before(b.next) {
+		return nil, ErrBackoff
+	}
+
+	dialer := websocket.Dialer{HandshakeTimeout: time.Duration(config.PEER_TIMEOUT) * time.Second}
+	ws, _, err := dialer.DialContext(ctx, fmt.Sprintf("ws://%v/peer", addr), nil)
+	if err == nil {
+		ws.SetReadLimit(config.PEER_READ_LIMIT)
+		if c, err = handshake(ws, node); err != nil {
+			ws.Close()
+		}
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if err != nil {
+		if b == nil {
+			b = &backoff{}
+			p.backoffs[addr] = b
+		}
+		delay := config.PEER_BACKOFF_MAX
+		if b.fails < 16 && config.PEER_BACKOFF_MIN<<b.fails < delay {
+			delay = config.PEER_BACKOFF_MIN << b.fails
+		}
+		b.fails++
+		b.next = time.Now().Add(time.Duration(delay) * time.Millisecond)
+		return nil, err
+	}
+	delete(p.backoffs, addr)
+
+	// Another request can dial at the same time, otherwise the connection to the node gone is replaced
+	if dup, ok := p.conns[addr]; ok {
+		if dup.peer.Hash == c.peer.Hash {
+			ws.Close()
+			return dup, nil
+		}
+		dup.close()
+	}
+
+	p.conns[addr] = c
+	go p.run(addr, c)
+
+	return c, nil
+}
+
+// RequestContext sends the request to the node and decodes the reply into res
+func (p *PeerMgr) RequestContext(ctx context.Context, node *dtype.NodeInfo, msgType string, req interface{}, res interface{}) error {
+	c, err := p.conn(ctx, node)
+	if err != nil {
+		return err
+	}
+
+	payload, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	id, ch, err := c.register()
+	if err != nil {
+		return err
+	}
+	defer c.unregister(id)
+
+	if err := c.write(&dtype.Message{Type: msgType, ID: id, Payload: payload}); err != nil {
+		c.close()
+		return err
+	}
+
+	select {
+	case msg, ok := <-ch:
+		if !ok {
+			return ErrConnClosed
+		}
+		if msg.Error != "" {
+			return errors.New(msg.Error)
+		}
+		if res == nil {
+			return nil
+		}
+		return json.Unmarshal(msg.Payload, res)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Request sends the request to the node with the default timeout
+func (p *PeerMgr) Request(node *dtype.NodeInfo, msgType string, req interface{}, res interface{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(config.PEER_TIMEOUT)*time.Second)
+	defer cancel()
+
+	return p.RequestContext(ctx, node, msgType, req, res)
+}
+
+// Notify sends the message to the node without reply
+func (p *PeerMgr) Notify(node *dtype.NodeInfo, msgType string, payload interface{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(config.PEER_TIMEOUT)*time.Second)
+	defer cancel()
+
+	c, err := p.conn(ctx, node)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	if err := c.write(&dtype.Message{Type: msgType, ID: 0, Payload: data}); err != nil {
+		c.close()
+		return err
+	}
+
+	return nil
+}
+
+// Close closes all outbound connections
+func (p *PeerMgr) Close() {
+	p.mutex.Lock()
+	conns := p.conns
+	p.conns = make(map[string]*peerConn)
+	p.mutex.Unlock()
+
+	for _, c := range conns {
+		c.close()
+	}
+}
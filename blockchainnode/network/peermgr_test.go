@@ -0,0 +1,172 @@
+package network
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/junwookheo/bcsos/common/config"
+	"github.com/junwookheo/bcsos/common/dtype"
+	"github.com/junwookheo/bcsos/common/wallet"
+	"github.com/stretchr/testify/assert"
+)
+
+func peerServer(p *PeerMgr) (*httptest.Server, dtype.NodeInfo) {
+	s := httptest.NewServer(http.HandlerFunc(p.PeerHandler))
+
+	host, port, _ := net.SplitHostPort(strings.TrimPrefix(s.URL, "http://"))
+	n, _ := strconv.Atoi(port)
+	return s, dtype.NodeInfo{IP: host, Port: n}
+}
+
+// setIdentity signs the local node with a new wallet, it returns the function restoring the local node
+func setIdentity(t *testing.T) func() {
+	ni := NodeInfoInst()
+	old := *ni
+	ni.SetLocalddrParam("ST", 0, 0, wallet.NewWallet(filepath.Join(t.TempDir(), "node.wallet")))
+
+	return func() { *ni = old }
+}
+
+func TestPeerMgr(t *testing.T) {
+	defer setIdentity(t)()
+	server := NewPeerMgr()
+	notified := make(chan string, 1)
+	server.Handle("echo", func(payload json.RawMessage) (interface{}, error) {
+		var v int
+		json.Unmarshal(payload, &v)
+		time.Sleep(time.Duration(10-v) * time.Millisecond)
+		return v, nil
+	})
+	server.Handle("fail", func(payload json.RawMessage) (interface{}, error) {
+		return nil, errors.New("failed")
+	})
+	server.Handle("panic", func(payload json.RawMessage) (interface{}, error) {
+		panic("bad message")
+	})
+	server.Handle("notify", func(payload json.RawMessage) (interface{}, error) {
+		var v string
+		json.Unmarshal(payload, &v)
+		notified <- v
+		return nil, nil
+	})
+	s, node := peerServer(server)
+
+	// Concurrent requests share one connection and replies are matched by ID
+	client := NewPeerMgr()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var v int
+			assert.Nil(t, client.Request(&node, "echo", i, &v))
+			assert.Equal(t, i, v)
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, 1, len(client.conns))
+
+	// The server reaches the client by the connection the client opened
+	client.Handle("echo", func(payload json.RawMessage) (interface{}, error) {
+		return payload, nil
+	})
+	var v int
+	assert.Nil(t, server.Request(NodeInfoInst().GetLocalddr(), "echo", 7, &v))
+	assert.Equal(t, 7, v)
+	assert.Equal(t, 1, len(server.conns))
+
+	assert.EqualError(t, client.Request(&node, "fail", nil, nil), "failed")
+	assert.EqualError(t, client.Request(&node, "none", nil, nil), "unknown message type : none")
+
+	// A panic of the handler is replied as an error and the connection is kept
+	assert.EqualError(t, client.Request(&node, "panic", nil, nil), "handler panic : bad message")
+	assert.Nil(t, client.Notify(&node, "panic", nil))
+	assert.Nil(t, client.Request(&node, "echo", 1, nil))
+
+	assert.Nil(t, client.Notify(&node, "notify", "hello"))
+	assert.Equal(t, "hello", <-notified)
+
+	// The node is not redialed until the backoff expires
+	s.Close()
+	client.Close()
+	assert.NotNil(t, client.Request(&node, "echo", 1, nil))
+	assert.Equal(t, ErrBackoff, client.Request(&node, "echo", 1, nil))
+}
+
+func TestPeerHandshake(t *testing.T) {
+	defer setIdentity(t)()
+	server := NewPeerMgr()
+	server.Handle("echo", func(payload json.RawMessage) (interface{}, error) {
+		return payload, nil
+	})
+	s, node := peerServer(server)
+	defer s.Close()
+
+	// Messages of the binary codec are sent after the handshake
+	cfg := config.DefaultConfig()
+	cfg.WireCodec = config.CODEC_BINARY
+	assert.Nil(t, config.SetConfig(cfg))
+	defer config.SetConfig(config.DefaultConfig())
+
+	client := NewPeerMgr()
+	defer client.Close()
+	var v string
+	assert.Nil(t, client.Request(&node, "echo", "hello", &v))
+	assert.Equal(t, "hello", v)
+	c := client.conns[s.Listener.Addr().String()]
+	assert.Equal(t, binaryEnvelopeCodec{}, c.codec)
+	assert.Equal(t, NodeInfoInst().GetLocalddr().Hash, c.peer.Hash)
+
+	// A message over the read limit breaks the connection
+	assert.NotNil(t, client.Request(&node, "echo", strings.Repeat("a", int(config.PEER_READ_LIMIT)), &v))
+	assert.True(t, c.closed)
+
+	// The connection to another node at the address is closed when the node is dialed
+	url := "ws" + strings.TrimPrefix(s.URL, "http") + "/peer"
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	assert.Nil(t, err)
+	gone := newPeerConn(ws, jsonCodec{}, config.PROTOCOL_VERSION, dtype.NodeInfo{Hash: "01"})
+	client.conns[s.Listener.Addr().String()] = gone
+	known := node
+	known.Hash = NodeInfoInst().GetLocalddr().Hash
+	assert.Nil(t, client.Request(&known, "echo", "hello", &v))
+	assert.True(t, gone.closed)
+	assert.NotEqual(t, gone, client.conns[s.Listener.Addr().String()])
+
+	// A node claiming another hash is refused
+	other := node
+	other.Hash = "00" + c.peer.Hash[2:]
+	assert.ErrorIs(t, NewPeerMgr().Request(&other, "echo", "hello", &v), dtype.ErrNodeIdentity)
+
+	// A node of other versions or not signed is refused
+	unsigned, _ := json.Marshal(dtype.Handshake{MinVersion: config.PROTOCOL_MIN_VERSION, MaxVersion: config.PROTOCOL_VERSION, Node: dtype.NodeInfo{Hash: "01"}})
+	for i, msg := range []dtype.Message{
+		{Type: MSG_HELLO, ID: 1, Payload: json.RawMessage(`{"MinVersion":65000,"MaxVersion":65001}`)},
+		{Type: "echo", ID: 1, Payload: json.RawMessage(`"hello"`)},
+		{Type: MSG_HELLO, ID: 1, Payload: unsigned},
+	} {
+		ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+		assert.Nil(t, err)
+		assert.Nil(t, ws.WriteJSON(&msg))
+
+		reply := dtype.Message{}
+		assert.Nil(t, ws.ReadJSON(&reply))
+		if i < 2 {
+			assert.Contains(t, reply.Error, ErrVersion.Error())
+		} else {
+			assert.Contains(t, reply.Error, dtype.ErrNodeIdentity.Error())
+		}
+		assert.NotNil(t, ws.ReadJSON(&reply))
+		ws.Close()
+	}
+}
@@ -0,0 +1,172 @@
+package network
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/junwookheo/bcsos/common/config"
+	"github.com/junwookheo/bcsos/common/dtype"
+)
+
+// Content routing with provider records
+// A node caching an object announces itself to the k closest nodes to the object hash among all storage classes.
+// A requester finds the providers by an iterative FIND_VALUE lookup instead of walking storage classes in order.
+
+type providerStore struct {
+	records map[string][]dtype.Provider
+	mutex   sync.Mutex
+}
+
+func newProviderStore() *providerStore {
+	return &providerStore{records: make(map[string][]dtype.Provider), mutex: sync.Mutex{}}
+}
+
+// add keeps the latest record of each provider
+func (p *providerStore) add(rec dtype.Provider) {
+	if rec.Hash == "" || rec.Node.Hash == "" {
+		return
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	recs := p.records[rec.Hash]
+	if i := indexOfProvider(recs, rec.Node.Hash); i != -1 {
+		recs = append(recs[:i], recs[i+1:]...)
+	}
+	p.records[rec.Hash] = append(recs, rec)
+}
+
+// get returns records of the object not expired
+func (p *providerStore) get(hash string) []dtype.Provider {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	expire := time.Now().UnixNano() - int64(config.PROVIDER_TTL)*int64(time.Second)
+	recs := []dtype.Provider{}
+	for _, r := range p.records[hash] {
+		if expire < r.Timestamp {
+			recs = append(recs, r)
+		}
+	}
+
+	if len(recs) == 0 {
+		delete(p.records, hash)
+	} else {
+		p.records[hash] = recs
+	}
+
+	return recs
+}
+
+func indexOfProvider(recs []dtype.Provider, hash string) int {
+	for i, r := range recs {
+		if r.Node.Hash == hash {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// Provide announces the local node keeps the object
+func (n *NodeMgr) Provide(hash string) {
+	rec := dtype.Provider{Hash: hash, Node: *NodeInfoInst().GetLocalddr(), Timestamp: time.Now().UnixNano()}
+	n.providers.add(rec)
+
+	for _, node := range n.FindNode(ALL_SC, hash) {
+		putProvider(&node, &rec)
+	}
+}
+
+func putProvider(node *dtype.NodeInfo, rec *dtype.Provider) bool {
+	ok := false
+	if err := PeerMgrInst().Request(node, MSG_ADD_PROVIDER, rec, &ok); err != nil {
+		log.Printf("putProvider error : %v", err)
+		return false
+	}
+
+	return ok
+}
+
+// addProviderMessage keeps a provider record
+// Request : provider record
+// Response : true if it is kept
+func (n *NodeMgr) addProviderMessage(payload json.RawMessage) (interface{}, error) {
+	rec := dtype.Provider{}
+	if err := json.Unmarshal(payload, &rec); err != nil {
+		return nil, err
+	}
+
+	if err := n.scn.AddNSCNNode(rec.Node); err != nil {
+		return nil, err
+	}
+	n.providers.add(rec)
+
+	return true, nil
+}
+
+// FindValue looks up providers of the object
+// It returns the providers and the number of nodes queried
+func (n *NodeMgr) FindValue(hash string) ([]dtype.Provider, int) {
+	local := NodeInfoInst().GetLocalddr()
+	providers := []dtype.Provider{}
+	for _, p := range n.providers.get(hash) {
+		if p.Node.Hash != local.Hash {
+			providers = append(providers, p)
+		}
+	}
+	if len(providers) != 0 {
+		return providers, 0
+	}
+
+	req := dtype.ReqFindValue{Sender: *local, Target: hash}
+	mutex := sync.Mutex{}
+	_, queried := n.lookup(ALL_SC, hash, func(node *dtype.NodeInfo) ([]dtype.NodeInfo, bool, error) {
+		res, err := queryFindValue(node, &req)
+		if err != nil {
+			return nil, false, err
+		}
+
+		mutex.Lock()
+		defer mutex.Unlock()
+		for _, p := range res.Providers {
+			if p.Hash == hash && p.Node.Hash != local.Hash && indexOfProvider(providers, p.Node.Hash) == -1 && p.Node.Verify() == nil {
+				providers = append(providers, p)
+			}
+		}
+		return res.Nodes, len(providers) != 0, nil
+	})
+
+	return providers, queried
+}
+
+func queryFindValue(node *dtype.NodeInfo, req *dtype.ReqFindValue) (*dtype.ResFindValue, error) {
+	res := dtype.ResFindValue{}
+	if err := PeerMgrInst().Request(node, MSG_FIND_VALUE, req, &res); err != nil {
+		return nil, err
+	}
+
+	return &res, nil
+}
+
+// findValueMessage returns providers of the object and nodes closest to it
+// Request : sender and hash of the object
+// Response : provider records and k closest nodes of all storage classes including the local node
+func (n *NodeMgr) findValueMessage(payload json.RawMessage) (interface{}, error) {
+	req := dtype.ReqFindValue{}
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return nil, err
+	}
+
+	if err := n.scn.AddNSCNNode(req.Sender); err != nil {
+		return nil, err
+	}
+
+	res := dtype.ResFindValue{Providers: n.providers.get(req.Target), Nodes: n.scn.FindClosest(ALL_SC, req.Target)}
+	res.Nodes = append(res.Nodes, *NodeInfoInst().GetLocalddr())
+
+	return res, nil
+}
@@ -0,0 +1,28 @@
+package network
+
+import (
+	"testing"
+	"time"
+
+	"github.com/junwookheo/bcsos/common/config"
+	"github.com/junwookheo/bcsos/common/dtype"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProviderStore(t *testing.T) {
+	p := newProviderStore()
+	now := time.Now().UnixNano()
+	expired := now - int64(config.PROVIDER_TTL+1)*int64(time.Second)
+
+	p.add(dtype.Provider{Hash: "01", Node: dtype.NodeInfo{Hash: "a"}, Timestamp: expired})
+	p.add(dtype.Provider{Hash: "01", Node: dtype.NodeInfo{Hash: "b"}, Timestamp: now})
+	p.add(dtype.Provider{Hash: "01", Node: dtype.NodeInfo{Hash: ""}, Timestamp: now})
+	assert.Equal(t, []dtype.Provider{{Hash: "01", Node: dtype.NodeInfo{Hash: "b"}, Timestamp: now}}, p.get("01"))
+
+	// The latest record of a provider is kept
+	p.add(dtype.Provider{Hash: "01", Node: dtype.NodeInfo{Hash: "b", SC: 1}, Timestamp: now + 1})
+	assert.Equal(t, 1, len(p.get("01")))
+	assert.Equal(t, 1, p.get("01")[0].Node.SC)
+
+	assert.Empty(t, p.get("02"))
+}
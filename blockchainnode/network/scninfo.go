@@ -2,6 +2,8 @@ package network
 
 import (
 	"log"
+	"math/big"
+	"sort"
 	"sync"
 
 	"github.com/junwookheo/bcsos/common/config"
@@ -9,186 +11,276 @@ import (
 	"github.com/junwookheo/bcsos/common/wallet"
 )
 
+// Kademlia routing table for each storage class
+// Peers are kept in 256 k-buckets by the length of prefix shared with the local node.
+// A bucket keeps NumSCPeer peers and the least recently seen peer is the first.
+// If a bucket is full, a new peer waits in the replacement cache and the least recently seen peer is pinged,
+// it is evicted only if it does not respond.
+// A peer is added only if its NodeInfo is signed by the key of its hash.
+
+// ALL_SC looks up peers of all storage classes, it is the key space of provider records
+const ALL_SC int = -1
+
+type kBucket struct {
+	peers        []dtype.NodeInfo // the least recently seen first
+	replacements []dtype.NodeInfo // the most recently seen last
+	pinging      bool
+}
+
+type routingTable struct {
+	buckets [wallet.ADDR_BITS]kBucket
+}
+
 type scnInfo struct {
-	scnodes [][]dtype.NodeInfo
-	mutex   sync.Mutex
+	tables []routingTable
+	scores map[string]float64             // reputation of peers by Proof of Storage
+	ping   func(node dtype.NodeInfo) bool // liveness check of the least recently seen peer
+	verify func(node *dtype.NodeInfo) error
+	mutex  sync.Mutex
 }
 
 func NewSCNInfo() *scnInfo {
-	// return &scnInfo{local: l, scnodes: make([]scnList, config.MAX_SC), mutex: sync.Mutex{}}
 	scn := scnInfo{}
 	scn.mutex = sync.Mutex{}
-	scn.scnodes = make([][]dtype.NodeInfo, config.MAX_SC)
-	for i := 0; i < config.MAX_SC; i++ {
-		scn.scnodes[i] = make([]dtype.NodeInfo, config.MAX_SC_PEER)
-		for j := 0; j < config.MAX_SC_PEER; j++ {
-			scn.scnodes[i][j] = zeroNode()
+	scn.tables = make([]routingTable, config.MAX_SC)
+	scn.scores = make(map[string]float64)
+	scn.verify = (*dtype.NodeInfo).Verify
+
+	return &scn
+}
+
+func indexOf(peers []dtype.NodeInfo, hash string) int {
+	for i, peer := range peers {
+		if peer.Hash == hash {
+			return i
 		}
 	}
-	return &scn
+
+	return -1
 }
 
-func zeroNode() dtype.NodeInfo {
-	return dtype.NodeInfo{Mode: "", SC: 0, IP: "", Port: 0, Hash: ""}
+func remove(peers []dtype.NodeInfo, i int) []dtype.NodeInfo {
+	return append(peers[:i], peers[i+1:]...)
 }
 
-func (c *scnInfo) AddNSCNNode(n dtype.NodeInfo) {
-	ni := NodeInfoInst()
-	local := ni.GetLocalddr()
+// bucket returns the bucket of the peer, nil for the local node
+func (c *scnInfo) bucket(n *dtype.NodeInfo) (*kBucket, int) {
+	local := NodeInfoInst().GetLocalddr()
+	if n.SC < 0 || config.ConfigInst().NumSC <= n.SC || n.Hash == "" || n.Hash == local.Hash {
+		return nil, -1
+	}
 
-	if n.SC >= config.MAX_SC || n.Hash == local.Hash {
-		return
+	idx := wallet.PrefixLen(local.Hash, n.Hash)
+	if wallet.ADDR_BITS <= idx {
+		return nil, -1
 	}
+
+	return &c.tables[n.SC].buckets[idx], idx
+}
+
+// AddNSCNNode marks the peer as the most recently seen, an error is returned if the peer is not verified
+// The latest announcement of the peer is kept.
+func (c *scnInfo) AddNSCNNode(n dtype.NodeInfo) error {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
-	pos := 0
-	for _, peer := range c.scnodes[n.SC] {
-		if peer.Hash == n.Hash {
-			return
-		}
-		if peer.Hash == "" {
-			break
-		}
-		d1 := wallet.DistanceXor(local.Hash, n.Hash)
-		d2 := wallet.DistanceXor(local.Hash, peer.Hash)
-		if d1 < d2 { // if new node is closer than cur node, insert new node
-			break
-		}
-		pos++
+
+	b, idx := c.bucket(&n)
+	if b == nil {
+		return nil
 	}
 
-	switch pos {
-	case 0:
-		for i := config.MAX_SC_PEER - 1; 0 < i; i-- {
-			c.scnodes[n.SC][i] = c.scnodes[n.SC][i-1]
-		}
-		c.scnodes[n.SC][0] = n
-	case config.MAX_SC_PEER - 1:
-		c.scnodes[n.SC][pos] = n
-	case config.MAX_SC_PEER:
-		break
-	default:
-		for i := config.MAX_SC_PEER - 1; pos < i; i-- {
-			c.scnodes[n.SC][i] = c.scnodes[n.SC][i-1]
+	if err := c.verify(&n); err != nil {
+		return err
+	}
+
+	if i := indexOf(b.peers, n.Hash); i != -1 {
+		if n.Nonce < b.peers[i].Nonce {
+			n = b.peers[i]
 		}
-		c.scnodes[n.SC][pos] = n
+		b.peers = append(remove(b.peers, i), n)
+		return nil
+	}
+
+	k := config.ConfigInst().NumSCPeer
+	if len(b.peers) < k {
+		b.peers = append(b.peers, n)
+		return nil
+	}
+
+	if i := indexOf(b.replacements, n.Hash); i != -1 {
+		b.replacements = remove(b.replacements, i)
+	}
+	b.replacements = append(b.replacements, n)
+	if k < len(b.replacements) {
+		b.replacements = b.replacements[1:]
+	}
 
+	if !b.pinging && c.ping != nil {
+		b.pinging = true
+		go c.checkBucket(n.SC, idx, b.peers[0])
 	}
+
+	return nil
 }
 
-func (c *scnInfo) DeleteSCNNode(n dtype.NodeInfo) {
-	if n.SC >= config.MAX_SC {
+// checkBucket pings the least recently seen peer of a full bucket, it is replaced if it does not respond
+func (c *scnInfo) checkBucket(sc int, idx int, head dtype.NodeInfo) {
+	alive := c.ping(head)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	b := &c.tables[sc].buckets[idx]
+	b.pinging = false
+	i := indexOf(b.peers, head.Hash)
+	if i == -1 {
+		return
+	}
+
+	if alive {
+		b.peers = append(remove(b.peers, i), head)
 		return
 	}
 
+	log.Printf("Evict node because ping error : %v", head)
+	evict(b, i)
+}
+
+// evict removes i-th peer of the bucket and the most recently seen replacement takes its place
+func evict(b *kBucket, i int) {
+	b.peers = remove(b.peers, i)
+	if n := len(b.replacements); n != 0 {
+		b.peers = append(b.peers, b.replacements[n-1])
+		b.replacements = b.replacements[:n-1]
+	}
+}
+
+func (c *scnInfo) DeleteSCNNode(n dtype.NodeInfo) {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
-	pos := 0
-	for _, peer := range c.scnodes[n.SC] {
-		if peer.Hash == n.Hash {
-			break
-		}
-		pos++
+
+	b, _ := c.bucket(&n)
+	if b == nil {
+		return
+	}
+
+	if i := indexOf(b.replacements, n.Hash); i != -1 {
+		b.replacements = remove(b.replacements, i)
+	}
+	if i := indexOf(b.peers, n.Hash); i != -1 {
+		evict(b, i)
+	}
+}
+
+// closest returns up to num peers of the storage class closest to target, peers with low reputation are placed after others
+func (c *scnInfo) closest(sc int, target string, num int) []dtype.NodeInfo {
+	if sc < ALL_SC || config.MAX_SC <= sc {
+		return nil
 	}
-	switch pos {
-	case 0:
-		//c.scnodes[n.SC] = append(c.scnodes[n.SC][1:], []dtype.NodeInfo{zeroNode()}...)
-		for i := 0; i < config.MAX_SC_PEER-1; i++ {
-			c.scnodes[n.SC][i] = c.scnodes[n.SC][i+1]
+
+	peers := []dtype.NodeInfo{}
+	for i, table := range c.tables {
+		if sc != ALL_SC && sc != i {
+			continue
 		}
-		c.scnodes[n.SC][config.MAX_SC_PEER-1] = zeroNode()
-	case config.MAX_SC_PEER - 1:
-		c.scnodes[n.SC][pos] = zeroNode()
-	case config.MAX_SC_PEER:
-		break
-	default:
-		// tmp := append(c.scnodes[n.SC][pos+1:], []dtype.NodeInfo{zeroNode()}...)
-		// c.scnodes[n.SC] = append(c.scnodes[n.SC][:pos], tmp...)
-		for i := pos; i < config.MAX_SC_PEER-1; i++ {
-			c.scnodes[n.SC][i] = c.scnodes[n.SC][i+1]
+		for _, b := range table.buckets {
+			peers = append(peers, b.peers...)
 		}
-		c.scnodes[n.SC][config.MAX_SC_PEER-1] = zeroNode()
+	}
 
+	dists := make(map[string]*big.Int, len(peers))
+	for _, peer := range peers {
+		dists[peer.Hash] = wallet.DistanceXor(target, peer.Hash)
 	}
-}
+	sort.Slice(peers, func(i, j int) bool {
+		li, lj := c.isDemoted(peers[i].Hash), c.isDemoted(peers[j].Hash)
+		if li != lj {
+			return !li
+		}
+		return dists[peers[i].Hash].Cmp(dists[peers[j].Hash]) < 0
+	})
 
-// return the copy of node list due to conccurency issues
-func (c *scnInfo) GetSCNNodeList(sc int, nodes *[config.MAX_SC_PEER]dtype.NodeInfo) bool {
-	if sc >= config.MAX_SC {
-		return false
+	if num < len(peers) {
+		peers = peers[:num]
 	}
 
+	return peers
+}
+
+// FindClosest returns up to k peers of the storage class closest to target, sc is ALL_SC for all storage classes
+func (c *scnInfo) FindClosest(sc int, target string) []dtype.NodeInfo {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
-	//newscn := []dtype.NodeInfo{}
 
-	pos := 0
-	for _, peer := range c.scnodes[sc] {
-		if peer.Hash != "" {
-			//newscn = append(newscn, []dtype.NodeInfo{peer}...)
-			nodes[pos] = peer
-			pos++
-		}
-	}
+	return c.closest(sc, target, config.ConfigInst().NumSCPeer)
+}
+
+// return the copy of node list due to conccurency issues
+// The peers closest to the local node are returned
+func (c *scnInfo) GetSCNNodeList(sc int, nodes *[config.MAX_SC_PEER]dtype.NodeInfo) bool {
+	local := NodeInfoInst().GetLocalddr()
 
-	return pos > 0
+	return c.GetSCNNodeListbyDistance(sc, local.Hash, nodes)
 }
 
 func (c *scnInfo) GetSCNNodeListbyDistance(sc int, oid string, nodes *[config.MAX_SC_PEER]dtype.NodeInfo) bool {
-	if sc >= config.MAX_SC {
-		return false
-	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return copy(nodes[:], c.closest(sc, oid, config.ConfigInst().NumSCPeer)) > 0
+}
 
+// SetReputation sets the reputation score of a peer
+func (c *scnInfo) SetReputation(hash string, score float64) {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 
-	pos := 0
-	var dists [config.MAX_SC_PEER]uint64
-	for _, peer := range c.scnodes[sc] {
-		if peer.Hash != "" {
-			dists[pos] = wallet.DistanceXor(oid, peer.Hash)
-			nodes[pos] = peer
-			pos++
-		}
-	}
-	if 1 < pos {
-		// Buble sort by distance
-		for i := 0; i < pos; i++ {
-			for j := 1; j < pos-i; j++ {
-				if dists[j] < dists[j-1] {
-					dists[j], dists[j-1] = dists[j-1], dists[j]
-					nodes[j], nodes[j-1] = nodes[j-1], nodes[j]
-				}
-			}
-		}
-	}
+	c.scores[hash] = score
+}
 
-	return pos > 0
+// isDemoted returns true if the peer failed Proof of Storage too much, a peer not audited is not demoted
+func (c *scnInfo) isDemoted(hash string) bool {
+	score, ok := c.scores[hash]
+	return ok && score < config.MIN_REPUTATION
 }
 
+// GetSCNNodeListAll returns the peers closest to the local node in all storage classes
 func (c *scnInfo) GetSCNNodeListAll(nodes *[(config.MAX_SC) * config.MAX_SC_PEER]dtype.NodeInfo) {
+	local := NodeInfoInst().GetLocalddr()
+
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
-	//newscn := []dtype.NodeInfo{}
+
 	pos := 0
-	for _, scn := range c.scnodes {
-		for _, peer := range scn {
-			if peer.Hash != "" {
-				//newscn = append(newscn, []dtype.NodeInfo{peer}...)
-				nodes[pos] = peer
-				pos++
-			}
-		}
+	for sc := range c.tables {
+		pos += copy(nodes[pos:], c.closest(sc, local.Hash, config.ConfigInst().NumSCPeer))
+	}
+}
+
+// Size returns the number of peers of the storage class in the routing table
+func (c *scnInfo) Size(sc int) int {
+	if sc < 0 || config.MAX_SC <= sc {
+		return 0
 	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	size := 0
+	for _, b := range c.tables[sc].buckets {
+		size += len(b.peers)
+	}
+
+	return size
 }
 
 func (c *scnInfo) ShowSCNNodeList() {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
-	for i, scn := range c.scnodes {
-		for _, peer := range scn {
-			if peer.Hash != "" {
-				log.Printf("SC:%v, node:%v", i, peer)
+	for i, table := range c.tables {
+		for j, b := range table.buckets {
+			for _, peer := range b.peers {
+				log.Printf("SC:%v, bucket:%v, node:%v", i, j, peer)
 			}
 		}
 	}
@@ -1,10 +1,17 @@
 package network
 
 import (
+	"fmt"
 	"log"
+	"path/filepath"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/junwookheo/bcsos/common/config"
+	"github.com/junwookheo/bcsos/common/dtype"
 	"github.com/junwookheo/bcsos/common/wallet"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestXOR(t *testing.T) {
@@ -16,3 +23,117 @@ func TestXOR(t *testing.T) {
 	log.Printf("distance3 : %v", d3)
 	// log.Printf("d1 - d2 : %v", d2.Cmp(d1))
 }
+
+// unverifiedSCNInfo accepts any node, hashes of tests below are not derived from keys
+func unverifiedSCNInfo() *scnInfo {
+	scn := NewSCNInfo()
+	scn.verify = func(node *dtype.NodeInfo) error { return nil }
+
+	return scn
+}
+
+func TestSCNNodeReputation(t *testing.T) {
+	scn := unverifiedSCNInfo()
+	scn.AddNSCNNode(dtype.NodeInfo{SC: 0, Hash: "01"})
+	scn.AddNSCNNode(dtype.NodeInfo{SC: 0, Hash: "02"})
+	scn.AddNSCNNode(dtype.NodeInfo{SC: 0, Hash: "04"})
+
+	var nodes [config.MAX_SC_PEER]dtype.NodeInfo
+	assert.True(t, scn.GetSCNNodeListbyDistance(0, "00", &nodes))
+	assert.Equal(t, []string{"01", "02", "04"}, []string{nodes[0].Hash, nodes[1].Hash, nodes[2].Hash})
+
+	// The closest node failed Proof of Storage
+	scn.SetReputation("01", dtype.ReputationScore(0, 1))
+	scn.SetReputation("02", dtype.ReputationScore(1, 1))
+	assert.True(t, scn.GetSCNNodeListbyDistance(0, "00", &nodes))
+	assert.Equal(t, []string{"02", "04", "01"}, []string{nodes[0].Hash, nodes[1].Hash, nodes[2].Hash})
+}
+
+func TestSCNNodeDistance(t *testing.T) {
+	scn := unverifiedSCNInfo()
+	// The low 64 bits of far are closer to the target
+	far := "8000000000000000000000000000000000000000000000000000000000000001"
+	near := "00000000000000000000000000000000000000000000000000000000000000ff"
+	scn.AddNSCNNode(dtype.NodeInfo{SC: 1, Hash: far})
+	scn.AddNSCNNode(dtype.NodeInfo{SC: 1, Hash: near})
+
+	closest := scn.FindClosest(1, "00")
+	assert.Equal(t, 2, len(closest))
+	assert.Equal(t, near, closest[0].Hash)
+	assert.Equal(t, 0, scn.Size(0))
+}
+
+// bucketPeers returns hashes of peers in the first bucket of SC 2
+func bucketPeers(scn *scnInfo) []string {
+	scn.mutex.Lock()
+	defer scn.mutex.Unlock()
+
+	hashes := []string{}
+	for _, peer := range scn.tables[2].buckets[0].peers {
+		hashes = append(hashes, peer.Hash)
+	}
+	return hashes
+}
+
+func TestKBucketEviction(t *testing.T) {
+	k := config.ConfigInst().NumSCPeer
+	scn := unverifiedSCNInfo()
+	var alive int32
+	scn.ping = func(node dtype.NodeInfo) bool { return atomic.LoadInt32(&alive) == 1 }
+
+	// All nodes share no prefix with the local node, so they are in the same bucket
+	hash := func(i int) string { return fmt.Sprintf("f%063x", i) }
+	for i := 0; i < k; i++ {
+		scn.AddNSCNNode(dtype.NodeInfo{SC: 2, Hash: hash(i)})
+	}
+	assert.Equal(t, k, scn.Size(2))
+	assert.Equal(t, hash(0), bucketPeers(scn)[0])
+
+	// The least recently seen node responds, so it is kept and the new node waits
+	atomic.StoreInt32(&alive, 1)
+	scn.AddNSCNNode(dtype.NodeInfo{SC: 2, Hash: hash(k)})
+	assert.Eventually(t, func() bool { return bucketPeers(scn)[k-1] == hash(0) }, time.Second, time.Millisecond)
+	assert.Equal(t, k, scn.Size(2))
+	assert.NotContains(t, bucketPeers(scn), hash(k))
+
+	// The least recently seen node does not respond, so the latest replacement takes its place
+	atomic.StoreInt32(&alive, 0)
+	scn.AddNSCNNode(dtype.NodeInfo{SC: 2, Hash: hash(k + 1)})
+	assert.Eventually(t, func() bool { return bucketPeers(scn)[0] != hash(1) }, time.Second, time.Millisecond)
+	assert.Contains(t, bucketPeers(scn), hash(k+1))
+	assert.NotContains(t, bucketPeers(scn), hash(1))
+
+	// A deleted node is replaced by the remaining replacement
+	scn.DeleteSCNNode(dtype.NodeInfo{SC: 2, Hash: hash(2)})
+	assert.Equal(t, k, scn.Size(2))
+	assert.Contains(t, bucketPeers(scn), hash(k))
+}
+
+func TestSCNNodeVerify(t *testing.T) {
+	w := wallet.NewWallet(filepath.Join(t.TempDir(), "node.wallet"))
+	node := dtype.NodeInfo{Mode: "ST", SC: 1, IP: "10.0.0.1", Port: 1000}
+	assert.Nil(t, node.Sign(w))
+	assert.Equal(t, wallet.NodeHash(w.PublicKey), node.Hash)
+
+	scn := NewSCNInfo()
+	assert.Nil(t, scn.AddNSCNNode(node))
+	assert.Equal(t, 1, scn.Size(1))
+
+	// Forged fields and hashes are rejected
+	forged := node
+	forged.IP = "10.0.0.2"
+	assert.ErrorIs(t, scn.AddNSCNNode(forged), dtype.ErrNodeIdentity)
+	forged = node
+	forged.Hash = "00" + node.Hash[2:]
+	assert.ErrorIs(t, scn.AddNSCNNode(forged), dtype.ErrNodeIdentity)
+	assert.ErrorIs(t, scn.AddNSCNNode(dtype.NodeInfo{SC: 1, Hash: "01"}), dtype.ErrNodeIdentity)
+	assert.Equal(t, 1, scn.Size(1))
+
+	// The latest announcement is kept
+	moved := node
+	moved.IP = "10.0.0.3"
+	assert.Nil(t, moved.Sign(w))
+	assert.Nil(t, scn.AddNSCNNode(moved))
+	assert.Nil(t, scn.AddNSCNNode(node))
+	assert.Equal(t, "10.0.0.3", scn.FindClosest(1, node.Hash)[0].IP)
+}
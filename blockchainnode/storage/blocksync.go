@@ -0,0 +1,378 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"time"
+
+	"github.com/junwookheo/bcsos/blockchainnode/network"
+	"github.com/junwookheo/bcsos/common/blockchain"
+	"github.com/junwookheo/bcsos/common/config"
+	"github.com/junwookheo/bcsos/common/dtype"
+	"github.com/junwookheo/bcsos/common/listener"
+)
+
+// Initial block download for a node joining in the middle of experiment
+// 1. Ask the saved tip to peers and download headers backward in batches until the local tip or the genesis
+// 2. Validate each header chain from the lowest and choose the chain with the most cumulative work
+// 3. Fetch block bodies within the retention time of the storage class, others are kept as header only
+// 4. Fetch candidate blocks from the head of the peer, since its saved tip is FINALITY blocks behind
+
+// getHeadersMessage is called when other node requests headers for initial block download
+// Request : hash of the highest block and the number of headers, empty hash for the latest block
+// Response : headers and transaction hashes in descending order of height
+func (h *StorageMgr) getHeadersMessage(payload json.RawMessage) (interface{}, error) {
+	var req dtype.ReqHeaders
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return nil, err
+	}
+
+	return h.getHeaders(req.Hash, req.Count), nil
+}
+
+func (h *StorageMgr) getHeaders(hash string, count int) *dtype.ResHeaders {
+	res := dtype.ResHeaders{}
+	if hash == "" {
+		hash, _ = h.db.GetLatestBlockHash()
+	}
+
+	if config.SYNC_HEADER_BATCH < count {
+		count = config.SYNC_HEADER_BATCH
+	}
+
+	for i := 0; i < count && hash != ""; i++ {
+		bh := blockchain.BlockHeader{}
+		trhashes := []string{}
+		if h.db.GetBlockIndex(hash, &bh, &trhashes) == 0 {
+			break
+		}
+
+		res.Headers = append(res.Headers, bh)
+		res.TrHashes = append(res.TrHashes, trhashes)
+		hash = hex.EncodeToString(bh.PrvHash)
+	}
+
+	return &res
+}
+
+func (h *StorageMgr) queryHeaders(node *dtype.NodeInfo, hash string, count int) *dtype.ResHeaders {
+	res := dtype.ResHeaders{}
+	if err := network.PeerMgrInst().Request(node, network.MSG_GET_HEADERS, dtype.ReqHeaders{Hash: hash, Count: count}, &res); err != nil {
+		log.Printf("queryHeaders error : %v", err)
+		return nil
+	}
+
+	if len(res.Headers) != len(res.TrHashes) {
+		return nil
+	}
+
+	return &res
+}
+
+// downloadHeaders downloads headers from the tip to the local tip or the genesis
+// Return headers and transaction hashes in ascending order of height
+func (h *StorageMgr) downloadHeaders(node *dtype.NodeInfo, tip string, localhash string) ([]blockchain.BlockHeader, [][]string, error) {
+	var headers []blockchain.BlockHeader
+	var trhashes [][]string
+
+	hash := tip
+	for hash != localhash && hash != "" {
+		res := h.queryHeaders(node, hash, config.SYNC_HEADER_BATCH)
+		if res == nil || len(res.Headers) == 0 {
+			return nil, nil, fmt.Errorf("no headers from %v", hash)
+		}
+
+		for i, bh := range res.Headers {
+			if hex.EncodeToString(bh.Hash) != hash {
+				return nil, nil, fmt.Errorf("unexpected header %v", hex.EncodeToString(bh.Hash))
+			}
+
+			headers = append([]blockchain.BlockHeader{bh}, headers...)
+			trhashes = append([][]string{res.TrHashes[i]}, trhashes...)
+			hash = hex.EncodeToString(bh.PrvHash)
+			if hash == localhash || hash == "" {
+				break
+			}
+		}
+	}
+
+	return headers, trhashes, nil
+}
+
+// validateHeaders checks the header chain and the merkle root of transaction hashes
+func (h *StorageMgr) validateHeaders(headers []blockchain.BlockHeader, trhashes [][]string, localhash string, localheight int) error {
+	var parent *blockchain.BlockHeader
+	if localhash != "" && hex.EncodeToString(headers[0].PrvHash) == localhash {
+		parent = &blockchain.BlockHeader{}
+		hashes := []string{}
+		// The local header can be removed already, then only the link is checked
+		if h.db.GetBlockIndex(localhash, parent, &hashes) == 0 {
+			parent = &blockchain.BlockHeader{Hash: headers[0].PrvHash, Height: localheight}
+		}
+	}
+
+	for i := range headers {
+		if err := blockchain.ValidateHeader(&headers[i], parent); err != nil {
+			return fmt.Errorf("header(%v) %v : %w", headers[i].Height, hex.EncodeToString(headers[i].Hash), err)
+		}
+
+		// The difficulty is checked only if the first block of the retarget window is downloaded
+		if 0 < i {
+			var first *blockchain.BlockHeader
+			height := blockchain.RetargetAncestor(headers[i].Height)
+			if headers[0].Height <= height {
+				first = &headers[height-headers[0].Height]
+			}
+			if (height == -1 || first != nil) && blockchain.GetConsensus().NextDifficulty(parent, first) != headers[i].Difficulty {
+				return fmt.Errorf("header(%v) %v : %w", headers[i].Height, hex.EncodeToString(headers[i].Hash), blockchain.ErrBadDifficulty)
+			}
+		}
+
+		var leaves [][]byte
+		for _, trhash := range trhashes[i] {
+			leaf, _ := hex.DecodeString(trhash)
+			leaves = append(leaves, leaf)
+		}
+		if len(leaves) == 0 || !bytes.Equal(blockchain.CalMerkleRootHash(leaves), headers[i].MerkleRoot) {
+			return fmt.Errorf("header(%v) %v : %w", headers[i].Height, hex.EncodeToString(headers[i].Hash), blockchain.ErrBadMerkleRoot)
+		}
+
+		parent = &headers[i]
+	}
+
+	return nil
+}
+
+// localWork returns the cumulative work of the headers in local storage from the hash
+func (h *StorageMgr) localWork(hash string) *big.Int {
+	work := big.NewInt(0)
+	for hash != "" {
+		bh := blockchain.BlockHeader{}
+		trhashes := []string{}
+		if h.db.GetBlockIndex(hash, &bh, &trhashes) == 0 {
+			break
+		}
+
+		work.Add(work, bh.Work())
+		hash = hex.EncodeToString(bh.PrvHash)
+	}
+
+	return work
+}
+
+// syncChain is a header chain downloaded from a peer and validated
+type syncChain struct {
+	peer     *dtype.NodeInfo
+	headers  []blockchain.BlockHeader
+	trhashes [][]string
+	work     *big.Int
+}
+
+// bestChain downloads headers from the nodes and returns the chain with the most cumulative work,
+// nil if no chain has more work than the local chain
+// The height reported by peers is not trusted, the work is computed from the validated headers.
+// An error is returned if the chains of all peers answered fail to download or validate.
+func (h *StorageMgr) bestChain(nodes []dtype.NodeInfo, localhash string, localheight int) (*syncChain, error) {
+	local := network.NodeInfoInst().GetLocalddr()
+	nm := network.NodeMgrInst()
+
+	localwork := h.localWork(localhash)
+	var best *syncChain
+	var failed error
+	agreed := false // a peer has the local tip or a valid chain
+	for i := range nodes {
+		node := nodes[i]
+		if node.IP == "" || node.Hash == local.Hash {
+			continue
+		}
+
+		res := h.queryHeaders(&node, "", 1)
+		if res == nil || len(res.Headers) != 1 {
+			continue
+		}
+		if hex.EncodeToString(res.Headers[0].Hash) == localhash {
+			agreed = true
+			continue
+		}
+
+		headers, trhashes, err := h.downloadHeaders(&node, hex.EncodeToString(res.Headers[0].Hash), localhash)
+		if err == nil && len(headers) == 0 {
+			agreed = true
+			continue
+		}
+		if err == nil {
+			err = h.validateHeaders(headers, trhashes, localhash, localheight)
+		}
+		if err != nil {
+			nm.ReportMisbehavior(&node, fmt.Sprintf("sync %v", err))
+			failed = fmt.Errorf("chain of %v:%v : %w", node.IP, node.Port, err)
+			continue
+		}
+		agreed = true
+
+		// A chain from the genesis does not include the local chain
+		work := big.NewInt(0)
+		if localhash != "" && hex.EncodeToString(headers[0].PrvHash) == localhash {
+			work.Set(localwork)
+		}
+		for _, bh := range headers {
+			work.Add(work, bh.Work())
+		}
+
+		if work.Cmp(localwork) == 1 && (best == nil || work.Cmp(best.work) == 1) {
+			best = &syncChain{&node, headers, trhashes, work}
+		}
+	}
+
+	if best == nil && !agreed && failed != nil {
+		return nil, failed
+	}
+
+	return best, nil
+}
+
+// syncCandidates fetches blocks from the head of the peer down to its saved tip
+// and adds them to candidate blocks from the lowest, it returns the number of blocks added
+func (h *StorageMgr) syncCandidates(node *dtype.NodeInfo, savedtip string) (int, error) {
+	var blocks []*blockchain.Block
+	hash := ""
+	for i := 0; i < config.ConfigInst().Finality*2; i++ {
+		b := queryBlock(node, hash)
+		if b == nil {
+			return 0, fmt.Errorf("no block %v from %v:%v", hash, node.IP, node.Port)
+		}
+		if hex.EncodeToString(b.Header.Hash) == savedtip {
+			break
+		}
+
+		blocks = append([]*blockchain.Block{b}, blocks...)
+		hash = hex.EncodeToString(b.Header.PrvHash)
+		if hash == savedtip {
+			break
+		}
+	}
+
+	cnt := 0
+	for _, b := range blocks {
+		if err := h.cand.Validate(b); err != nil {
+			return cnt, fmt.Errorf("candidate block(%v) %v : %w", b.Header.Height, hex.EncodeToString(b.Header.Hash), err)
+		}
+		if h.cand.PushAndSave(b, h) {
+			cnt++
+		}
+	}
+
+	return cnt, nil
+}
+
+// SyncBlocks downloads blocks missed before joining from the peer with the most cumulative work
+// Return false if the chain or candidate blocks of the peer fail to download or validate,
+// or no block body is fetched within the retention time
+func (h *StorageMgr) SyncBlocks() bool {
+	ni := network.NodeInfoInst()
+	local := ni.GetLocalddr()
+
+	localhash, localheight := h.db.GetLatestBlockHash()
+
+	var nodes [config.MAX_SC * config.MAX_SC_PEER]dtype.NodeInfo
+	network.NodeMgrInst().GetSCNNodeListAll(&nodes)
+	best, err := h.bestChain(nodes[:], localhash, localheight)
+	if err != nil {
+		log.Printf("SyncBlocks : %v", err)
+		return false
+	}
+	if best == nil {
+		log.Printf("SyncBlocks : up to date(%v)", localheight)
+		return true
+	}
+	peer, headers, trhashes := best.peer, best.headers, best.trhashes
+	peerheight := headers[len(headers)-1].Height
+	log.Printf("SyncBlocks : %v -> %v from %v:%v", localheight, peerheight, peer.IP, peer.Port)
+
+	// Bodies are fetched only within the retention time, others are kept as header only
+	retention := int64(config.ConfigInst().TSC(local.SC) * float32(1e9))
+	now := time.Now().UnixNano()
+
+	var last *blockchain.Block
+	wanted, fetched := 0, 0
+	for i := range headers {
+		bh := &headers[i]
+		if retention == 0 || now-retention < bh.Timestamp {
+			wanted++
+			if b := h.RequestBlock(hex.EncodeToString(bh.Hash)); b != nil && bytes.Equal(b.Header.MerkleRoot, bh.MerkleRoot) {
+				for _, t := range b.Transactions {
+					h.db.AddTransaction(t)
+				}
+				h.db.AddBlockIndex(bh, trhashes[i], bh.Timestamp)
+				last = b
+				fetched++
+				continue
+			}
+			log.Printf("SyncBlocks : no body of block(%v), header only", bh.Height)
+		}
+		h.db.AddBlockIndex(bh, trhashes[i], bh.Timestamp)
+	}
+
+	// The saved tip becomes the anchor of candidate blocks, then blocks up to the head of the peer are added
+	if last != nil && last.Header.Height == peerheight {
+		h.cand.PushAndSave(last, h)
+	}
+	cands, err := h.syncCandidates(peer, hex.EncodeToString(headers[len(headers)-1].Hash))
+	if err != nil {
+		log.Printf("SyncBlocks : %v", err)
+		return false
+	}
+	log.Printf("SyncBlocks : done(%v), %v headers, %v/%v bodies, %v candidate blocks", peerheight, len(headers), fetched, wanted, cands)
+
+	return wanted == 0 || fetched != 0
+}
+
+func (h *StorageMgr) IsSynced() bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	return h.synced
+}
+
+// SyncBlockProc runs initial block download once the experiment starts
+func (h *StorageMgr) SyncBlockProc() {
+	command := make(chan string)
+	el := listener.EventListenerInst()
+	el.AddListener(command)
+
+	go func(command <-chan string) {
+		for {
+			cmd := <-command
+			switch cmd {
+			case "Stop":
+				return
+			case "Start":
+				if h.IsSynced() {
+					continue
+				}
+
+				// Wait for the peer list to be updated
+				for i := 0; i < config.TIME_UPDATE_NEITHBOUR; i++ {
+					var nodes [config.MAX_SC * config.MAX_SC_PEER]dtype.NodeInfo
+					network.NodeMgrInst().GetSCNNodeListAll(&nodes)
+					if nodes[0].IP != "" {
+						break
+					}
+					time.Sleep(time.Second)
+				}
+
+				if !h.SyncBlocks() {
+					log.Printf("SyncBlocks failed, blocks are received from now")
+				}
+
+				h.mutex.Lock()
+				h.synced = true
+				h.mutex.Unlock()
+			}
+		}
+	}(command)
+}
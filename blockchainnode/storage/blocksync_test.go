@@ -0,0 +1,140 @@
+package storage
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/junwookheo/bcsos/blockchainnode/network"
+	"github.com/junwookheo/bcsos/common/blockchain"
+	"github.com/junwookheo/bcsos/common/datalib"
+	"github.com/junwookheo/bcsos/common/dbagent"
+	"github.com/junwookheo/bcsos/common/dtype"
+	"github.com/junwookheo/bcsos/common/wallet"
+	"github.com/stretchr/testify/assert"
+)
+
+// syncServer serves a chain with blocks up to saved as its storage and the last block as the head
+func syncServer(chain []*blockchain.Block, saved int) (*httptest.Server, dtype.NodeInfo) {
+	find := func(hash string) int {
+		for i, b := range chain {
+			if hex.EncodeToString(b.Header.Hash) == hash {
+				return i
+			}
+		}
+		return -1
+	}
+
+	p := network.NewPeerMgr()
+	p.Handle(network.MSG_GET_HEADERS, func(payload json.RawMessage) (interface{}, error) {
+		var req dtype.ReqHeaders
+		if err := json.Unmarshal(payload, &req); err != nil {
+			return nil, err
+		}
+
+		res := dtype.ResHeaders{}
+		i := saved
+		if req.Hash != "" {
+			i = find(req.Hash)
+		}
+		for ; 0 <= i && len(res.Headers) < req.Count; i-- {
+			trhashes := []string{}
+			for _, t := range chain[i].Transactions {
+				trhashes = append(trhashes, hex.EncodeToString(t.Hash))
+			}
+			res.Headers = append(res.Headers, chain[i].Header)
+			res.TrHashes = append(res.TrHashes, trhashes)
+		}
+		return res, nil
+	})
+	p.Handle(network.MSG_GET_BLOCK, func(payload json.RawMessage) (interface{}, error) {
+		var req dtype.ReqBlock
+		if err := json.Unmarshal(payload, &req); err != nil {
+			return nil, err
+		}
+
+		i := len(chain) - 1
+		if req.Hash != "" {
+			i = find(req.Hash)
+		}
+		if i == -1 {
+			return nil, fmt.Errorf("%w : block %v", ErrObjectNotFound, req.Hash)
+		}
+		return chain[i], nil
+	})
+	s := httptest.NewServer(http.HandlerFunc(p.PeerHandler))
+
+	host, port, _ := net.SplitHostPort(strings.TrimPrefix(s.URL, "http://"))
+	n, _ := strconv.Atoi(port)
+	return s, dtype.NodeInfo{IP: host, Port: n}
+}
+
+func TestSyncBestChain(t *testing.T) {
+	path := "./blocksync_test.db"
+	wallet_path := "./wallet_test.wallet"
+	defer os.Remove(path)
+	defer os.Remove(wallet_path)
+
+	w := wallet.NewWallet(wallet_path)
+	network.NodeInfoInst().SetLocalddrParam("ST", 0, 0, w)
+	db := dbagent.NewDBAgent(path)
+	defer db.Close()
+	h := StorageMgr{db: db, om: NewObjMgr(db), cand: datalib.NewCandidateBlocks()}
+
+	crchain := func(s string, n int, difficulty int) []*blockchain.Block {
+		var chain []*blockchain.Block
+		var prv []byte
+		for i := 0; i < n; i++ {
+			trs := []*blockchain.Transaction{blockchain.CreateTransaction(w, []byte(fmt.Sprintf("%v-%v", s, i)))}
+			chain = append(chain, blockchain.CreateBlockWithDifficulty(trs, prv, i, difficulty))
+			prv = chain[i].Header.Hash
+		}
+		return chain
+	}
+
+	// The higher chain has less work
+	heavy := crchain("heavy", 3, 14)
+	high := crchain("high", 4, 12)
+	hs, heavyNode := syncServer(heavy, 1)
+	defer hs.Close()
+	ls, highNode := syncServer(high, 3)
+	defer ls.Close()
+
+	best, err := h.bestChain([]dtype.NodeInfo{highNode, heavyNode}, "", -1)
+	assert.Nil(t, err)
+	assert.NotNil(t, best)
+	assert.Equal(t, heavyNode, *best.peer)
+	assert.Equal(t, 2, len(best.headers))
+
+	// The head is fetched above the saved tip of the peer
+	cnt, err := h.syncCandidates(best.peer, hex.EncodeToString(heavy[1].Header.Hash))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, cnt)
+	height, hash := h.cand.GetHighestBlockHash()
+	assert.Equal(t, 2, height)
+	assert.Equal(t, hex.EncodeToString(heavy[2].Header.Hash), hash)
+
+	// A chain failing validation is an error only if no other peer has a valid chain
+	bad := crchain("bad", 3, 14)
+	bad[1].Transactions[0].Hash = bad[0].Transactions[0].Hash
+	bs, badNode := syncServer(bad, 2)
+	defer bs.Close()
+	best, err = h.bestChain([]dtype.NodeInfo{badNode}, "", -1)
+	assert.Nil(t, best)
+	assert.NotNil(t, err)
+	best, err = h.bestChain([]dtype.NodeInfo{badNode, heavyNode}, "", -1)
+	assert.Nil(t, err)
+	assert.Equal(t, heavyNode, *best.peer)
+
+	// The head cannot be fetched from a peer gone
+	ls.Close()
+	_, err = h.syncCandidates(&highNode, "")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,355 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/junwookheo/bcsos/blockchainnode/network"
+	"github.com/junwookheo/bcsos/common/blockchain"
+	"github.com/junwookheo/bcsos/common/config"
+	"github.com/junwookheo/bcsos/common/dbagent"
+	"github.com/junwookheo/bcsos/common/dtype"
+	"github.com/junwookheo/bcsos/common/erasure"
+	"github.com/junwookheo/bcsos/common/serial"
+	"github.com/junwookheo/bcsos/common/wallet"
+)
+
+// Erasure coding mode of the highest storage class
+// 1. A finalised block body is split into k data shards and m parity shards
+// 2. The node closest to the block hash places each shard on the closest node to the shard hash
+// 3. Every node of the highest storage class removes transactions of the block after all shards are confirmed stored
+// 4. A transaction is reconstructed from any k shards when it is not found in other nodes
+//    and checked against the block header kept in local storage
+
+// isErasureCoding returns true if the local node keeps shards instead of block bodies
+func isErasureCoding() bool {
+	c := config.ConfigInst()
+	local := network.NodeInfoInst().GetLocalddr()
+
+	return c.ErasureCoding && local.SC == c.NumSC-1
+}
+
+// AddBlock saves a finalised block, it is called by candidate blocks
+func (h *StorageMgr) AddBlock(b *blockchain.Block) int64 {
+	id := h.db.AddBlock(b)
+	if id == 0 {
+		return id
+	}
+
+	// Transactions are removed after they are kept in shards
+	if isErasureCoding() {
+		go h.encodeBlock(b)
+		provide(hex.EncodeToString(b.Header.Hash))
+	} else {
+		hashes := []string{hex.EncodeToString(b.Header.Hash)}
+		for _, t := range b.Transactions {
+			hashes = append(hashes, hex.EncodeToString(t.Hash))
+		}
+		provide(hashes...)
+	}
+
+	return id
+}
+
+// RemoveBlock removes a saved block detached by a reorg, it is called by candidate blocks
+func (h *StorageMgr) RemoveBlock(hash string) bool {
+	return h.db.RemoveBlock(hash)
+}
+
+// closestNode returns the closest node to hash in the highest storage class, nil if the local node is the closest
+func closestNode(hash string) *dtype.NodeInfo {
+	local := network.NodeInfoInst().GetLocalddr()
+	nm := network.NodeMgrInst()
+
+	var nodes [config.MAX_SC_PEER]dtype.NodeInfo
+	if !nm.GetSCNNodeListbyDistance(config.ConfigInst().NumSC-1, hash, &nodes) {
+		return nil
+	}
+
+	if !wallet.CloserXor(hash, nodes[0].Hash, local.Hash) {
+		return nil
+	}
+
+	return &nodes[0]
+}
+
+// encodeBlock removes transactions of the block after all shards are confirmed stored
+// The node closest to the block hash places the shards, other nodes check the shards after ERASURE_PROBE_DELAY
+// and place them if the closest node they know did not, since it can be offline or have another view of the storage class.
+func (h *StorageMgr) encodeBlock(b *blockchain.Block) {
+	blockhash := hex.EncodeToString(b.Header.Hash)
+	stored := false
+	if closestNode(blockhash) != nil {
+		time.Sleep(time.Duration(config.ERASURE_PROBE_DELAY) * time.Second)
+		stored = h.shardsStored(blockhash)
+	}
+	if !stored && !h.storeShards(b) {
+		log.Printf("Erasure coding block(%v) not confirmed, transactions are kept", b.Header.Height)
+		return
+	}
+
+	for _, t := range b.Transactions {
+		h.db.RemoveObject(hex.EncodeToString(t.Hash))
+	}
+}
+
+// storeShards splits the block into shards and places each shard on the closest node to the shard hash
+// It returns true if all shards are acknowledged by the nodes or stored in local.
+func (h *StorageMgr) storeShards(b *blockchain.Block) bool {
+	c := config.ConfigInst()
+	enc, err := erasure.NewEncoder(c.ErasureDataShards, c.ErasureParityShards)
+	if err != nil {
+		log.Printf("Erasure encoder error : %v", err)
+		return false
+	}
+
+	blockhash := hex.EncodeToString(b.Header.Hash)
+	data := serial.Serialize(b)
+	stored := 0
+	for i, shard := range enc.Split(data) {
+		s := dtype.Shard{BlockHash: blockhash, Index: i, K: c.ErasureDataShards, M: c.ErasureParityShards, Size: len(data), Data: shard}
+		// The shard is kept in local if it can not be sent
+		if node := closestNode(dbagent.ShardHash(blockhash, i)); node != nil && putShard(node, &s) {
+			stored++
+		} else if h.db.AddShard(&s) != 0 {
+			stored++
+		}
+	}
+	log.Printf("Erasure coding block(%v) : %v bytes to %v shards, %v stored", b.Header.Height, len(data), c.ErasureDataShards+c.ErasureParityShards, stored)
+
+	return stored == c.ErasureDataShards+c.ErasureParityShards
+}
+
+// shardsStored returns true if all shards of the block are found in local storage or other nodes
+func (h *StorageMgr) shardsStored(blockhash string) bool {
+	c := config.ConfigInst()
+	for i := 0; i < c.ErasureDataShards+c.ErasureParityShards; i++ {
+		if h.getShard(blockhash, i) == nil {
+			return false
+		}
+	}
+
+	return true
+}
+
+// putShardMessage stores a shard sent by the encoder
+// Request : shard
+// Response : true if it is stored
+func (h *StorageMgr) putShardMessage(payload json.RawMessage) (interface{}, error) {
+	var s dtype.Shard
+	if err := json.Unmarshal(payload, &s); err != nil {
+		return nil, err
+	}
+
+	return h.db.AddShard(&s) != 0, nil
+}
+
+func putShard(node *dtype.NodeInfo, s *dtype.Shard) bool {
+	ok := false
+	if err := network.PeerMgrInst().Request(node, network.MSG_PUT_SHARD, s, &ok); err != nil {
+		log.Printf("putShard error : %v", err)
+		return false
+	}
+
+	return ok
+}
+
+// getShardMessage returns a shard kept in local storage
+// Request : block hash and index of shard
+// Response : shard, ErrObjectNotFound if not found
+func (h *StorageMgr) getShardMessage(payload json.RawMessage) (interface{}, error) {
+	var req dtype.ReqShard
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return nil, err
+	}
+
+	s := dtype.Shard{}
+	if h.db.GetShard(req.BlockHash, req.Index, &s) == 0 {
+		return nil, fmt.Errorf("%w : shard %v of %v", ErrObjectNotFound, req.Index, req.BlockHash)
+	}
+
+	return s, nil
+}
+
+func queryShard(node *dtype.NodeInfo, blockhash string, index int) *dtype.Shard {
+	s := dtype.Shard{}
+	if err := network.PeerMgrInst().Request(node, network.MSG_GET_SHARD, dtype.ReqShard{BlockHash: blockhash, Index: index}, &s); err != nil {
+		log.Printf("queryShard error : %v", err)
+		return nil
+	}
+
+	if s.BlockHash != blockhash || s.Index != index || len(s.Data) == 0 {
+		return nil
+	}
+
+	return &s
+}
+
+// getShard reads a shard from local storage or nodes of the highest storage class close to the shard
+func (h *StorageMgr) getShard(blockhash string, index int) *dtype.Shard {
+	s := dtype.Shard{}
+	if h.db.GetShard(blockhash, index, &s) != 0 {
+		return &s
+	}
+
+	local := network.NodeInfoInst().GetLocalddr()
+	nm := network.NodeMgrInst()
+
+	var nodes [config.MAX_SC_PEER]dtype.NodeInfo
+	if nm.GetSCNNodeListbyDistance(config.ConfigInst().NumSC-1, dbagent.ShardHash(blockhash, index), &nodes) {
+		for _, node := range nodes {
+			if node.IP == "" || node.Hash == local.Hash {
+				continue
+			}
+
+			if s := queryShard(&node, blockhash, index); s != nil {
+				return s
+			}
+		}
+	}
+
+	return nil
+}
+
+// reconstructBlock collects k shards of the block and decodes the block body
+// A shard has no hash of its own, so other k shards are tried if the block is not verified
+func (h *StorageMgr) reconstructBlock(blockhash string) (*blockchain.Block, error) {
+	c := config.ConfigInst()
+	k, m := c.ErasureDataShards, c.ErasureParityShards
+	size := -1
+
+	var shards [][]byte
+	var found []int // indices of shards collected
+	next := 0
+	collect := func(num int) {
+		for ; next < k+m && len(found) < num; next++ {
+			s := h.getShard(blockhash, next)
+			if s == nil {
+				continue
+			}
+
+			// The shards can be made with other parameters before
+			if size == -1 {
+				k, m, size = s.K, s.M, s.Size
+				shards = make([][]byte, k+m)
+			}
+			if s.K != k || s.M != m || s.Size != size || k+m <= s.Index || shards[s.Index] != nil {
+				continue
+			}
+
+			shards[s.Index] = s.Data
+			found = append(found, s.Index)
+		}
+	}
+
+	collect(k)
+	if size == -1 {
+		return nil, fmt.Errorf("no shard of block %v", blockhash)
+	}
+
+	// Shards come from other nodes, so the block is checked against the header kept in local storage
+	bh := h.getLocalBlockHeader(blockhash)
+	if bh == nil {
+		return nil, fmt.Errorf("no header of block %v", blockhash)
+	}
+
+	enc, err := erasure.NewEncoder(k, m)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := decodeBlock(enc, shards, size, bh)
+	if err == nil || len(found) < k {
+		return b, err
+	}
+
+	log.Printf("Block %v not verified with shards %v, other shards are tried : %v", blockhash, found, err)
+	collect(k + m)
+	idx := make([]int, k)
+	for i := range idx {
+		idx[i] = i
+	}
+	for nextCombination(idx, len(found)) {
+		sub := make([][]byte, k+m)
+		for _, i := range idx {
+			sub[found[i]] = shards[found[i]]
+		}
+		if b, err = decodeBlock(enc, sub, size, bh); err == nil {
+			return b, nil
+		}
+	}
+
+	return nil, err
+}
+
+// decodeBlock joins shards and checks the block against the header
+func decodeBlock(enc *erasure.Encoder, shards [][]byte, size int, bh *blockchain.BlockHeader) (*blockchain.Block, error) {
+	blockhash := hex.EncodeToString(bh.Hash)
+	data, err := enc.Join(shards, size)
+	if err != nil {
+		return nil, err
+	}
+
+	b := blockchain.Block{}
+	if err := b.UnmarshalBinary(data); err != nil {
+		return nil, fmt.Errorf("invalid block reconstructed : %v, %w", blockhash, err)
+	}
+
+	var leaves [][]byte
+	for _, t := range b.Transactions {
+		if !bytes.Equal(t.Hash, t.GetHash()) {
+			return nil, fmt.Errorf("invalid transaction reconstructed : %v", hex.EncodeToString(t.Hash))
+		}
+		leaves = append(leaves, t.Hash)
+	}
+	if len(leaves) == 0 || !bytes.Equal(blockchain.CalMerkleRootHash(leaves), bh.MerkleRoot) {
+		return nil, fmt.Errorf("invalid block reconstructed : %v", blockhash)
+	}
+	b.Header = *bh
+
+	return &b, nil
+}
+
+// nextCombination moves idx to the next combination of len(idx) out of n in lexicographic order
+// Return false after the last combination
+func nextCombination(idx []int, n int) bool {
+	k := len(idx)
+	for i := k - 1; 0 <= i; i-- {
+		if idx[i] < n-k+i {
+			idx[i]++
+			for j := i + 1; j < k; j++ {
+				idx[j] = idx[j-1] + 1
+			}
+			return true
+		}
+	}
+
+	return false
+}
+
+// reconstructTransaction finds the block of the transaction and reconstructs it from shards
+func (h *StorageMgr) reconstructTransaction(hash string, tr *blockchain.Transaction) bool {
+	blockhash, index := h.db.GetBlockHashOfObject(hash)
+	if blockhash == "" || index < 1 {
+		return false
+	}
+
+	b, err := h.reconstructBlock(blockhash)
+	if err != nil {
+		log.Printf("Reconstruct transaction error : %v", err)
+		return false
+	}
+
+	for _, t := range b.Transactions {
+		if hex.EncodeToString(t.Hash) == hash {
+			*tr = *t
+			return true
+		}
+	}
+
+	return false
+}
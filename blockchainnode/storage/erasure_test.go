@@ -0,0 +1,91 @@
+package storage
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/junwookheo/bcsos/common/blockchain"
+	"github.com/junwookheo/bcsos/common/config"
+	"github.com/junwookheo/bcsos/common/dbagent"
+	"github.com/junwookheo/bcsos/common/dtype"
+	"github.com/junwookheo/bcsos/common/wallet"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErasureCoding(t *testing.T) {
+	path := "./erasure_test.db"
+	wallet_path := "./wallet_test.wallet"
+	defer os.Remove(path)
+	defer os.Remove(wallet_path)
+
+	w := wallet.NewWallet(wallet_path)
+	db := dbagent.NewDBAgent(path)
+	defer db.Close()
+	h := StorageMgr{db: db, om: NewObjMgr(db)}
+
+	var trs []*blockchain.Transaction
+	for i := 0; i < 8; i++ {
+		trs = append(trs, blockchain.CreateTransaction(w, []byte(fmt.Sprintf("erasure-%v", i))))
+	}
+	b := blockchain.CreateBlock(trs, nil, 0)
+	blockhash := hex.EncodeToString(b.Header.Hash)
+	db.AddBlock(b)
+
+	// Without other nodes, all shards are kept in local and transactions are removed
+	h.encodeBlock(b)
+	c := config.ConfigInst()
+	s := dtype.Shard{}
+	for i := 0; i < c.ErasureDataShards+c.ErasureParityShards; i++ {
+		assert.NotEqual(t, int64(0), db.GetShard(blockhash, i, &s))
+	}
+	tr := blockchain.Transaction{}
+	assert.Equal(t, int64(0), db.GetTransaction(hex.EncodeToString(trs[3].Hash), &tr))
+
+	assert.True(t, h.shardsStored(blockhash))
+
+	// A corrupted shard of transactions is replaced by other shards
+	last := c.ErasureDataShards - 1
+	assert.NotEqual(t, int64(0), db.GetShard(blockhash, last, &s))
+	corrupted := s
+	corrupted.Data = append([]byte{}, s.Data...)
+	corrupted.Data[len(s.Data)/2] ^= 0xff
+	db.RemoveObject(dbagent.ShardHash(blockhash, last))
+	assert.NotEqual(t, int64(0), db.AddShard(&corrupted))
+	rb, err := h.reconstructBlock(blockhash)
+	assert.Nil(t, err)
+	assert.Equal(t, len(trs), len(rb.Transactions))
+	db.RemoveObject(dbagent.ShardHash(blockhash, last))
+	db.AddShard(&s)
+
+	// Any k shards are enough
+	for i := 0; i < c.ErasureParityShards; i++ {
+		db.RemoveObject(dbagent.ShardHash(blockhash, i*2))
+	}
+	rb, err = h.reconstructBlock(blockhash)
+	assert.Nil(t, err)
+	assert.Equal(t, b.Header.MerkleRoot, rb.Header.MerkleRoot)
+	assert.Equal(t, len(trs), len(rb.Transactions))
+
+	assert.True(t, h.reconstructTransaction(hex.EncodeToString(trs[3].Hash), &tr))
+	assert.Equal(t, trs[3].Hash, tr.Hash)
+	assert.Equal(t, trs[3].Data, tr.Data)
+
+	assert.False(t, h.shardsStored(blockhash))
+
+	// A block of other transactions is refused by the header in local storage
+	other := blockchain.CreateBlock(trs[:4], nil, 0)
+	other.Header.Hash = b.Header.Hash
+	for i := 0; i < c.ErasureDataShards+c.ErasureParityShards; i++ {
+		db.RemoveObject(dbagent.ShardHash(blockhash, i))
+	}
+	assert.True(t, h.storeShards(other))
+	assert.True(t, h.shardsStored(blockhash))
+	_, err = h.reconstructBlock(blockhash)
+	assert.NotNil(t, err)
+
+	db.RemoveObject(dbagent.ShardHash(blockhash, 1))
+	_, err = h.reconstructBlock(blockhash)
+	assert.NotNil(t, err)
+}
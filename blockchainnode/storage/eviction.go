@@ -0,0 +1,244 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/junwookheo/bcsos/common/config"
+	"github.com/junwookheo/bcsos/common/dbagent"
+)
+
+// EvictionPolicy chooses objects to be removed from local storage
+// Objects are removed with DBAgent.RemoveObject so that DBStatus is updated for every policy
+type EvictionPolicy interface {
+	Name() string
+	// Victims returns hashes of objects to be removed, now is UnixNano
+	Victims(objs []dbagent.CachedObj, now int64) []string
+}
+
+// NewEvictionPolicy returns the eviction policy of the storage class in the config
+func NewEvictionPolicy(c *config.Config, sc int) (EvictionPolicy, error) {
+	if sc < 0 || len(c.EvictionPolicy) <= sc {
+		return nil, fmt.Errorf("no eviction policy for SC%v", sc)
+	}
+
+	switch c.EvictionPolicy[sc] {
+	case config.EVICTION_TIME:
+		return &timePolicy{tsc: c.TSC(sc)}, nil
+	case config.EVICTION_LRU:
+		return &lruPolicy{capacity: c.CacheObjects[sc]}, nil
+	case config.EVICTION_LFU:
+		return &lfuPolicy{capacity: c.CacheObjects[sc]}, nil
+	case config.EVICTION_ARC:
+		return newARCPolicy(c.CacheObjects[sc]), nil
+	case config.EVICTION_SIZE:
+		return &sizePolicy{limit: c.CacheBytes[sc]}, nil
+	}
+
+	return nil, fmt.Errorf("unknown eviction policy : %v", c.EvictionPolicy[sc])
+}
+
+// sortByACTime sorts objects from the least recently used
+func sortByACTime(objs []dbagent.CachedObj) []dbagent.CachedObj {
+	sorted := append([]dbagent.CachedObj{}, objs...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].ACTime < sorted[j].ACTime })
+	return sorted
+}
+
+func hashesOf(objs []dbagent.CachedObj) []string {
+	hashes := []string{}
+	for _, obj := range objs {
+		hashes = append(hashes, obj.Hash)
+	}
+	return hashes
+}
+
+// timePolicy removes objects not accessed for TSCX of the storage class
+type timePolicy struct {
+	tsc float32 // Second
+}
+
+func (p *timePolicy) Name() string {
+	return config.EVICTION_TIME
+}
+
+func (p *timePolicy) Victims(objs []dbagent.CachedObj, now int64) []string {
+	ts := now - int64(p.tsc*float32(1e9))
+
+	hashes := []string{}
+	for _, obj := range objs {
+		if obj.ACTime < ts {
+			hashes = append(hashes, obj.Hash)
+		}
+	}
+
+	return hashes
+}
+
+// lruPolicy keeps capacity objects recently used
+type lruPolicy struct {
+	capacity int
+}
+
+func (p *lruPolicy) Name() string {
+	return config.EVICTION_LRU
+}
+
+func (p *lruPolicy) Victims(objs []dbagent.CachedObj, now int64) []string {
+	if len(objs) <= p.capacity {
+		return nil
+	}
+
+	return hashesOf(sortByACTime(objs)[:len(objs)-p.capacity])
+}
+
+// lfuPolicy keeps capacity objects frequently used, the least recently used one is removed first among the same count
+type lfuPolicy struct {
+	capacity int
+}
+
+func (p *lfuPolicy) Name() string {
+	return config.EVICTION_LFU
+}
+
+func (p *lfuPolicy) Victims(objs []dbagent.CachedObj, now int64) []string {
+	if len(objs) <= p.capacity {
+		return nil
+	}
+
+	sorted := sortByACTime(objs)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Count < sorted[j].Count })
+
+	return hashesOf(sorted[:len(objs)-p.capacity])
+}
+
+// sizePolicy removes the least recently used objects until the total size is under limit
+type sizePolicy struct {
+	limit int // Byte
+}
+
+func (p *sizePolicy) Name() string {
+	return config.EVICTION_SIZE
+}
+
+func (p *sizePolicy) Victims(objs []dbagent.CachedObj, now int64) []string {
+	total := 0
+	for _, obj := range objs {
+		total += obj.Size
+	}
+
+	hashes := []string{}
+	for _, obj := range sortByACTime(objs) {
+		if total <= p.limit {
+			break
+		}
+		total -= obj.Size
+		hashes = append(hashes, obj.Hash)
+	}
+
+	return hashes
+}
+
+// ghostList keeps hashes of evicted objects in the evicted order
+type ghostList struct {
+	order []string
+	set   map[string]bool
+}
+
+func (g *ghostList) add(hash string, capacity int) {
+	if g.set[hash] {
+		return
+	}
+
+	g.order = append(g.order, hash)
+	g.set[hash] = true
+	for capacity < len(g.order) {
+		delete(g.set, g.order[0])
+		g.order = g.order[1:]
+	}
+}
+
+func (g *ghostList) remove(hash string) bool {
+	if !g.set[hash] {
+		return false
+	}
+
+	delete(g.set, hash)
+	for i, h := range g.order {
+		if h == hash {
+			g.order = append(g.order[:i], g.order[i+1:]...)
+			break
+		}
+	}
+	return true
+}
+
+// arcPolicy is Adaptive Replacement Cache working on the snapshot of access information
+// T1 : objects accessed once, T2 : objects accessed more than once
+// B1, B2 : ghost lists of objects evicted from T1 and T2
+// An object fetched again after eviction adapts the target size of T1(p)
+type arcPolicy struct {
+	capacity int
+	p        int
+	b1       ghostList
+	b2       ghostList
+}
+
+func newARCPolicy(capacity int) *arcPolicy {
+	return &arcPolicy{
+		capacity: capacity,
+		p:        0,
+		b1:       ghostList{set: map[string]bool{}},
+		b2:       ghostList{set: map[string]bool{}},
+	}
+}
+
+func (p *arcPolicy) Name() string {
+	return config.EVICTION_ARC
+}
+
+func (p *arcPolicy) Victims(objs []dbagent.CachedObj, now int64) []string {
+	max := func(a, b int) int {
+		if a < b {
+			return b
+		}
+		return a
+	}
+	min := func(a, b int) int {
+		if a < b {
+			return a
+		}
+		return b
+	}
+
+	var t1, t2 []dbagent.CachedObj
+	for _, obj := range sortByACTime(objs) {
+		// Hits in ghost lists
+		if p.b1.remove(obj.Hash) {
+			p.p = min(p.capacity, p.p+max(len(p.b2.order)/max(len(p.b1.order), 1), 1))
+		} else if p.b2.remove(obj.Hash) {
+			p.p = max(0, p.p-max(len(p.b1.order)/max(len(p.b2.order), 1), 1))
+		}
+
+		if obj.Count <= 1 {
+			t1 = append(t1, obj)
+		} else {
+			t2 = append(t2, obj)
+		}
+	}
+
+	hashes := []string{}
+	for p.capacity < len(t1)+len(t2) {
+		if 0 < len(t1) && (p.p < len(t1) || len(t2) == 0) {
+			hashes = append(hashes, t1[0].Hash)
+			p.b1.add(t1[0].Hash, p.capacity)
+			t1 = t1[1:]
+		} else {
+			hashes = append(hashes, t2[0].Hash)
+			p.b2.add(t2[0].Hash, p.capacity)
+			t2 = t2[1:]
+		}
+	}
+
+	return hashes
+}
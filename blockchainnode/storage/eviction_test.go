@@ -0,0 +1,154 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/junwookheo/bcsos/common/blockchain"
+	"github.com/junwookheo/bcsos/common/config"
+	"github.com/junwookheo/bcsos/common/dbagent"
+	"github.com/junwookheo/bcsos/common/wallet"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEvictionPolicy(t *testing.T) {
+	const second = int64(1e9)
+	now := 100 * second
+	objs := []dbagent.CachedObj{
+		{Hash: "a", Size: 100, ACTime: 10 * second, Count: 5},
+		{Hash: "b", Size: 200, ACTime: 90 * second, Count: 1},
+		{Hash: "c", Size: 300, ACTime: 50 * second, Count: 2},
+		{Hash: "d", Size: 400, ACTime: 95 * second, Count: 1},
+	}
+
+	c := config.DefaultConfig()
+	c.EvictionPolicy = []string{config.EVICTION_TIME, config.EVICTION_LRU, config.EVICTION_LFU}
+	c.CacheObjects = []int{2, 2, 2}
+
+	p, err := NewEvictionPolicy(c, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, config.EVICTION_TIME, p.Name())
+	c.TSCX[0] = 30
+	p, _ = NewEvictionPolicy(c, 0)
+	assert.Equal(t, []string{"a", "c"}, p.Victims(objs, now))
+
+	p, _ = NewEvictionPolicy(c, 1)
+	assert.Equal(t, []string{"a", "c"}, p.Victims(objs, now))
+
+	p, _ = NewEvictionPolicy(c, 2)
+	assert.Equal(t, []string{"b", "d"}, p.Victims(objs, now))
+
+	p = &sizePolicy{limit: 500}
+	assert.Equal(t, []string{"a", "c", "b"}, p.Victims(objs, now))
+	assert.Empty(t, p.Victims(objs[:2], now))
+
+	_, err = NewEvictionPolicy(c, config.MAX_SC)
+	assert.NotNil(t, err)
+}
+
+func TestEvictionARC(t *testing.T) {
+	p := newARCPolicy(2)
+	objs := []dbagent.CachedObj{
+		{Hash: "a", ACTime: 1, Count: 3},
+		{Hash: "b", ACTime: 2, Count: 1},
+		{Hash: "c", ACTime: 3, Count: 1},
+	}
+
+	// p is 0, objects accessed once are evicted first
+	assert.Equal(t, []string{"b"}, p.Victims(objs, 0))
+	assert.True(t, p.b1.set["b"])
+
+	// b is fetched again, so the target size of T1 grows
+	objs = []dbagent.CachedObj{
+		{Hash: "a", ACTime: 1, Count: 3},
+		{Hash: "c", ACTime: 3, Count: 1},
+		{Hash: "b", ACTime: 4, Count: 1},
+	}
+	assert.Equal(t, []string{"c"}, p.Victims(objs, 0))
+	assert.Equal(t, 1, p.p)
+	assert.False(t, p.b1.set["b"])
+	assert.True(t, p.b1.set["c"])
+
+	// T1 is within the target size, T2 is evicted
+	objs = []dbagent.CachedObj{
+		{Hash: "a", ACTime: 1, Count: 3},
+		{Hash: "b", ACTime: 4, Count: 1},
+		{Hash: "d", ACTime: 5, Count: 2},
+	}
+	assert.Equal(t, []string{"a"}, p.Victims(objs, 0))
+	assert.True(t, p.b2.set["a"])
+}
+
+func TestEvictObjects(t *testing.T) {
+	path := "./eviction_test.db"
+	wallet_path := "./wallet_test.wallet"
+	defer os.Remove(path)
+	defer os.Remove(wallet_path)
+
+	w := wallet.NewWallet(wallet_path)
+	db := dbagent.NewDBAgent(path)
+	defer db.Close()
+
+	var trs []*blockchain.Transaction
+	for i := 0; i < 4; i++ {
+		trs = append(trs, blockchain.CreateTransaction(w, []byte(fmt.Sprintf("eviction-%v", i))))
+	}
+	db.AddBlock(blockchain.CreateBlock(trs, nil, 0))
+
+	objs := []dbagent.CachedObj{}
+	assert.True(t, db.GetCachedObjects(&objs))
+	assert.Equal(t, 5, len(objs)) // a header and transactions
+
+	status := *db.GetDBStatus()
+	om := ObjectMgr{db: db, policy: &lruPolicy{capacity: 2}}
+	om.EvictObjects()
+
+	objs = []dbagent.CachedObj{}
+	db.GetCachedObjects(&objs)
+	assert.Equal(t, 2, len(objs))
+	after := db.GetDBStatus()
+	assert.Equal(t, status.Headers+status.Transactions-3, after.Headers+after.Transactions)
+	assert.Less(t, after.Size, status.Size)
+}
+
+func TestEvictObjectsConcurrent(t *testing.T) {
+	path := "./eviction_concurrent_test.db"
+	wallet_path := "./wallet_test.wallet"
+	defer os.Remove(path)
+	defer os.Remove(wallet_path)
+
+	w := wallet.NewWallet(wallet_path)
+	db := dbagent.NewDBAgent(path)
+	defer db.Close()
+
+	var trs []*blockchain.Transaction
+	for i := 0; i < 8; i++ {
+		trs = append(trs, blockchain.CreateTransaction(w, []byte(fmt.Sprintf("concurrent-%v", i))))
+	}
+	db.AddBlock(blockchain.CreateBlock(trs, nil, 0))
+
+	// ARC keeps its lists across evictions, so the callers must not interleave
+	om := ObjectMgr{db: db, policy: newARCPolicy(2)}
+	var wg sync.WaitGroup
+	removed := make(chan int, 4)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			removed <- om.EvictObjects()
+		}()
+	}
+	wg.Wait()
+	close(removed)
+
+	total := 0
+	for cnt := range removed {
+		total += cnt
+	}
+	objs := []dbagent.CachedObj{}
+	db.GetCachedObjects(&objs)
+	assert.Equal(t, 2, len(objs))
+	assert.Equal(t, 9-2, total) // a header and transactions
+}
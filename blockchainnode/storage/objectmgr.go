@@ -2,17 +2,103 @@ package storage
 
 import (
 	"log"
+	"sync"
+	"time"
 
+	"github.com/junwookheo/bcsos/blockchainnode/network"
 	"github.com/junwookheo/bcsos/common/blockchain"
+	"github.com/junwookheo/bcsos/common/config"
 	"github.com/junwookheo/bcsos/common/dbagent"
 )
 
 type ObjectMgr struct {
-	db dbagent.DBAgent
+	db     dbagent.DBAgent
+	policy EvictionPolicy
+	mutex  sync.Mutex // eviction runs from the quota, the access pattern and the caching goroutines
 }
 
-func (c *ObjectMgr) DeleteNoAccedObjects() {
-	c.db.DeleteNoAccedObjects()
+// EvictObjects removes objects chosen by the eviction policy of the local storage class
+// The policy is chosen at the first eviction, after the config from the simulator is applied
+// Return the number of removed objects
+func (c *ObjectMgr) EvictObjects() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.evictObjects()
+}
+
+// evictObjects should be called with the mutex locked
+func (c *ObjectMgr) evictObjects() int {
+	if c.policy == nil {
+		local := network.NodeInfoInst().GetLocalddr()
+		policy, err := NewEvictionPolicy(config.ConfigInst(), local.SC)
+		if err != nil {
+			log.Printf("Eviction policy error : %v", err)
+			return 0
+		}
+		log.Printf("Eviction policy of SC%v : %v", local.SC, policy.Name())
+		c.policy = policy
+	}
+
+	objs := []dbagent.CachedObj{}
+	if !c.db.GetCachedObjects(&objs) {
+		return 0
+	}
+
+	return c.removeObjects(c.policy.Victims(objs, time.Now().UnixNano()))
+}
+
+func (c *ObjectMgr) removeObjects(hashes []string) int {
+	cnt := 0
+	for _, hash := range hashes {
+		if c.db.RemoveObject(hash) {
+			cnt++
+		}
+	}
+
+	return cnt
+}
+
+// MakeRoom removes objects so that an object of size can be added within quota
+// The eviction policy runs first, then the least recently used objects are removed.
+// Return the number of removed objects and false if the room cannot be made
+func (c *ObjectMgr) MakeRoom(size int, quota int) (int, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.db.GetDBStatus().Size+size <= quota {
+		return 0, true
+	}
+
+	// The highest storage class has no eviction policy
+	cnt := 0
+	if local := network.NodeInfoInst().GetLocalddr(); local.SC < config.ConfigInst().NumSC-1 {
+		cnt = c.evictObjects()
+	}
+
+	used := c.db.GetDBStatus().Size
+	if used+size <= quota {
+		return cnt, true
+	}
+
+	objs := []dbagent.CachedObj{}
+	if !c.db.GetCachedObjects(&objs) {
+		return cnt, false
+	}
+
+	// Blocks and objects not in the matching table cannot be removed
+	cached := 0
+	for _, obj := range objs {
+		cached += obj.Size
+	}
+	limit := quota - size - (used - cached)
+	if limit < 0 {
+		return cnt, false
+	}
+
+	cnt += c.removeObjects((&sizePolicy{limit: limit}).Victims(objs, time.Now().UnixNano()))
+
+	return cnt, c.db.GetDBStatus().Size+size <= quota
 }
 
 func (c *ObjectMgr) AccessWithUniform(num int, rethashes *[]dbagent.RemoverbleObj) bool {
@@ -26,7 +112,9 @@ func (c *ObjectMgr) AccessWithUniform(num int, rethashes *[]dbagent.RemoverbleOb
 	for _, hash := range hashes {
 		if hash.HashType == 0 {
 			var bh blockchain.BlockHeader
-			if c.db.GetBlockHeader(hash.Hash, &bh) == 0 {
+			hit := c.db.GetBlockHeader(hash.Hash, &bh) != 0
+			logLocalAccess(c.db, "blockheader", hash.Hash, hit)
+			if !hit {
 				*rethashes = append(*rethashes, hash)
 				ret = true
 			} else {
@@ -34,7 +122,9 @@ func (c *ObjectMgr) AccessWithUniform(num int, rethashes *[]dbagent.RemoverbleOb
 			}
 		} else {
 			var tr blockchain.Transaction
-			if c.db.GetTransaction(hash.Hash, &tr) == 0 {
+			hit := c.db.GetTransaction(hash.Hash, &tr) != 0
+			logLocalAccess(c.db, "transaction", hash.Hash, hit)
+			if !hit {
 				*rethashes = append(*rethashes, hash)
 				ret = true
 			} else {
@@ -58,7 +148,9 @@ func (c *ObjectMgr) AccessWithExponential(num int, rethashes *[]dbagent.Removerb
 	for _, hash := range hashes {
 		if hash.HashType == 0 {
 			var bh blockchain.BlockHeader
-			if c.db.GetBlockHeader(hash.Hash, &bh) == 0 {
+			hit := c.db.GetBlockHeader(hash.Hash, &bh) != 0
+			logLocalAccess(c.db, "blockheader", hash.Hash, hit)
+			if !hit {
 				*rethashes = append(*rethashes, hash)
 				ret = true
 			} else {
@@ -66,7 +158,9 @@ func (c *ObjectMgr) AccessWithExponential(num int, rethashes *[]dbagent.Removerb
 			}
 		} else {
 			var tr blockchain.Transaction
-			if c.db.GetTransaction(hash.Hash, &tr) == 0 {
+			hit := c.db.GetTransaction(hash.Hash, &tr) != 0
+			logLocalAccess(c.db, "transaction", hash.Hash, hit)
+			if !hit {
 				*rethashes = append(*rethashes, hash)
 				ret = true
 			} else {
@@ -79,6 +173,6 @@ func (c *ObjectMgr) AccessWithExponential(num int, rethashes *[]dbagent.Removerb
 }
 
 func NewObjMgr(db dbagent.DBAgent) *ObjectMgr {
-	om := ObjectMgr{db}
+	om := ObjectMgr{db: db, policy: nil}
 	return &om
 }
@@ -0,0 +1,48 @@
+package storage
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/junwookheo/bcsos/common/dtype"
+)
+
+// The number of hot objects if it is not requested
+const DEFAULT_HOT_OBJECTS int = 10
+
+// objectStatsHandler returns popularity statistics from the access log
+// Request : the number of hot objects
+// Response : hot objects, the hit ratio for each storage class and messages for each routing mode
+func (h *StorageMgr) objectStatsHandler(w http.ResponseWriter, r *http.Request) {
+	upgrader.CheckOrigin = func(r *http.Request) bool { return true }
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println("objectStatsHandler", err)
+		return
+	}
+	defer ws.Close()
+
+	var req dtype.ReqObjectStats
+	if err := ws.ReadJSON(&req); err != nil {
+		log.Printf("Read json error : %v", err)
+		return
+	}
+
+	if err := ws.WriteJSON(h.getObjectStats(req.Num)); err != nil {
+		log.Printf("Write json error : %v", err)
+		return
+	}
+}
+
+func (h *StorageMgr) getObjectStats(num int) *dtype.ResObjectStats {
+	if num <= 0 {
+		num = DEFAULT_HOT_OBJECTS
+	}
+
+	res := dtype.ResObjectStats{Objects: []dtype.ObjectStat{}, HitRatio: []dtype.SCHitRatio{}, Routing: []dtype.RoutingStat{}}
+	h.db.GetHotObjects(num, &res.Objects)
+	h.db.GetHitRatio(&res.HitRatio)
+	h.db.GetRoutingStats(&res.Routing)
+
+	return &res
+}
@@ -0,0 +1,116 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"time"
+
+	"github.com/junwookheo/bcsos/blockchainnode/network"
+	"github.com/junwookheo/bcsos/common/config"
+	"github.com/junwookheo/bcsos/common/dtype"
+)
+
+// Query executor of objects
+// A request is sent to QueryFanout closest nodes in parallel with a deadline of QueryTimeout.
+// The next wave is hedged after HedgeDelay or sent when all queries of the wave failed.
+// The first valid object cancels other queries.
+
+// ErrObjectNotFound is answered by a node which does not have the object, it is not misbehavior
+var ErrObjectNotFound = errors.New("object not found")
+
+// queryResult is an answer of a node, elapsed is from the request to the node to its answer
+type queryResult struct {
+	node    dtype.NodeInfo
+	res     dtype.ReqData
+	obj     interface{}
+	elapsed time.Duration
+	err     error
+}
+
+// queryObject sends the request to the node and verifies the object if req.Verify is set
+// The request is abandoned when ctx is done, so a hung node does not block the caller.
+func (h *StorageMgr) queryObject(ctx context.Context, node *dtype.NodeInfo, req *dtype.ReqData, obj interface{}) (dtype.ReqData, error) {
+	res := dtype.ResObject{}
+	if err := network.PeerMgrInst().RequestContext(ctx, node, network.MSG_GET_OBJECT, req, &res); err != nil {
+		return res.Data, err
+	}
+	if res.NotFound {
+		return res.Data, fmt.Errorf("%w : %v in %v:%v", ErrObjectNotFound, req.ObjHash, node.IP, node.Port)
+	}
+
+	if err := json.Unmarshal(res.Object, obj); err != nil {
+		return res.Data, err
+	}
+	if reflect.ValueOf(obj).Elem().IsZero() {
+		return res.Data, fmt.Errorf("%w : empty object of %v in %v:%v", ErrObjectNotFound, req.ObjHash, node.IP, node.Port)
+	}
+
+	// Use the request sent, not the one returned by the peer, only an object answered is penalised if it is not valid
+	if req.Verify {
+		if err := h.verifyObject(req, obj, &res.Proof); err != nil {
+			nm := network.NodeMgrInst()
+			nm.ReportMisbehavior(node, fmt.Sprintf("%v %v", req.ObjHash, err))
+			return res.Data, err
+		}
+	}
+
+	return res.Data, nil
+}
+
+// fanOut queries nodes in order of waves and copies the first valid object to obj
+// It returns the answer, nil if no node answered, and the number of nodes queried.
+func (h *StorageMgr) fanOut(nodes []dtype.NodeInfo, req *dtype.ReqData, obj interface{}) (*queryResult, int) {
+	cfg := config.ConfigInst()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	results := make(chan *queryResult, len(nodes))
+	sent, pending := 0, 0
+	var hedge <-chan time.Time
+	send := func() {
+		for i := 0; i < cfg.QueryFanout && sent < len(nodes); i++ {
+			go func(node dtype.NodeInfo) {
+				qctx, qcancel := context.WithTimeout(ctx, time.Duration(cfg.QueryTimeout)*time.Millisecond)
+				defer qcancel()
+
+				start := time.Now()
+				r := queryResult{node: node, obj: reflect.New(reflect.TypeOf(obj).Elem()).Interface()}
+				r.res, r.err = h.queryObject(qctx, &node, req, r.obj)
+				r.elapsed = time.Since(start)
+				results <- &r
+			}(nodes[sent])
+			sent++
+			pending++
+		}
+
+		hedge = nil
+		if 0 < cfg.HedgeDelay && sent < len(nodes) {
+			hedge = time.After(time.Duration(cfg.HedgeDelay) * time.Millisecond)
+		}
+	}
+
+	send()
+	for 0 < pending {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				reflect.ValueOf(obj).Elem().Set(reflect.ValueOf(r.obj).Elem())
+				return r, sent
+			}
+
+			log.Printf("queryObject fail(%v:%v) : %v", r.node.IP, r.node.Port, r.err)
+			if pending == 0 {
+				send()
+			}
+		case <-hedge:
+			send()
+		}
+	}
+
+	return nil, sent
+}
@@ -0,0 +1,116 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/junwookheo/bcsos/blockchainnode/network"
+	"github.com/junwookheo/bcsos/common/blockchain"
+	"github.com/junwookheo/bcsos/common/config"
+	"github.com/junwookheo/bcsos/common/dtype"
+	"github.com/junwookheo/bcsos/common/wallet"
+	"github.com/stretchr/testify/assert"
+)
+
+// objectServer answers a block header after delay, servers share the identity of the local node
+func objectServer(delay time.Duration) (*httptest.Server, dtype.NodeInfo) {
+	return queryServer(func(res *dtype.ResObject) {
+		time.Sleep(delay)
+
+		res.Data.SC, res.Data.Hop = 1, 1
+		res.Object, _ = json.Marshal(blockchain.BlockHeader{Height: int(delay.Milliseconds()), Timestamp: 1})
+	})
+}
+
+// queryServer answers queries of objects with the response set by answer
+func queryServer(answer func(res *dtype.ResObject)) (*httptest.Server, dtype.NodeInfo) {
+	p := network.NewPeerMgr()
+	p.Handle(network.MSG_GET_OBJECT, func(payload json.RawMessage) (interface{}, error) {
+		res := dtype.ResObject{}
+		if err := json.Unmarshal(payload, &res.Data); err != nil {
+			return nil, err
+		}
+
+		answer(&res)
+		return res, nil
+	})
+	s := httptest.NewServer(http.HandlerFunc(p.PeerHandler))
+
+	host, port, _ := net.SplitHostPort(strings.TrimPrefix(s.URL, "http://"))
+	n, _ := strconv.Atoi(port)
+	return s, dtype.NodeInfo{IP: host, Port: n, Hash: network.NodeInfoInst().GetLocalddr().Hash}
+}
+
+func TestFanOut(t *testing.T) {
+	defer config.SetConfig(config.DefaultConfig())
+	network.NodeInfoInst().SetLocalddrParam("ST", 0, 0, wallet.NewWallet(filepath.Join(t.TempDir(), "node.wallet")))
+
+	slow, slowNode := objectServer(3 * time.Second)
+	defer slow.Close()
+	fast, fastNode := objectServer(0)
+	defer fast.Close()
+
+	h := StorageMgr{}
+	req := dtype.ReqData{ObjType: "blockheader", ObjHash: "00"}
+
+	// The hedged query answers first and the slow one is cancelled
+	c := config.DefaultConfig()
+	c.QueryFanout, c.QueryTimeout, c.HedgeDelay = 1, 5000, 50
+	assert.Nil(t, config.SetConfig(c))
+
+	start := time.Now()
+	bh := blockchain.BlockHeader{}
+	r, sent := h.fanOut([]dtype.NodeInfo{slowNode, fastNode}, &req, &bh)
+	assert.NotNil(t, r)
+	assert.Equal(t, 2, sent)
+	assert.Equal(t, fastNode, r.node)
+	assert.Equal(t, 1, r.res.Hop)
+	assert.Equal(t, 0, bh.Height)
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+
+	// Without hedging, the next wave is sent after the slow query times out
+	c.HedgeDelay, c.QueryTimeout = 0, 200
+	assert.Nil(t, config.SetConfig(c))
+	r, sent = h.fanOut([]dtype.NodeInfo{slowNode, fastNode}, &req, &bh)
+	assert.NotNil(t, r)
+	assert.Equal(t, 2, sent)
+	assert.Equal(t, fastNode, r.node)
+
+	// No node answers in time
+	r, sent = h.fanOut([]dtype.NodeInfo{slowNode}, &req, &bh)
+	assert.Nil(t, r)
+	assert.Equal(t, 1, sent)
+}
+
+func TestQueryNotFound(t *testing.T) {
+	network.NodeInfoInst().SetLocalddrParam("ST", 0, 0, wallet.NewWallet(filepath.Join(t.TempDir(), "node.wallet")))
+
+	h := StorageMgr{}
+	req := dtype.ReqData{ObjType: "blockheader", ObjHash: "00", Verify: true}
+	nm := network.NodeMgrInst()
+
+	// A node without the object is not penalised
+	s, node := queryServer(func(res *dtype.ResObject) { res.NotFound = true })
+	defer s.Close()
+	before := nm.GetMisbehavior(node.Hash)
+	_, err := h.queryObject(context.Background(), &node, &req, &blockchain.BlockHeader{})
+	assert.ErrorIs(t, err, ErrObjectNotFound)
+	assert.Equal(t, before, nm.GetMisbehavior(node.Hash))
+
+	// An object not matching the request is penalised
+	bad, badNode := objectServer(0)
+	defer bad.Close()
+	_, err = h.queryObject(context.Background(), &badNode, &req, &blockchain.BlockHeader{})
+	assert.NotNil(t, err)
+	assert.False(t, errors.Is(err, ErrObjectNotFound))
+	assert.Equal(t, before+1, nm.GetMisbehavior(node.Hash))
+}
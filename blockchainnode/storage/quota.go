@@ -0,0 +1,162 @@
+package storage
+
+import (
+	"encoding/hex"
+	"log"
+
+	"github.com/junwookheo/bcsos/blockchainnode/network"
+	"github.com/junwookheo/bcsos/common/blockchain"
+	"github.com/junwookheo/bcsos/common/config"
+	"github.com/junwookheo/bcsos/common/dbagent"
+	"github.com/junwookheo/bcsos/common/dtype"
+	"github.com/junwookheo/bcsos/common/serial"
+)
+
+// Byte quota of local storage to reproduce storage-constrained nodes
+// Objects received from other nodes are cached only within the quota.
+// If the quota is exceeded, objects are evicted by the policy or the object is not cached.
+// Blocks of the node are always stored, so the quota can be exceeded by them.
+
+// QuotaStatus reports the pressure of the quota
+type QuotaStatus struct {
+	Quota    int     // Byte, 0 is unlimited
+	Used     int     // Byte, the same as DBStatus.Size
+	Pressure float64 // Used / Quota
+	Evicted  int     // the number of objects evicted to cache objects
+	Declined int     // the number of objects not cached due to the quota
+}
+
+// nodeStatus is sent to the web app at /statusinfo with gossip statistics including duplicate bytes
+type nodeStatus struct {
+	*dbagent.DBStatus
+	QuotaStatus
+	Gossip dtype.GossipStat `json:"Gossip"`
+}
+
+// SetQuota sets the byte quota of the node, 0 uses quota_bytes of the storage class in the config
+func (h *StorageMgr) SetQuota(quota int) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.quota.Quota = quota
+}
+
+func (h *StorageMgr) getQuota() int {
+	h.mutex.Lock()
+	quota := h.quota.Quota
+	h.mutex.Unlock()
+
+	if quota == 0 {
+		local := network.NodeInfoInst().GetLocalddr()
+		quota = config.ConfigInst().Quota(local.SC)
+	}
+
+	return quota
+}
+
+func (h *StorageMgr) GetQuotaStatus() QuotaStatus {
+	quota := h.getQuota()
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	status := h.quota
+	status.Quota = quota
+	status.Used = h.db.GetDBStatus().Size
+	if quota != 0 {
+		status.Pressure = float64(status.Used) / float64(quota)
+	}
+
+	return status
+}
+
+// cacheObject adds an object of size with add if there is room within the quota
+// Return false if the object is declined
+func (h *StorageMgr) cacheObject(size int, add func() int64) bool {
+	quota := h.getQuota()
+	if quota == 0 {
+		add()
+		return true
+	}
+
+	// Eviction and adding are not interleaved with other objects
+	h.quotaMutex.Lock()
+	defer h.quotaMutex.Unlock()
+
+	evicted, ok := h.om.MakeRoom(size, quota)
+
+	h.mutex.Lock()
+	h.quota.Evicted += evicted
+	if !ok {
+		h.quota.Declined++
+	}
+	h.mutex.Unlock()
+
+	if !ok {
+		return false
+	}
+
+	add()
+	return true
+}
+
+// cacheTransaction adds a transaction received from other nodes within the quota
+func (h *StorageMgr) cacheTransaction(tr *blockchain.Transaction) bool {
+	// Transactions reconstructed from shards are not kept in the highest storage class
+	if isErasureCoding() {
+		return true
+	}
+
+	size := len(hex.EncodeToString(tr.Hash)) + len(serial.Serialize(tr))
+	if !h.cacheObject(size, func() int64 { return h.db.AddTransaction(tr) }) {
+		log.Printf("Quota exceeded, transaction is not cached : %v", hex.EncodeToString(tr.Hash))
+		return false
+	}
+	provide(hex.EncodeToString(tr.Hash))
+
+	return true
+}
+
+// cacheBlockHeader adds a block header received from other nodes within the quota
+func (h *StorageMgr) cacheBlockHeader(hash string, bh *blockchain.BlockHeader) bool {
+	size := len(hash) + len(serial.Serialize(bh))
+	if !h.cacheObject(size, func() int64 { return h.db.AddBlockHeader(hash, bh) }) {
+		log.Printf("Quota exceeded, block header is not cached : %v", hash)
+		return false
+	}
+	provide(hash)
+
+	return true
+}
+
+// provide announces the cached objects for content routing
+func provide(hashes ...string) {
+	if !config.ConfigInst().ContentRouting || len(hashes) == 0 {
+		return
+	}
+
+	go func() {
+		for _, hash := range hashes {
+			network.NodeMgrInst().Provide(hash)
+		}
+	}()
+}
+
+// provideObjects announces all objects kept in local storage again, provider records expire after PROVIDER_TTL
+func (h *StorageMgr) provideObjects() {
+	if !config.ConfigInst().ContentRouting {
+		return
+	}
+
+	objs := []dbagent.CachedObj{}
+	if !h.db.GetCachedObjects(&objs) {
+		return
+	}
+
+	hashes := []string{}
+	for _, obj := range objs {
+		hashes = append(hashes, obj.Hash)
+	}
+	log.Printf("Provide objects again : %v", len(hashes))
+	provide(hashes...)
+}
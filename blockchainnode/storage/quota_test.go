@@ -0,0 +1,52 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/junwookheo/bcsos/common/blockchain"
+	"github.com/junwookheo/bcsos/common/dbagent"
+	"github.com/junwookheo/bcsos/common/wallet"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQuota(t *testing.T) {
+	path := "./quota_test.db"
+	wallet_path := "./wallet_test.wallet"
+	defer os.Remove(path)
+	defer os.Remove(wallet_path)
+
+	w := wallet.NewWallet(wallet_path)
+	db := dbagent.NewDBAgent(path)
+	defer db.Close()
+	h := StorageMgr{db: db, om: NewObjMgr(db)}
+
+	var trs []*blockchain.Transaction
+	for i := 0; i < 4; i++ {
+		trs = append(trs, blockchain.CreateTransaction(w, []byte(fmt.Sprintf("quota-%v", i))))
+	}
+	db.AddBlock(blockchain.CreateBlock(trs, nil, 0))
+	used := db.GetDBStatus().Size
+
+	// Unlimited
+	assert.True(t, h.cacheTransaction(blockchain.CreateTransaction(w, []byte("unlimited"))))
+	assert.Equal(t, 0, h.GetQuotaStatus().Quota)
+	used = db.GetDBStatus().Size
+
+	// Old objects are evicted to make room
+	h.SetQuota(used + 10)
+	assert.True(t, h.cacheTransaction(blockchain.CreateTransaction(w, []byte("evict"))))
+	status := h.GetQuotaStatus()
+	assert.Less(t, 0, status.Evicted)
+	assert.Equal(t, 0, status.Declined)
+	assert.LessOrEqual(t, status.Used, status.Quota)
+	assert.LessOrEqual(t, status.Pressure, 1.0)
+
+	// Objects which cannot be removed are over the quota
+	h.SetQuota(10)
+	assert.False(t, h.cacheTransaction(blockchain.CreateTransaction(w, []byte("decline"))))
+	status = h.GetQuotaStatus()
+	assert.Equal(t, 1, status.Declined)
+	assert.Less(t, 1.0, status.Pressure)
+}
@@ -0,0 +1,299 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	mrand "math/rand"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/junwookheo/bcsos/blockchainnode/network"
+	"github.com/junwookheo/bcsos/common/blockchain"
+	"github.com/junwookheo/bcsos/common/config"
+	"github.com/junwookheo/bcsos/common/dbagent"
+	"github.com/junwookheo/bcsos/common/dtype"
+	"github.com/junwookheo/bcsos/common/listener"
+	"github.com/junwookheo/bcsos/common/wallet"
+)
+
+// Replication of the highest storage class
+// 1. Each object is assigned to the ReplicationFactor closest nodes of the highest storage class by XOR distance
+// 2. Holders of objects in local storage are audited every AuditPeriod with a nonce challenge
+// 3. The object is sent to a holder which failed, a holder which left scnInfo is replaced by the next closest node
+// 4. A node which is not a holder drops the object after all holders passed the audit, a repaired holder is audited again
+
+// The number of objects audited in a round
+const NUM_REPLICA_AUDIT int = 20
+
+type ReplicationMgr struct {
+	status dtype.ResReplicationStatus
+	under  map[string]dtype.UnderReplicated
+	mutex  sync.Mutex
+}
+
+func NewReplicationMgr() *ReplicationMgr {
+	return &ReplicationMgr{under: make(map[string]dtype.UnderReplicated)}
+}
+
+// selectHolders returns r closest nodes to hash among nodes including the local node
+func selectHolders(hash string, local *dtype.NodeInfo, nodes []dtype.NodeInfo, r int) []dtype.NodeInfo {
+	candidates := []dtype.NodeInfo{*local}
+	for _, node := range nodes {
+		if node.Hash != "" && node.Hash != local.Hash {
+			candidates = append(candidates, node)
+		}
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return wallet.CloserXor(hash, candidates[i].Hash, candidates[j].Hash)
+	})
+
+	if r < len(candidates) {
+		candidates = candidates[:r]
+	}
+
+	return candidates
+}
+
+func auditProof(nonce string, data []byte) string {
+	proof := sha256.Sum256(append([]byte(nonce), data...))
+	return hex.EncodeToString(proof[:])
+}
+
+// AuditReplicas audits holders of num objects in local storage and repairs replicas
+func (h *StorageMgr) AuditReplicas(num int) {
+	c := config.ConfigInst()
+	local := network.NodeInfoInst().GetLocalddr()
+	// Transactions are kept as shards in erasure coding mode
+	if c.ReplicationFactor == 0 || local.SC != c.NumSC-1 || isErasureCoding() {
+		return
+	}
+
+	objs := []dbagent.CachedObj{}
+	if !h.db.GetCachedObjects(&objs) {
+		return
+	}
+	mrand.Shuffle(len(objs), func(i, j int) { objs[i], objs[j] = objs[j], objs[i] })
+	if num < len(objs) {
+		objs = objs[:num]
+	}
+
+	// Block headers are kept in all nodes to verify transactions
+	for _, obj := range objs {
+		if obj.Type != "transaction" {
+			continue
+		}
+
+		var nodes [config.MAX_SC_PEER]dtype.NodeInfo
+		network.NodeMgrInst().GetSCNNodeListbyDistance(c.NumSC-1, obj.Hash, &nodes)
+		h.auditReplica(obj.Hash, local, nodes[:], c.ReplicationFactor)
+	}
+}
+
+func (h *StorageMgr) auditReplica(hash string, local *dtype.NodeInfo, nodes []dtype.NodeInfo, r int) {
+	objtype, data := h.db.GetObjectData(hash)
+	if data == nil {
+		return
+	}
+
+	holder, repaired := false, 0
+	passed := []string{}
+	for _, node := range selectHolders(hash, local, nodes, r) {
+		if node.Hash == local.Hash {
+			holder = true
+			passed = append(passed, node.Hash)
+			continue
+		}
+
+		// A repaired holder is counted after it passes a new challenge
+		if challengeHolder(&node, hash, data) {
+			passed = append(passed, node.Hash)
+		} else if pushReplica(&node, &dtype.Replica{Type: objtype, Hash: hash, Data: data}) && challengeHolder(&node, hash, data) {
+			log.Printf("Replica repaired %v : %v", node.Hash, hash)
+			passed = append(passed, node.Hash)
+			repaired++
+		}
+	}
+
+	h.rm.mutex.Lock()
+	h.rm.status.Audited++
+	h.rm.status.Repaired += repaired
+	if len(passed) < r {
+		h.rm.under[hash] = dtype.UnderReplicated{Hash: hash, Type: objtype, Replicas: len(passed), Holders: passed}
+	} else {
+		delete(h.rm.under, hash)
+	}
+	h.rm.mutex.Unlock()
+
+	// Enough replicas passed the audit in other nodes
+	if !holder && r <= len(passed) && h.db.RemoveObject(hash) {
+		h.rm.mutex.Lock()
+		h.rm.status.Dropped++
+		h.rm.mutex.Unlock()
+	}
+}
+
+// challengeHolder audits the node with a new nonce, it returns true if the proof matches data
+func challengeHolder(node *dtype.NodeInfo, hash string, data []byte) bool {
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+
+	proof := auditHolder(node, hash, hex.EncodeToString(nonce))
+	return proof != "" && proof == auditProof(hex.EncodeToString(nonce), data)
+}
+
+// auditReplicaMessage answers a challenge of an object
+// Request : hash of object and nonce
+// Response : sha256(nonce + object), empty if not found
+func (h *StorageMgr) auditReplicaMessage(payload json.RawMessage) (interface{}, error) {
+	var req dtype.ReqAudit
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return nil, err
+	}
+
+	local := network.NodeInfoInst().GetLocalddr()
+	res := dtype.ResAudit{Addr: local.Hash}
+	if _, data := h.db.GetObjectData(req.Hash); data != nil {
+		res.Proof = auditProof(req.Nonce, data)
+	}
+
+	return res, nil
+}
+
+func auditHolder(node *dtype.NodeInfo, hash string, nonce string) string {
+	res := dtype.ResAudit{}
+	if err := network.PeerMgrInst().Request(node, network.MSG_AUDIT, dtype.ReqAudit{Hash: hash, Nonce: nonce}, &res); err != nil {
+		log.Printf("auditHolder error : %v", err)
+		return ""
+	}
+
+	return res.Proof
+}
+
+// putReplicaMessage stores an object sent by other holders
+// Request : replica
+// Response : true if it is stored
+func (h *StorageMgr) putReplicaMessage(payload json.RawMessage) (interface{}, error) {
+	var rep dtype.Replica
+	if err := json.Unmarshal(payload, &rep); err != nil {
+		return nil, err
+	}
+
+	ok := h.addReplica(&rep)
+	if !ok {
+		log.Printf("Replica not stored : %v", rep.Hash)
+	}
+
+	return ok, nil
+}
+
+// addReplica verifies the object of the replica and stores it within the quota
+// The object should be in a block kept in local storage, transactions are not kept in erasure coding mode.
+func (h *StorageMgr) addReplica(rep *dtype.Replica) bool {
+	if blockhash, _ := h.db.GetBlockHashOfObject(rep.Hash); blockhash == "" {
+		return false
+	}
+
+	switch rep.Type {
+	case "transaction":
+		tr := blockchain.Transaction{}
+		if isErasureCoding() || tr.UnmarshalBinary(rep.Data) != nil {
+			return false
+		}
+		if hex.EncodeToString(tr.Hash) != rep.Hash || !bytes.Equal(tr.Hash, tr.GetHash()) || !tr.Verify() {
+			return false
+		}
+		return h.cacheTransaction(&tr)
+	case "blockheader":
+		bh := blockchain.BlockHeader{}
+		if bh.UnmarshalBinary(rep.Data) != nil || hex.EncodeToString(bh.GetHash()) != rep.Hash {
+			return false
+		}
+		return h.cacheBlockHeader(rep.Hash, &bh)
+	}
+
+	return false
+}
+
+func pushReplica(node *dtype.NodeInfo, rep *dtype.Replica) bool {
+	ok := false
+	if err := network.PeerMgrInst().Request(node, network.MSG_PUT_REPLICA, rep, &ok); err != nil {
+		log.Printf("pushReplica error : %v", err)
+		return false
+	}
+
+	return ok
+}
+
+// replicationStatusHandler returns counters of audits and under-replicated objects
+// Request : none
+// Response : replication status
+func (h *StorageMgr) replicationStatusHandler(w http.ResponseWriter, r *http.Request) {
+	upgrader.CheckOrigin = func(r *http.Request) bool { return true }
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println("replicationStatusHandler", err)
+		return
+	}
+	defer ws.Close()
+
+	if err := ws.WriteJSON(h.GetReplicationStatus()); err != nil {
+		log.Printf("Write json error : %v", err)
+		return
+	}
+}
+
+func (h *StorageMgr) GetReplicationStatus() *dtype.ResReplicationStatus {
+	h.rm.mutex.Lock()
+	defer h.rm.mutex.Unlock()
+
+	status := h.rm.status
+	status.Factor = config.ConfigInst().ReplicationFactor
+	status.UnderReplicated = []dtype.UnderReplicated{}
+	for _, u := range h.rm.under {
+		status.UnderReplicated = append(status.UnderReplicated, u)
+	}
+	sort.Slice(status.UnderReplicated, func(i, j int) bool {
+		return status.UnderReplicated[i].Replicas < status.UnderReplicated[j].Replicas
+	})
+
+	return &status
+}
+
+func (h *StorageMgr) ReplicationProc() {
+	command := make(chan string)
+	el := listener.EventListenerInst()
+	el.AddListener(command)
+
+	go func(command <-chan string) {
+		var status = "Pause"
+		for {
+			select {
+			case cmd := <-command:
+				switch cmd {
+				case "Stop":
+					return
+				case "Pause":
+					status = "Pause"
+				case "Resume":
+					status = "Running"
+				case "Start":
+					status = "Running"
+				}
+			default:
+				if status == "Running" {
+					h.AuditReplicas(NUM_REPLICA_AUDIT)
+					time.Sleep(time.Duration(config.ConfigInst().AuditPeriod) * time.Second)
+				} else {
+					time.Sleep(time.Second)
+				}
+			}
+		}
+	}(command)
+}
@@ -0,0 +1,142 @@
+package storage
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/junwookheo/bcsos/blockchainnode/network"
+	"github.com/junwookheo/bcsos/common/blockchain"
+	"github.com/junwookheo/bcsos/common/dbagent"
+	"github.com/junwookheo/bcsos/common/dtype"
+	"github.com/junwookheo/bcsos/common/serial"
+	"github.com/junwookheo/bcsos/common/wallet"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSelectHolders(t *testing.T) {
+	local := dtype.NodeInfo{Hash: "f0"}
+	nodes := []dtype.NodeInfo{{Hash: "01"}, {Hash: ""}, {Hash: "0f"}, {Hash: "f0"}, {Hash: "ff"}}
+
+	holders := selectHolders("00", &local, nodes, 2)
+	assert.Equal(t, []dtype.NodeInfo{{Hash: "01"}, {Hash: "0f"}}, holders)
+
+	holders = selectHolders("f1", &local, nodes, 2)
+	assert.Equal(t, []dtype.NodeInfo{{Hash: "f0"}, {Hash: "ff"}}, holders)
+
+	// The local node is not counted twice
+	holders = selectHolders("00", &local, nodes, 7)
+	assert.Equal(t, 4, len(holders))
+}
+
+func TestReplicaAudit(t *testing.T) {
+	path := "./replication_test.db"
+	wallet_path := "./wallet_test.wallet"
+	defer os.Remove(path)
+	defer os.Remove(wallet_path)
+
+	w := wallet.NewWallet(wallet_path)
+	db := dbagent.NewDBAgent(path)
+	defer db.Close()
+	h := StorageMgr{db: db, om: NewObjMgr(db), rm: NewReplicationMgr()}
+
+	tr := blockchain.CreateTransaction(w, []byte("replication"))
+	other := blockchain.CreateTransaction(w, []byte("other"))
+	db.AddBlock(blockchain.CreateBlock([]*blockchain.Transaction{tr}, nil, 0))
+	hash := hex.EncodeToString(tr.Hash)
+	local := dtype.NodeInfo{Hash: hex.EncodeToString(w.PublicKey)}
+
+	// The local node is the only holder
+	h.auditReplica(hash, &local, []dtype.NodeInfo{}, 1)
+	status := h.GetReplicationStatus()
+	assert.Equal(t, 1, status.Audited)
+	assert.Empty(t, status.UnderReplicated)
+
+	// The closest holder is not reachable, the object is kept
+	far := dtype.NodeInfo{IP: "127.0.0.1", Port: 1, Hash: hash}
+	h.auditReplica(hash, &local, []dtype.NodeInfo{far}, 1)
+	status = h.GetReplicationStatus()
+	assert.Equal(t, 1, len(status.UnderReplicated))
+	assert.Equal(t, 0, status.UnderReplicated[0].Replicas)
+	assert.Equal(t, 0, status.Dropped)
+	_, data := db.GetObjectData(hash)
+	assert.NotNil(t, data)
+
+	// Replicas are verified before stored
+	db.RemoveObject(hash)
+	assert.False(t, h.addReplica(&dtype.Replica{Type: "transaction", Hash: hash, Data: serial.Serialize(other)}))
+	assert.False(t, h.addReplica(&dtype.Replica{Type: "transaction", Hash: hex.EncodeToString(other.Hash), Data: serial.Serialize(other)}))
+	assert.True(t, h.addReplica(&dtype.Replica{Type: "transaction", Hash: hash, Data: data}))
+}
+
+// replicaServer serves the holder with replication messages of h, a lying holder acknowledges replicas without storing them
+// Servers share the identity of the local node.
+func replicaServer(h *StorageMgr, lying bool) (*httptest.Server, dtype.NodeInfo) {
+	p := network.NewPeerMgr()
+	if lying {
+		p.Handle(network.MSG_AUDIT, func(payload json.RawMessage) (interface{}, error) { return dtype.ResAudit{}, nil })
+		p.Handle(network.MSG_PUT_REPLICA, func(payload json.RawMessage) (interface{}, error) { return true, nil })
+	} else {
+		p.Handle(network.MSG_AUDIT, h.auditReplicaMessage)
+		p.Handle(network.MSG_PUT_REPLICA, h.putReplicaMessage)
+	}
+	s := httptest.NewServer(http.HandlerFunc(p.PeerHandler))
+
+	host, port, _ := net.SplitHostPort(strings.TrimPrefix(s.URL, "http://"))
+	n, _ := strconv.Atoi(port)
+	return s, dtype.NodeInfo{IP: host, Port: n, Hash: network.NodeInfoInst().GetLocalddr().Hash}
+}
+
+func TestReplicaRepair(t *testing.T) {
+	dir := t.TempDir()
+	w := wallet.NewWallet(filepath.Join(dir, "wallet_test.wallet"))
+	db := dbagent.NewDBAgent(filepath.Join(dir, "local.db"))
+	defer db.Close()
+	h := StorageMgr{db: db, om: NewObjMgr(db), rm: NewReplicationMgr()}
+
+	tr := blockchain.CreateTransaction(w, []byte("repair"))
+	b := blockchain.CreateBlock([]*blockchain.Transaction{tr}, nil, 0)
+	db.AddBlock(b)
+	hash := hex.EncodeToString(tr.Hash)
+
+	// Holders are closer to the object than the local node with the inverted hash
+	network.NodeInfoInst().SetLocalddrParam("ST", 0, 0, w)
+	far := make([]byte, len(tr.Hash))
+	for i, v := range tr.Hash {
+		far[i] = ^v
+	}
+	local := dtype.NodeInfo{Hash: hex.EncodeToString(far)}
+
+	// A holder acknowledging the replica without keeping it does not pass, the object is kept
+	s, liar := replicaServer(nil, true)
+	defer s.Close()
+	h.auditReplica(hash, &local, []dtype.NodeInfo{liar}, 1)
+	status := h.GetReplicationStatus()
+	assert.Equal(t, 0, status.Repaired)
+	assert.Equal(t, 0, status.Dropped)
+	assert.Equal(t, 1, len(status.UnderReplicated))
+	_, data := db.GetObjectData(hash)
+	assert.NotNil(t, data)
+
+	// A holder storing the replica passes the new challenge and the local copy is dropped
+	hdb := dbagent.NewDBAgent(filepath.Join(dir, "holder.db"))
+	defer hdb.Close()
+	hdb.AddBlock(b)
+	hdb.RemoveObject(hash)
+	s, holder := replicaServer(&StorageMgr{db: hdb, om: NewObjMgr(hdb)}, false)
+	defer s.Close()
+	h.auditReplica(hash, &local, []dtype.NodeInfo{holder}, 1)
+	status = h.GetReplicationStatus()
+	assert.Equal(t, 1, status.Repaired)
+	assert.Equal(t, 1, status.Dropped)
+	assert.Empty(t, status.UnderReplicated)
+	_, data = db.GetObjectData(hash)
+	assert.Nil(t, data)
+}
@@ -0,0 +1,61 @@
+package storage
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/junwookheo/bcsos/blockchainnode/network"
+	"github.com/junwookheo/bcsos/common/dbagent"
+	"github.com/junwookheo/bcsos/common/dtype"
+)
+
+// RecordPoSAudit writes the result of Proof of Storage and updates the reputation of the prover
+func (h *StorageMgr) RecordPoSAudit(node *dtype.NodeInfo, blockhash string, latency time.Duration, err error) {
+	local := network.NodeInfoInst().GetLocalddr()
+
+	audit := dbagent.PoSAudit{Timestamp: time.Now().UnixNano(), Challenger: local.Hash, Prover: node.Hash, SC: node.SC,
+		BlockHash: blockhash, Result: err == nil, Latency: latency.Nanoseconds()}
+	if err != nil {
+		audit.Reason = err.Error()
+	}
+	h.db.AddPoSAudit(&audit)
+
+	reps := []dtype.Reputation{}
+	if h.db.GetReputation(node.Hash, &reps) && len(reps) == 1 {
+		network.NodeMgrInst().SetReputation(node.Hash, reps[0].Score)
+	}
+}
+
+// LoadReputation sets reputation of peers from audits kept in local storage
+func (h *StorageMgr) LoadReputation() {
+	reps := []dtype.Reputation{}
+	if !h.db.GetReputation("", &reps) {
+		return
+	}
+
+	nm := network.NodeMgrInst()
+	for _, r := range reps {
+		nm.SetReputation(r.Prover, r.Score)
+	}
+}
+
+// reputationHandler returns reputation of peers audited by the node
+// Request : none
+// Response : reputation of peers
+func (h *StorageMgr) reputationHandler(w http.ResponseWriter, r *http.Request) {
+	upgrader.CheckOrigin = func(r *http.Request) bool { return true }
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println("reputationHandler", err)
+		return
+	}
+	defer ws.Close()
+
+	reps := []dtype.Reputation{}
+	h.db.GetReputation("", &reps)
+	if err := ws.WriteJSON(reps); err != nil {
+		log.Printf("Write json error : %v", err)
+		return
+	}
+}
@@ -1,11 +1,14 @@
 package storage
 
 import (
-	"crypto/sha256"
+	"bytes"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -22,9 +25,16 @@ import (
 )
 
 type StorageMgr struct {
-	db   dbagent.DBAgent
-	om   *ObjectMgr
-	cand *datalib.CandidateBlocks
+	db      dbagent.DBAgent
+	om      *ObjectMgr
+	rm      *ReplicationMgr
+	cand    *datalib.CandidateBlocks
+	orphans *datalib.OrphanBlocks
+	mutex   sync.Mutex
+	synced  bool // initial block download is done
+
+	quota      QuotaStatus
+	quotaMutex sync.Mutex
 }
 
 var upgrader = websocket.Upgrader{
@@ -43,8 +53,8 @@ func (h *StorageMgr) Stop() {
 
 // getTransactionHandler is called when transaction query from other nodes is received
 // if the node does not have the transaction, the node will query it to other nodes with highr SC
-// Request : hash of transaction
-// Response : transaction
+// Request : ReqData of the object
+// Response : ResObject with the object
 func (h *StorageMgr) getObjectHandler(w http.ResponseWriter, r *http.Request) {
 	upgrader.CheckOrigin = func(r *http.Request) bool { return true }
 	ws, err := upgrader.Upgrade(w, r, nil)
@@ -60,17 +70,71 @@ func (h *StorageMgr) getObjectHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	res, err := h.resObject(&reqData)
+	if err != nil {
+		log.Printf("Query object error : %v", err)
+		return
+	}
+
+	ws.WriteJSON(res)
+	log.Printf("<==Query write reqData: %v", res.Data)
+}
+
+// getObjectMessage is the query of an object from peer connections
+// Request : ReqData of the object
+// Response : ResObject with the object
+func (h *StorageMgr) getObjectMessage(payload json.RawMessage) (interface{}, error) {
+	reqData := dtype.ReqData{}
+	if err := json.Unmarshal(payload, &reqData); err != nil {
+		return nil, err
+	}
+
+	res, err := h.resObject(&reqData)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("<==Query write reqData: %v", res.Data)
+
+	return res, nil
+}
+
+// resObject returns ReqData updated by the node, the object and the proof if Verify is set
+func (h *StorageMgr) resObject(reqData *dtype.ReqData) (*dtype.ResObject, error) {
+	obj, err := h.serveObject(reqData)
+	if errors.Is(err, ErrObjectNotFound) {
+		return &dtype.ResObject{Data: *reqData, NotFound: true}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	res := dtype.ResObject{Data: *reqData}
+	if res.Object, err = json.Marshal(obj); err != nil {
+		return nil, err
+	}
+	if res.Data.Verify && res.Data.ObjType == "transaction" {
+		res.Proof = *h.buildObjectProof(res.Data.ObjHash)
+	}
+
+	return &res, nil
+}
+
+// serveObject reads the object from local storage or queries it to other nodes with higher storage class
+// reqData is updated with the address of the local node and the hop, ErrObjectNotFound is returned if no node has it
+func (h *StorageMgr) serveObject(reqData *dtype.ReqData) (interface{}, error) {
 	h.db.UpdateDBNetworkQuery(1, 0, 0)
 
 	ni := network.NodeInfoInst()
 	local := ni.GetLocalddr()
 	reqData.SC = local.SC
 	var obj interface{}
+	found := true
 	if reqData.ObjType == "transaction" {
 		tr := blockchain.Transaction{}
-		if h.db.GetTransaction(reqData.ObjHash, &tr) == 0 {
-			if h.getObjectQuery(local.SC+1, &reqData, &tr) {
-				h.db.AddTransaction(&tr)
+		hit := h.db.GetTransaction(reqData.ObjHash, &tr) != 0
+		logLocalAccess(h.db, reqData.ObjType, reqData.ObjHash, hit)
+		if !hit {
+			if found = h.getObjectQuery(local.SC+1, reqData, &tr); found {
+				h.cacheTransaction(&tr)
 			}
 		} else {
 			h.db.UpdateDBNetworkQuery(0, 0, 1)
@@ -78,24 +142,127 @@ func (h *StorageMgr) getObjectHandler(w http.ResponseWriter, r *http.Request) {
 		obj = tr
 	} else if reqData.ObjType == "blockheader" {
 		bh := blockchain.BlockHeader{}
-		if h.db.GetBlockHeader(reqData.ObjHash, &bh) == 0 {
-			if h.getObjectQuery(local.SC+1, &reqData, &bh) {
-				h.db.AddBlockHeader(reqData.ObjHash, &bh)
+		hit := h.db.GetBlockHeader(reqData.ObjHash, &bh) != 0
+		logLocalAccess(h.db, reqData.ObjType, reqData.ObjHash, hit)
+		if !hit {
+			if found = h.getObjectQuery(local.SC+1, reqData, &bh); found {
+				h.cacheBlockHeader(reqData.ObjHash, &bh)
 			}
 		} else {
 			h.db.UpdateDBNetworkQuery(0, 0, 1)
 		}
 		obj = bh
 	} else {
-		log.Panicf("Not support object type")
+		return nil, fmt.Errorf("not support object type : %v", reqData.ObjType)
 	}
 
 	reqData.Addr = fmt.Sprintf("%v:%v", local.IP, local.Port)
 	reqData.Hop += 1
+	if !found {
+		return nil, fmt.Errorf("%w : %v %v", ErrObjectNotFound, reqData.ObjType, reqData.ObjHash)
+	}
+
+	return obj, nil
+}
+
+// buildObjectProof makes Merkle proof of a transaction from block-transaction matching table
+// so the transaction itself is not needed to build the proof
+func (h *StorageMgr) buildObjectProof(hash string) *dtype.ResObjectProof {
+	proof := dtype.ResObjectProof{BlockHash: "", Index: -1}
+
+	bh, idx := h.db.GetBlockHashOfObject(hash)
+	if idx < 1 {
+		return &proof
+	}
+
+	hashes := []string{}
+	if h.db.GetBlockTransactionMatching(bh, &hashes) < 2 {
+		return &proof
+	}
+
+	// hashes[0] is the header
+	var leaves [][]byte
+	for _, th := range hashes[1:] {
+		leaf, _ := hex.DecodeString(th)
+		leaves = append(leaves, leaf)
+	}
+
+	mp := blockchain.BuildMerkleProof(leaves, idx-1)
+	if mp == nil {
+		return &proof
+	}
+
+	proof.BlockHash = bh
+	proof.Index = idx - 1
+	proof.Proof = *mp
+
+	return &proof
+}
+
+// getLocalBlockHeader returns the header of block kept in local storage.
+// If the header was removed, it is queried to other nodes again, a header is verified by its hash.
+func (h *StorageMgr) getLocalBlockHeader(blockhash string) *blockchain.BlockHeader {
+	hashes := []string{}
+	if h.db.GetBlockTransactionMatching(blockhash, &hashes) == 0 {
+		return nil
+	}
+
+	bh := blockchain.BlockHeader{}
+	if h.db.GetBlockHeader(hashes[0], &bh) != 0 {
+		return &bh
+	}
+
+	ni := network.NodeInfoInst()
+	local := ni.GetLocalddr()
+	req := h.newReqData("blockheader", hashes[0])
+	if !h.getObjectQuery(local.SC, &req, &bh) {
+		return nil
+	}
+	h.cacheBlockHeader(hashes[0], &bh)
+
+	return &bh
+}
+
+// verifyObject checks the object received from other node.
+// A header is checked with its hash and a transaction is checked with Merkle proof
+// against the block header kept in local storage.
+func (h *StorageMgr) verifyObject(req *dtype.ReqData, obj interface{}, proof *dtype.ResObjectProof) error {
+	switch o := obj.(type) {
+	case *blockchain.BlockHeader:
+		if hex.EncodeToString(o.GetHash()) != req.ObjHash {
+			return fmt.Errorf("header hash not equal %v", hex.EncodeToString(o.GetHash()))
+		}
+	case *blockchain.Transaction:
+		if hex.EncodeToString(o.Hash) != req.ObjHash || !bytes.Equal(o.Hash, o.GetHash()) {
+			return fmt.Errorf("transaction hash not equal %v", hex.EncodeToString(o.Hash))
+		}
+
+		if !o.Verify() {
+			return fmt.Errorf("transaction signature error")
+		}
+
+		blockhash, idx := h.db.GetBlockHashOfObject(req.ObjHash)
+		if blockhash == "" {
+			return fmt.Errorf("no block of transaction in local")
+		}
+
+		if proof.BlockHash != blockhash || proof.Index != idx-1 {
+			return fmt.Errorf("block not matched %v(%v)", proof.BlockHash, proof.Index)
+		}
+
+		bh := h.getLocalBlockHeader(blockhash)
+		if bh == nil || hex.EncodeToString(bh.Hash) != blockhash {
+			return fmt.Errorf("no block header in local %v", blockhash)
+		}
+
+		if !blockchain.VerifyMerkleProof(bh.MerkleRoot, o.Hash, &proof.Proof) {
+			return fmt.Errorf("merkle proof error")
+		}
+	default:
+		return fmt.Errorf("not support object type")
+	}
 
-	ws.WriteJSON(reqData)
-	ws.WriteJSON(obj)
-	log.Printf("<==Query write reqData: %v", reqData)
+	return nil
 }
 
 func (h *StorageMgr) newReqData(objtype string, hash string) dtype.ReqData {
@@ -109,6 +276,7 @@ func (h *StorageMgr) newReqData(objtype string, hash string) dtype.ReqData {
 	req.Hop = 0
 	req.ObjType = objtype
 	req.ObjHash = hash
+	req.Verify = config.VERIFY_OBJECT_QUERY
 
 	return req
 }
@@ -116,71 +284,110 @@ func (h *StorageMgr) newReqData(objtype string, hash string) dtype.ReqData {
 // getTransactionQuery queries a transaction ot other nodes with highr Storage Class
 // Request : hash of transaction
 // Response : transaction
+// If reqData.Verify is set, the object is verified and the next node is queried on failure
 func (h *StorageMgr) getObjectQuery(startSC int, reqData *dtype.ReqData, obj interface{}) bool {
-	queryObject := func(ip string, port int, reqData *dtype.ReqData, obj interface{}) bool {
-		url := fmt.Sprintf("ws://%v:%v/getobject", ip, port)
-		//log.Printf("getTransactionQuery : %v", url)
-
-		ws, _, err := websocket.DefaultDialer.Dial(url, nil)
-		if err != nil {
-			log.Printf("getTransactionQuery Dial error : %v", err)
-			return false
-		}
-		defer ws.Close()
-
-		if err := ws.WriteJSON(*reqData); err != nil {
-			log.Printf("Write json error : %v", err)
-			return false
-		}
+	req := *reqData
 
-		if err := ws.ReadJSON(reqData); err != nil {
-			log.Printf("Read json error : %v", err)
-			return false
-		}
-		if err := ws.ReadJSON(obj); err != nil {
-			log.Printf("Read json error : %v", err)
-			return false
-		}
+	// the number of query to other nodes
+	defer h.db.UpdateDBNetworkQuery(0, 1, 1)
 
-		ni := network.NodeInfoInst()
-		local := ni.GetLocalddr()
+	ni := network.NodeInfoInst()
+	local := ni.GetLocalddr()
+	nm := network.NodeMgrInst()
 
+	// Nodes queried by this node, relays of the node served are added from the hop of the response
+	messages := 0
+	found := func(r *queryResult) bool {
+		*reqData = r.res
 		hop := reqData.SC - local.SC
-		h.db.UpdateDBNetworkDelay(int(time.Now().UnixNano()-reqData.Timestamp), hop)
-		log.Printf("==>Query read reqData: %v[hop], %v", hop, reqData)
+		h.db.UpdateDBNetworkDelay(int(r.elapsed.Nanoseconds()), hop)
+		log.Printf("==>Query read reqData: %v[hop], %v from %v:%v in %v", hop, reqData, r.node.IP, r.node.Port, r.elapsed)
+		h.logRemoteAccess(&req, reqData, true, messages+reqData.Hop-1, r)
 		return true
 	}
 
-	// the number of query to other nodes
-	defer h.db.UpdateDBNetworkQuery(0, 1, 1)
+	if config.ConfigInst().ContentRouting {
+		providers, queried := nm.FindValue(req.ObjHash)
+		messages += queried
+		// Providers in lower storage classes are queried first like the walk
+		sort.SliceStable(providers, func(i, j int) bool { return providers[i].Node.SC < providers[j].Node.SC })
+		nodes := []dtype.NodeInfo{}
+		for _, p := range providers {
+			nodes = append(nodes, p.Node)
+		}
 
-	ni := network.NodeInfoInst()
-	local := ni.GetLocalddr()
-	nm := network.NodeMgrInst()
+		r, sent := h.fanOut(nodes, &req, obj)
+		messages += sent
+		if r != nil {
+			return found(r)
+		}
+	}
 
-	for i := startSC; i < config.MAX_SC; i++ {
-		var nodes [config.MAX_SC_PEER]dtype.NodeInfo
-		if nm.GetSCNNodeListbyDistance(i, reqData.ObjHash, &nodes) {
-			for _, node := range nodes {
-				if node.IP == "" {
-					continue
-				}
-				if node.Hash == local.Hash { // If the node is itself, skip
-					continue
-				}
+	for i := startSC; i < config.ConfigInst().NumSC; i++ {
+		var peers [config.MAX_SC_PEER]dtype.NodeInfo
+		if !nm.GetSCNNodeListbyDistance(i, reqData.ObjHash, &peers) {
+			continue
+		}
 
-				if queryObject(node.IP, node.Port, reqData, obj) {
-					return true
-				}
-				//time.Sleep(time.Duration(200 * time.Microsecond.Seconds()))
-				log.Printf("queryObject fail : query other nodes")
+		nodes := []dtype.NodeInfo{}
+		for _, node := range peers {
+			if node.IP == "" || node.Hash == local.Hash { // If the node is itself, skip
+				continue
 			}
+			nodes = append(nodes, node)
+		}
+
+		r, sent := h.fanOut(nodes, &req, obj)
+		messages += sent
+		if r != nil {
+			return found(r)
+		}
+	}
+
+	// Transactions in the highest storage class can be kept only in shards
+	if config.ConfigInst().ErasureCoding && req.ObjType == "transaction" {
+		if tr, ok := obj.(*blockchain.Transaction); ok && h.reconstructTransaction(req.ObjHash, tr) {
+			reqData.SC = config.ConfigInst().NumSC - 1
+			h.logRemoteAccess(&req, reqData, true, messages, nil)
+			return true
 		}
 	}
 
+	h.logRemoteAccess(&req, reqData, false, messages, nil)
 	return false
 }
 
+// logLocalAccess writes a read of local storage for a query, internal reads are not logged
+func logLocalAccess(db dbagent.DBAgent, objtype string, hash string, hit bool) {
+	sc := network.NodeInfoInst().GetLocalddr().SC
+	if !hit {
+		sc = -1
+	}
+	db.AddAccessLog(&dbagent.AccessLog{Timestamp: time.Now().UnixNano(), Hash: hash, Type: objtype, Hit: hit, SC: sc})
+}
+
+// logRemoteAccess writes the result of the query to other nodes after a local miss
+// req is the request sent and res is the one returned by the peer, r is the answer of the peer if it answered
+func (h *StorageMgr) logRemoteAccess(req *dtype.ReqData, res *dtype.ReqData, found bool, messages int, r *queryResult) {
+	ni := network.NodeInfoInst()
+	local := ni.GetLocalddr()
+
+	l := dbagent.AccessLog{Timestamp: time.Now().UnixNano(), Hash: req.ObjHash, Type: req.ObjType,
+		Hit: found, Remote: true, SC: -1, Hop: 0, Requester: req.Addr, Routing: config.ROUTING_WALK, Messages: messages}
+	if config.ConfigInst().ContentRouting {
+		l.Routing = config.ROUTING_PROVIDER
+	}
+	if found {
+		l.SC = res.SC
+		l.Hop = res.SC - local.SC
+	}
+	if r != nil {
+		l.Peer = r.node.Hash
+		l.Latency = r.elapsed.Nanoseconds()
+	}
+	h.db.AddAccessLog(&l)
+}
+
 type Test struct {
 	Start bool `json:"start"`
 }
@@ -208,7 +415,7 @@ func (h *StorageMgr) statusInfo(ws *websocket.Conn, w http.ResponseWriter, r *ht
 				return
 			case <-ticker.C:
 				//var status dbagent.DBStatus
-				status := h.db.GetDBStatus()
+				status := nodeStatus{h.db.GetDBStatus(), h.GetQuotaStatus(), network.GossipInst().Status()}
 				if err := ws.WriteJSON(status); err != nil {
 					log.Printf("Write json error : %v", err)
 					return
@@ -235,7 +442,7 @@ func (h *StorageMgr) ObjectbyAccessPattern() {
 	hashes := []dbagent.RemoverbleObj{}
 	ret := false
 
-	if config.ACCESS_FREQUENCY_PATTERN == config.RANDOM_ACCESS_PATTERN {
+	if config.ConfigInst().AccessFrequencyPattern == config.RANDOM_ACCESS_PATTERN {
 		ret = h.om.AccessWithUniform(config.NUM_AP_GEN, &hashes)
 	} else {
 		ret = h.om.AccessWithExponential(config.NUM_AP_GEN, &hashes)
@@ -250,18 +457,18 @@ func (h *StorageMgr) ObjectbyAccessPattern() {
 				bh := blockchain.BlockHeader{}
 				req := h.newReqData("blockheader", hash.Hash)
 				if h.getObjectQuery(local.SC, &req, &bh) {
-					h.db.AddBlockHeader(hash.Hash, &bh)
+					h.cacheBlockHeader(hash.Hash, &bh)
 					if hash.Hash != hex.EncodeToString(bh.GetHash()) {
-						log.Panicf("%v header Hash not equal %v", hash.Hash, hex.EncodeToString(bh.GetHash()))
+						log.Printf("%v header Hash not equal %v", hash.Hash, hex.EncodeToString(bh.GetHash()))
 					}
 				}
 			} else {
 				tr := blockchain.Transaction{}
 				req := h.newReqData("transaction", hash.Hash)
 				if h.getObjectQuery(local.SC, &req, &tr) {
-					h.db.AddTransaction(&tr)
+					h.cacheTransaction(&tr)
 					if hash.Hash != hex.EncodeToString(tr.Hash) {
-						log.Panicf("%v Tr Hash not equal %v", hash.Hash, hex.EncodeToString(tr.Hash))
+						log.Printf("%v Tr Hash not equal %v", hash.Hash, hex.EncodeToString(tr.Hash))
 					}
 				}
 			}
@@ -278,59 +485,123 @@ func (h *StorageMgr) RemoveNoAccessObjects() {
 	ni := network.NodeInfoInst()
 	local := ni.GetLocalddr()
 
-	if local.SC < config.MAX_SC-1 {
-		h.om.DeleteNoAccedObjects()
+	if local.SC < config.ConfigInst().NumSC-1 {
+		h.om.EvictObjects()
 	}
 }
 
-// proofStorageHandler handles the request of Proof of Storage
-// Request : Hash of block and timestamp
-// Response : Merkel root of transactions to be proven
-func (h *StorageMgr) proofStorageHandler(w http.ResponseWriter, r *http.Request) {
-	upgrader.CheckOrigin = func(r *http.Request) bool { return true }
-	ws, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		log.Println("proofStorageHandler", err)
-		return
+// proofStorageMessage is the request of Proof of Storage from peer connections
+func (h *StorageMgr) proofStorageMessage(payload json.RawMessage) (interface{}, error) {
+	var pos dtype.ReqPoStorage
+	if err := json.Unmarshal(payload, &pos); err != nil {
+		return nil, err
 	}
-	defer ws.Close()
 
-	var pos dtype.ReqPoStorage
-	if err := ws.ReadJSON(&pos); err != nil {
-		log.Printf("Read json error : %v", err)
-		return
+	return h.ProofStorageProc(&pos, network.NodeInfoInst().GetLocalddr()), nil
+}
+
+// ProofStorageProc makes the proof of transactions selected by the challenge and the address of node
+func (h *StorageMgr) ProofStorageProc(pos *dtype.ReqPoStorage, node *dtype.NodeInfo) *dtype.ResPoStorage {
+	proof := dtype.ResPoStorage{Addr: node.Hash, SC: node.SC, Leaves: []dtype.PoSLeaf{}}
+
+	baddr, _ := hex.DecodeString(node.Hash)
+	bhash, _ := hex.DecodeString(pos.Hash)
+
+	hashes := []string{}
+	if h.db.GetBlockTransactionMatching(pos.Hash, &hashes) < 2 {
+		return &proof
 	}
 
-	ni := network.NodeInfoInst()
-	local := ni.GetLocalddr()
-	proof := h.ProofStorageProc(&pos, local)
+	indices := blockchain.PoSIndices(bhash, baddr, pos.Timestamp, len(hashes)-1, pos.Num)
+	proof.NumTx = h.db.ProofStorage(pos.Hash, indices, &proof.Leaves)
+	if proof.NumTx != 0 || !isErasureCoding() {
+		return &proof
+	}
 
-	if err := ws.WriteJSON(proof); err != nil {
-		log.Printf("Write json error : %v", err)
-		return
+	// Transactions are kept in shards
+	b, err := h.reconstructBlock(pos.Hash)
+	if err != nil || len(b.Transactions) != len(hashes)-1 {
+		return &proof
+	}
+
+	var leaves [][]byte
+	for _, t := range b.Transactions {
+		leaves = append(leaves, t.Hash)
+	}
+	proof.Leaves = []dtype.PoSLeaf{}
+	for _, idx := range indices {
+		proof.Leaves = append(proof.Leaves, dtype.PoSLeaf{Index: idx, Transaction: *b.Transactions[idx], Proof: *blockchain.BuildMerkleProof(leaves, idx)})
 	}
+	proof.NumTx = len(leaves)
+
+	return &proof
 }
 
-func (h *StorageMgr) ProofStorageProc(pos *dtype.ReqPoStorage, node *dtype.NodeInfo) *dtype.ResPoStorage {
-	proof := dtype.ResPoStorage{}
+// VerifyProofStorage checks the proof with the block header kept in local storage
+func (h *StorageMgr) VerifyProofStorage(pos *dtype.ReqPoStorage, node *dtype.NodeInfo, proof *dtype.ResPoStorage) error {
+	bh := h.getLocalBlockHeader(pos.Hash)
+	if bh == nil || hex.EncodeToString(bh.Hash) != pos.Hash {
+		return fmt.Errorf("no block header in local %v", pos.Hash)
+	}
+
+	if proof.NumTx == 0 {
+		return fmt.Errorf("block not stored %v", pos.Hash)
+	}
 
-	proof.Addr = node.Hash
-	proof.SC = node.SC
+	// The merkle tree duplicates the last leaf, so the number of transactions of the prover cannot be trusted
+	hashes := []string{}
+	numtx := h.db.GetBlockTransactionMatching(pos.Hash, &hashes) - 1
+	if proof.NumTx != numtx {
+		return fmt.Errorf("the number of transactions not matched %v(%v)", proof.NumTx, numtx)
+	}
 
 	baddr, _ := hex.DecodeString(node.Hash)
-	bhash, _ := hex.DecodeString(pos.Hash)
-	tidx := sha256.Sum256(append(bhash, baddr...))
+	indices := blockchain.PoSIndices(bh.Hash, baddr, pos.Timestamp, numtx, pos.Num)
+	if len(indices) != len(proof.Leaves) {
+		return fmt.Errorf("the number of leaves not matched %v(%v)", len(proof.Leaves), len(indices))
+	}
 
-	// log.Printf("RIDX : %v, sc : %v", tidx, node.SC)
+	for i, idx := range indices {
+		leaf := proof.Leaves[i]
+		if leaf.Index != idx || !blockchain.VerifyPoSLeaf(bh.MerkleRoot, numtx, idx, &leaf.Transaction, &leaf.Proof) {
+			return fmt.Errorf("merkle proof error at %v", idx)
+		}
+	}
 
-	merkle := h.db.ProofStorage(tidx, pos.Timestamp, node.SC)
-	if merkle == nil {
-		proof.Proof = ""
-	} else {
-		proof.Proof = hex.EncodeToString(merkle)
+	return nil
+}
+
+// ChallengeBlock selects a block which the storage class should keep from the seed
+// A block is kept in lower storage classes within TSCX after it is finalised
+func (h *StorageMgr) ChallengeBlock(seed []byte, sc int) *blockchain.BlockHeader {
+	c := config.ConfigInst()
+	hash, height := h.db.GetLatestBlockHash()
+	if hash == "" || height < 0 {
+		return nil
 	}
 
-	return &proof
+	span := height + 1
+	if tsc := int(c.TSC(sc)); tsc != 0 {
+		span = tsc/c.BlockCreatePeriod - c.Finality
+	}
+	if span > height+1 {
+		span = height + 1
+	}
+	if span < 1 {
+		span = 1
+	}
+
+	var n uint64
+	for _, b := range seed {
+		n = n<<8 | uint64(b)
+	}
+
+	bh := h.getLocalBlockHeader(hash)
+	for back := int(n % uint64(span)); bh != nil && 0 < back && len(bh.PrvHash) != 0; back-- {
+		bh = h.getLocalBlockHeader(hex.EncodeToString(bh.PrvHash))
+	}
+
+	return bh
 }
 
 func (h *StorageMgr) ObjectbyAccessPatternProc() {
@@ -340,6 +611,7 @@ func (h *StorageMgr) ObjectbyAccessPatternProc() {
 
 	go func(command <-chan string) {
 		var status = "Pause"
+		provided := time.Now()
 		for {
 			select {
 			case cmd := <-command:
@@ -355,6 +627,10 @@ func (h *StorageMgr) ObjectbyAccessPatternProc() {
 				}
 			default:
 				if status == "Running" {
+					if time.Duration(config.PROVIDER_REPUBLISH)*time.Second <= time.Since(provided) {
+						h.provideObjects()
+						provided = time.Now()
+					}
 					ni := network.NodeInfoInst()
 					local := ni.GetLocalddr()
 					if strings.ToUpper(local.Mode) == "MI" {
@@ -363,7 +639,7 @@ func (h *StorageMgr) ObjectbyAccessPatternProc() {
 						time.Sleep(time.Duration(config.TIME_AP_GEN) * time.Second)
 					} else {
 						h.RemoveNoAccessObjects()
-						time.Sleep(time.Duration(config.BLOCK_CREATE_PERIOD*2) * time.Second)
+						time.Sleep(time.Duration(config.ConfigInst().BlockCreatePeriod*2) * time.Second)
 						// log.Printf("Mode : %v", local.Mode)
 					}
 				} else {
@@ -375,12 +651,163 @@ func (h *StorageMgr) ObjectbyAccessPatternProc() {
 	}(command)
 }
 
+// ProcessBlock validates a received block and adds it to the candidate blocks.
+// A block with unknown parent is kept in the orphan pool and ErrUnknownParent is returned.
+// Return the block and the orphans connected by it
+func (h *StorageMgr) ProcessBlock(b *blockchain.Block) ([]*blockchain.Block, error) {
+	if err := h.cand.Validate(b); err != nil {
+		// Orphan older than candidate blocks can not be connected
+		if errors.Is(err, blockchain.ErrUnknownParent) {
+			if b.Header.Height-1 < h.cand.GetLowestHeight() || !h.orphans.Add(b) {
+				return nil, fmt.Errorf("orphan block is not kept")
+			}
+		}
+		return nil, err
+	}
+
+	var accepted []*blockchain.Block
+	blocks := []*blockchain.Block{b}
+	for len(blocks) > 0 {
+		block := blocks[0]
+		blocks = blocks[1:]
+		if !h.cand.PushAndSave(block, h) {
+			continue
+		}
+		accepted = append(accepted, block)
+
+		for _, child := range h.orphans.PopChildren(block.Header.Hash) {
+			if err := h.cand.Validate(child); err != nil {
+				log.Printf("Reject orphan block(%v) %v : %v", child.Header.Height, hex.EncodeToString(child.Header.Hash), err)
+				continue
+			}
+			log.Printf("Connect orphan block(%v) : %v", child.Header.Height, hex.EncodeToString(child.Header.Hash))
+			blocks = append(blocks, child)
+		}
+	}
+
+	return accepted, nil
+}
+
+// getBlockMessage is called when other node requests a block to connect its orphan blocks
+// Request : hash of block, empty hash for the head of the heaviest chain
+// Response : block, ErrObjectNotFound if the node does not have whole block
+func (h *StorageMgr) getBlockMessage(payload json.RawMessage) (interface{}, error) {
+	var req dtype.ReqBlock
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return nil, err
+	}
+
+	if req.Hash == "" {
+		_, req.Hash = h.cand.GetHighestBlockHash()
+	}
+
+	b := h.GetLocalBlock(req.Hash)
+	if b == nil {
+		return nil, fmt.Errorf("%w : block %v", ErrObjectNotFound, req.Hash)
+	}
+
+	return b, nil
+}
+
+// GetLocalBlock returns the block with all transactions from local storage, nil if it is not kept
+func (h *StorageMgr) GetLocalBlock(hash string) *blockchain.Block {
+	bhash, _ := hex.DecodeString(hash)
+	if b := h.cand.GetBlock(bhash); b != nil {
+		return b
+	}
+
+	block := blockchain.Block{}
+	if h.db.GetBlock(hash, &block) != 0 {
+		// Transactions removed from local storage can not be sent
+		for _, tr := range block.Transactions {
+			if len(tr.Hash) == 0 {
+				block = blockchain.Block{}
+				break
+			}
+		}
+
+		// Transactions encoded into shards are reconstructed
+		if len(block.Header.Hash) == 0 && isErasureCoding() {
+			b, err := h.reconstructBlock(hash)
+			if err == nil {
+				return b
+			}
+			log.Printf("Reconstruct block error : %v", err)
+		}
+	}
+
+	if len(block.Header.Hash) == 0 {
+		return nil
+	}
+
+	return &block
+}
+
+// RequestBlock queries a block to other nodes from the highest storage class
+// Request : hash of block
+// Response : block
+func (h *StorageMgr) RequestBlock(hash string) *blockchain.Block {
+	ni := network.NodeInfoInst()
+	local := ni.GetLocalddr()
+	nm := network.NodeMgrInst()
+
+	for i := config.ConfigInst().NumSC - 1; 0 <= i; i-- {
+		var nodes [config.MAX_SC_PEER]dtype.NodeInfo
+		if nm.GetSCNNodeListbyDistance(i, hash, &nodes) {
+			for _, node := range nodes {
+				if node.IP == "" || node.Hash == local.Hash {
+					continue
+				}
+
+				if b := queryBlock(&node, hash); b != nil {
+					return b
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// queryBlock requests a block to the node, empty hash for the head of its heaviest chain
+func queryBlock(node *dtype.NodeInfo, hash string) *blockchain.Block {
+	block := blockchain.Block{}
+	if err := network.PeerMgrInst().Request(node, network.MSG_GET_BLOCK, dtype.ReqBlock{Hash: hash}, &block); err != nil {
+		log.Printf("RequestBlock error : %v", err)
+		return nil
+	}
+
+	if hash != "" && hex.EncodeToString(block.Header.Hash) != hash {
+		return nil
+	}
+
+	if err := blockchain.ValidateBlockBody(&block); err != nil {
+		nm := network.NodeMgrInst()
+		nm.ReportMisbehavior(node, fmt.Sprintf("block %v %v", hash, err))
+		return nil
+	}
+
+	return &block
+}
+
+func (h *StorageMgr) GetInvalidBlocks() int {
+	return h.cand.GetInvalidBlocks()
+}
+
 func (h *StorageMgr) AddNewBlock(b *blockchain.Block) {
 	// log.Printf("Rcv new block(%v) : %v-%v", b.Header.Height, hex.EncodeToString(b.Header.Hash), hex.EncodeToString(b.Header.PrvHash))
-	h.cand.PushAndSave(b, h.db)
+	h.cand.PushAndSave(b, h)
 	// h.cand.ShowAll()
 }
 
+func (h *StorageMgr) AddReorgListener(ch chan *datalib.Reorg) {
+	h.cand.AddReorgListener(ch)
+}
+
+func (h *StorageMgr) NextDifficulty(hash []byte) int {
+	return h.cand.NextDifficulty(hash)
+}
+
 func (h *StorageMgr) GetHighestBlockHash() (int, string) {
 	return h.cand.GetHighestBlockHash()
 }
@@ -392,7 +819,20 @@ func (h *StorageMgr) GetLatestBlockHash() (string, int) {
 func (sm *StorageMgr) SetHttpRouter(m *mux.Router) {
 	m.HandleFunc("/getobject", sm.getObjectHandler)
 	m.HandleFunc("/statusinfo", sm.statusInfoHandler)
-	m.HandleFunc("/proofstorage", sm.proofStorageHandler)
+	m.HandleFunc("/objectstats", sm.objectStatsHandler)
+	m.HandleFunc("/replicationstatus", sm.replicationStatusHandler)
+	m.HandleFunc("/reputation", sm.reputationHandler)
+
+	// Messages between nodes
+	p := network.PeerMgrInst()
+	p.Handle(network.MSG_GET_OBJECT, sm.getObjectMessage)
+	p.Handle(network.MSG_PROOF_STORE, sm.proofStorageMessage)
+	p.Handle(network.MSG_GET_BLOCK, sm.getBlockMessage)
+	p.Handle(network.MSG_GET_HEADERS, sm.getHeadersMessage)
+	p.Handle(network.MSG_PUT_SHARD, sm.putShardMessage)
+	p.Handle(network.MSG_GET_SHARD, sm.getShardMessage)
+	p.Handle(network.MSG_AUDIT, sm.auditReplicaMessage)
+	p.Handle(network.MSG_PUT_REPLICA, sm.putReplicaMessage)
 }
 
 func StorageMgrInst(db_path string) *StorageMgr {
@@ -402,9 +842,12 @@ func StorageMgrInst(db_path string) *StorageMgr {
 
 	once.Do(func() {
 		sm = &StorageMgr{
-			db:   dbagent.NewDBAgent(db_path),
-			om:   nil,
-			cand: datalib.NewCandidateBlocks(),
+			db:      dbagent.NewDBAgent(db_path),
+			om:      nil,
+			rm:      NewReplicationMgr(),
+			cand:    datalib.NewCandidateBlocks(),
+			orphans: datalib.NewOrphanBlocks(0),
+			synced:  false,
 		}
 		sm.om = NewObjMgr(sm.db)
 	})
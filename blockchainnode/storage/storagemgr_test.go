@@ -3,13 +3,17 @@ package storage
 import (
 	"database/sql"
 	"encoding/hex"
+	"fmt"
 	"log"
+	"os"
 	"testing"
 
 	"github.com/junwookheo/bcsos/blockchainnode/network"
 	"github.com/junwookheo/bcsos/common/blockchain"
+	"github.com/junwookheo/bcsos/common/dbagent"
 	"github.com/junwookheo/bcsos/common/dtype"
 	"github.com/junwookheo/bcsos/common/serial"
+	"github.com/junwookheo/bcsos/common/wallet"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -51,6 +55,138 @@ func TestBlockchainConsistency(t *testing.T) {
 	}
 }
 
+func TestVerifyObject(t *testing.T) {
+	path := "./verify_test.db"
+	wallet_path := "./wallet_test.wallet"
+	defer os.Remove(path)
+	defer os.Remove(wallet_path)
+
+	w := wallet.NewWallet(wallet_path)
+	h := StorageMgr{db: dbagent.NewDBAgent(path)}
+	defer h.db.Close()
+
+	var trs []*blockchain.Transaction
+	for _, s := range []string{"1111111111", "2222222222", "3333333333"} {
+		trs = append(trs, blockchain.CreateTransaction(w, []byte(s)))
+	}
+	b := blockchain.CreateBlock(trs, nil, 0)
+	h.db.AddBlock(b)
+
+	tr := *trs[2]
+	req := dtype.ReqData{ObjType: "transaction", ObjHash: hex.EncodeToString(tr.Hash), Verify: true}
+	proof := h.buildObjectProof(req.ObjHash)
+	assert.Equal(t, hex.EncodeToString(b.Header.Hash), proof.BlockHash)
+	assert.Nil(t, h.verifyObject(&req, &tr, proof))
+
+	// Fake data with a valid signature is not in the block
+	fake := blockchain.CreateTransaction(w, []byte("4444444444"))
+	req.ObjHash = hex.EncodeToString(fake.Hash)
+	assert.NotNil(t, h.verifyObject(&req, fake, proof))
+
+	req.ObjHash = hex.EncodeToString(tr.Hash)
+	tr.Data = []byte("fake")
+	assert.NotNil(t, h.verifyObject(&req, &tr, proof))
+}
+
+func TestSyncHeaders(t *testing.T) {
+	path := "./sync_test.db"
+	wallet_path := "./wallet_test.wallet"
+	defer os.Remove(path)
+	defer os.Remove(wallet_path)
+
+	w := wallet.NewWallet(wallet_path)
+	h := StorageMgr{db: dbagent.NewDBAgent(path)}
+	defer h.db.Close()
+
+	var prv *blockchain.Block
+	for i := 0; i < 5; i++ {
+		trs := []*blockchain.Transaction{blockchain.CreateTransaction(w, []byte(fmt.Sprintf("tr-%v", i)))}
+		if prv == nil {
+			prv = blockchain.CreateBlock(trs, nil, 0)
+		} else {
+			prv = blockchain.CreateBlock(trs, prv.Header.Hash, prv.Header.Height+1)
+		}
+		h.db.AddBlock(prv)
+	}
+
+	res := h.getHeaders("", 3)
+	assert.Equal(t, 3, len(res.Headers))
+	assert.Equal(t, prv.Header.Hash, res.Headers[0].Hash)
+	assert.Equal(t, 2, res.Headers[2].Height)
+
+	res = h.getHeaders("", 10)
+	assert.Equal(t, 5, len(res.Headers))
+
+	// Ascending order from the genesis
+	var headers []blockchain.BlockHeader
+	var trhashes [][]string
+	for i := range res.Headers {
+		headers = append([]blockchain.BlockHeader{res.Headers[i]}, headers...)
+		trhashes = append([][]string{res.TrHashes[i]}, trhashes...)
+	}
+	assert.Nil(t, h.validateHeaders(headers, trhashes, "", -1))
+	assert.Nil(t, h.validateHeaders(headers[2:], trhashes[2:], hex.EncodeToString(headers[1].Hash), 1))
+
+	trhashes[3] = trhashes[2]
+	assert.NotNil(t, h.validateHeaders(headers, trhashes, "", -1))
+}
+
+func TestVerifyProofStorage(t *testing.T) {
+	path := "./pos_test.db"
+	wallet_path := "./wallet_test.wallet"
+	defer os.Remove(path)
+	defer os.Remove(wallet_path)
+
+	w := wallet.NewWallet(wallet_path)
+	h := StorageMgr{db: dbagent.NewDBAgent(path)}
+	defer h.db.Close()
+
+	var trs []*blockchain.Transaction
+	for i := 0; i < 7; i++ {
+		trs = append(trs, blockchain.CreateTransaction(w, []byte(fmt.Sprintf("pos-%v", i))))
+	}
+	b := blockchain.CreateBlock(trs, nil, 0)
+	h.db.AddBlock(b)
+
+	node := dtype.NodeInfo{SC: 0, Hash: hex.EncodeToString(w.PublicKey)}
+	req := dtype.ReqPoStorage{Hash: hex.EncodeToString(b.Header.Hash), Timestamp: 1, Num: 3}
+	proof := h.ProofStorageProc(&req, &node)
+	assert.Equal(t, len(trs), proof.NumTx)
+	assert.Equal(t, 3, len(proof.Leaves))
+	assert.Nil(t, h.VerifyProofStorage(&req, &node, proof))
+
+	// Leaves are selected by the address of the prover
+	other := dtype.NodeInfo{SC: 0, Hash: hex.EncodeToString(b.Header.Hash)}
+	assert.NotNil(t, h.VerifyProofStorage(&req, &other, proof))
+
+	proof.Leaves[1].Transaction.Data = []byte("fake")
+	assert.NotNil(t, h.VerifyProofStorage(&req, &node, proof))
+
+	// The duplicated last leaf gives the same merkle root with one more transaction
+	var leaves [][]byte
+	for _, tr := range trs {
+		leaves = append(leaves, tr.Hash)
+	}
+	leaves = append(leaves, trs[len(trs)-1].Hash)
+	forged := dtype.ResPoStorage{Addr: node.Hash, SC: node.SC, NumTx: len(leaves)}
+	for _, idx := range blockchain.PoSIndices(b.Header.Hash, w.PublicKey, req.Timestamp, len(leaves), req.Num) {
+		tr := trs[len(trs)-1]
+		if idx < len(trs) {
+			tr = trs[idx]
+		}
+		forged.Leaves = append(forged.Leaves, dtype.PoSLeaf{Index: idx, Transaction: *tr, Proof: *blockchain.BuildMerkleProof(leaves, idx)})
+	}
+	assert.NotNil(t, h.VerifyProofStorage(&req, &node, &forged))
+
+	// A block not stored is a failure, not a crash
+	h.db.RemoveObject(hex.EncodeToString(trs[proof.Leaves[0].Index].Hash))
+	proof = h.ProofStorageProc(&req, &node)
+	assert.Equal(t, 0, proof.NumTx)
+	assert.NotNil(t, h.VerifyProofStorage(&req, &node, proof))
+
+	assert.NotNil(t, h.ChallengeBlock([]byte{1, 2, 3}, 0))
+}
+
 func TestProofStorage(t *testing.T) {
 	sm := StorageMgrInst("../db_nodes/7001.db")
 	req := dtype.ReqPoStorage{}
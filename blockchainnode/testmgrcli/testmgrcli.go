@@ -12,6 +12,7 @@ import (
 	"github.com/gorilla/websocket"
 	"github.com/grandcat/zeroconf"
 	"github.com/junwookheo/bcsos/blockchainnode/network"
+	"github.com/junwookheo/bcsos/common/config"
 	"github.com/junwookheo/bcsos/common/dtype"
 )
 
@@ -55,15 +56,40 @@ func (t *TestMgrCli) registerNode(ip string, port int) {
 	}
 
 	var node dtype.NodeInfo
+	if err := ws.ReadJSON(&node); err != nil {
+		log.Printf("Read json error : %v", err)
+		return
+	}
+
+	ni.SetLocalddrIP(node.IP)
+	log.Printf("Got response: %v\n", local)
+	log.Printf("Recevied node : %v", node)
+
+	// The config of the simulator overrides the local config
+	cfg := config.Config{}
+	if err := ws.ReadJSON(&cfg); err != nil {
+		log.Printf("Read json error : %v", err)
+		return
+	}
+
+	if err := config.SetConfig(&cfg); err != nil {
+		log.Printf("Config from simulator error : %v", err)
+	} else {
+		log.Printf("Config from simulator : %v", config.ConfigInst())
+	}
+
+	// The local information is signed again with the IP address
+	if err := ws.WriteJSON(local); err != nil {
+		log.Printf("Write json error : %v", err)
+		return
+	}
+
+	// Keep the connection until the simulator is closed
 	for {
 		if err := ws.ReadJSON(&node); err != nil {
 			log.Printf("Read json error : %v", err)
 			return
 		}
-
-		ni.SetLocalddrIP(node.IP)
-		log.Printf("Got response: %v\n", local)
-		log.Printf("Recevied node : %v", node)
 	}
 }
 
@@ -10,6 +10,7 @@ import (
 
 	"github.com/grandcat/zeroconf"
 	"github.com/junwookheo/bcsos/blockchainsim/testmgrsrv"
+	"github.com/junwookheo/bcsos/common/config"
 )
 
 const DB_PATH = "./bc_sim.db"
@@ -19,18 +20,23 @@ func init() {
 	log.SetFlags(log.LstdFlags | log.Lmicroseconds | log.Lshortfile)
 }
 
-func flagParse() (string, string) {
+func flagParse() (string, string, string) {
 	pmode := flag.String("mode", "ST", "ST: Test storage (Server generates tr and ap object), MI: Test Miner(generate tr and access object in local)")
 	ip := flag.String("ip", "", "IP for simulation server")
 	iface := flag.String("iface", "", "IP Interface for simulation server, 'eth0', 'wi-fi'")
+	consensus := flag.String("consensus", "POW", "POW: Proof of Work, POA: round-robin Proof of Authority")
+	config.AddFlags()
 	flag.Parse()
+	if err := config.LoadFlags(); err != nil {
+		log.Panicf("Config error : %v", err)
+	}
 
 	log.Printf("=== ip : %v", *ip)
 	if *ip == "" && *iface != "" {
 		*ip = localAddresses(iface)
 	}
 	log.Printf("=== ip : %v", *ip)
-	return *pmode, *ip
+	return *pmode, *ip, strings.ToUpper(*consensus)
 }
 
 func localAddresses(target *string) string {
@@ -68,8 +74,9 @@ func main() {
 	signal.Notify(interrupt, os.Interrupt)
 	defer signal.Reset()
 
-	mode, ip := flagParse()
+	mode, ip, consensus := flagParse()
 	s := testmgrsrv.NewHandler(mode, DB_PATH)
+	s.SetConsensus(consensus)
 	go s.StartService(PORT)
 	//go bcdummy.Start()
 
@@ -72,7 +72,7 @@ func genRandString() string {
 func LoadRawdataFromRandom(msg chan string) {
 	rand.Seed(time.Now().UnixNano())
 
-	for i := 0; i < config.TOTAL_TRANSACTIONS; i++ {
+	for i := 0; i < config.ConfigInst().TotalTransactions; i++ {
 		sensordata := SensorData{Id: i, Timestamp: time.Now().UnixNano(), Temperature: (rand.Float64()*80. - 30.), Condition: genRandString()}
 		jstr, err := json.Marshal(&sensordata)
 		if err != nil {
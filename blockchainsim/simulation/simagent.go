@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"math/big"
 	"math/rand"
 	"time"
 
@@ -46,15 +47,23 @@ func (h *Handler) getObjectQuery(reqData *dtype.ReqData, obj interface{}) bool {
 			return false
 		}
 
-		if err := ws.ReadJSON(reqData); err != nil {
+		// The node answers ReqData updated by nodes and the object in one response
+		res := dtype.ResObject{}
+		if err := ws.ReadJSON(&res); err != nil {
 			log.Printf("Read json error : %v", err)
 			return false
 		}
 
-		if err := ws.ReadJSON(obj); err != nil {
-			log.Printf("Read json error : %v", err)
+		if res.NotFound {
+			log.Printf("Object not found : %v", reqData.ObjHash)
+			return false
+		}
+
+		if err := json.Unmarshal(res.Object, obj); err != nil {
+			log.Printf("Unmarshal object error : %v", err)
 			return false
 		}
+		*reqData = res.Data
 
 		hop := reqData.SC
 		h.db.UpdateDBNetworkDelay(int(time.Now().UnixNano()-reqData.Timestamp), hop)
@@ -65,19 +74,13 @@ func (h *Handler) getObjectQuery(reqData *dtype.ReqData, obj interface{}) bool {
 	// the number of query to other nodes
 	defer h.db.UpdateDBNetworkQuery(0, 1, 1)
 
-	// var maxdist big.Int
-	var maxdist uint64
+	maxdist := new(big.Int)
 	var tnode dtype.NodeInfo
 
 	for _, node := range *h.Nodes {
 		if node.SC == 0 {
-			// dist := wallet.DistanceXor(reqData.ObjHash, node.Hash)
-			// if maxdist.Cmp(dist) == -1 {
-			// 	maxdist = *dist
-			// 	tnode = node
-			// }
 			dist := wallet.DistanceXor(reqData.ObjHash, node.Hash)
-			if maxdist < dist {
+			if maxdist.Cmp(dist) == -1 {
 				maxdist = dist
 				tnode = node
 			}
@@ -104,7 +107,7 @@ func (h *Handler) newReqData(objtype string, hash string) dtype.ReqData {
 }
 
 func (h *Handler) getObjectByAccessPattern(num int, hashes *[]dbagent.RemoverbleObj) bool {
-	if config.ACCESS_FREQUENCY_PATTERN == config.RANDOM_ACCESS_PATTERN {
+	if config.ConfigInst().AccessFrequencyPattern == config.RANDOM_ACCESS_PATTERN {
 		return h.db.GetTransactionwithUniform(num, hashes)
 	} else {
 		return h.db.GetTransactionwithExponential(num, hashes)
@@ -118,7 +121,7 @@ func (h *Handler) SimulateAccessPattern(pid *int) bool {
 	}
 
 	for _, hash := range hashes {
-		log.Printf("%v(%v) : %v", config.ACCESS_FREQUENCY_PATTERN, *pid, hashes)
+		log.Printf("%v(%v) : %v", config.ConfigInst().AccessFrequencyPattern, *pid, hashes)
 		*pid++
 		if hash.HashType == 0 {
 			bh := blockchain.BlockHeader{}
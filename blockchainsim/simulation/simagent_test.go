@@ -2,12 +2,25 @@ package simulation
 
 import (
 	"bufio"
+	"encoding/hex"
 	"encoding/json"
 	"log"
+	"net"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
 
+	"github.com/gorilla/mux"
+	"github.com/junwookheo/bcsos/blockchainnode/network"
+	"github.com/junwookheo/bcsos/blockchainnode/storage"
+	"github.com/junwookheo/bcsos/common/blockchain"
 	"github.com/junwookheo/bcsos/common/dbagent"
+	"github.com/junwookheo/bcsos/common/dtype"
+	"github.com/junwookheo/bcsos/common/wallet"
+	"github.com/stretchr/testify/assert"
 )
 
 // const PATH_TEST = "../iotdata/IoT_normal_fridge_1.log"
@@ -48,3 +61,37 @@ func TestDBAgent(t *testing.T) {
 	status := dba.GetDBStatus()
 	log.Printf("DB Status : %v", status)
 }
+
+func TestGetObjectQuery(t *testing.T) {
+	dir := t.TempDir()
+	w := wallet.NewWallet(filepath.Join(dir, "node.wallet"))
+	network.NodeInfoInst().SetLocalddrParam("ST", 0, 0, w)
+
+	// A storage node serving /getobject
+	sm := storage.StorageMgrInst(filepath.Join(dir, "node.db"))
+	tr := blockchain.CreateTransaction(w, []byte("simulator query"))
+	sm.AddBlock(blockchain.CreateBlock([]*blockchain.Transaction{tr}, nil, 0))
+	m := mux.NewRouter()
+	sm.SetHttpRouter(m)
+	s := httptest.NewServer(m)
+	defer s.Close()
+
+	host, port, _ := net.SplitHostPort(strings.TrimPrefix(s.URL, "http://"))
+	n, _ := strconv.Atoi(port)
+	nodes := map[string]dtype.NodeInfo{"node": {IP: host, Port: n, SC: 0, Hash: hex.EncodeToString(w.PublicKey)}}
+	db := dbagent.NewDBAgent(filepath.Join(dir, "sim.db"))
+	defer db.Close()
+	h := Handler{w: w, db: db, Nodes: &nodes}
+
+	hash := hex.EncodeToString(tr.Hash)
+	req := h.newReqData("transaction", hash)
+	res := blockchain.Transaction{}
+	assert.True(t, h.getObjectQuery(&req, &res))
+	assert.Equal(t, *tr, res)
+	assert.Equal(t, 0, req.SC)
+	assert.Equal(t, 1, req.Hop)
+
+	// An object no node has
+	req = h.newReqData("transaction", "00"+hash[2:])
+	assert.False(t, h.getObjectQuery(&req, &res))
+}
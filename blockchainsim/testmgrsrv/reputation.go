@@ -0,0 +1,112 @@
+package testmgrsrv
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/junwookheo/bcsos/common/dtype"
+)
+
+// The period to aggregate reputation of nodes
+const TIME_REPUTATION int = 5 // Second
+
+// peerReputation is reputation of a node aggregated from audits of all nodes
+type peerReputation struct {
+	dtype.Reputation
+	Port        int `json:"Port"`
+	Challengers int `json:"Challengers"` // the number of nodes audited the node
+}
+
+func queryReputation(node *dtype.NodeInfo) []dtype.Reputation {
+	url := fmt.Sprintf("ws://%v:%v/reputation", node.IP, node.Port)
+
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		log.Printf("queryReputation Dial error : %v", err)
+		return nil
+	}
+	defer ws.Close()
+
+	reps := []dtype.Reputation{}
+	if err := ws.ReadJSON(&reps); err != nil {
+		log.Printf("Read json error : %v", err)
+		return nil
+	}
+
+	return reps
+}
+
+// aggregateReputation merges reputation reported by nodes, the lowest score comes first
+func aggregateReputation(nodes map[string]dtype.NodeInfo, reports [][]dtype.Reputation) []peerReputation {
+	peers := map[string]*peerReputation{}
+	for _, reps := range reports {
+		for _, r := range reps {
+			p, ok := peers[r.Prover]
+			if !ok {
+				p = &peerReputation{Reputation: dtype.Reputation{Prover: r.Prover, SC: r.SC}, Port: nodes[r.Prover].Port}
+				peers[r.Prover] = p
+			}
+
+			// Latency is weighted by the number of audits
+			if p.Total+r.Total != 0 {
+				p.Latency = (p.Latency*int64(p.Total) + r.Latency*int64(r.Total)) / int64(p.Total+r.Total)
+			}
+			p.Success += r.Success
+			p.Total += r.Total
+			if p.LastAudit < r.LastAudit {
+				p.LastAudit = r.LastAudit
+			}
+			p.Challengers++
+		}
+	}
+
+	agg := []peerReputation{}
+	for _, p := range peers {
+		p.Score = dtype.ReputationScore(p.Success, p.Total)
+		agg = append(agg, *p)
+	}
+	sort.Slice(agg, func(i, j int) bool {
+		if agg[i].Score != agg[j].Score {
+			return agg[i].Score < agg[j].Score
+		}
+		return agg[i].Prover < agg[j].Prover
+	})
+
+	return agg
+}
+
+// reputationHandler sends reputation of nodes aggregated from all nodes to the web app
+func (h *Handler) reputationHandler(w http.ResponseWriter, r *http.Request) {
+	upgrader.CheckOrigin = func(r *http.Request) bool { return true }
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println("reputationHandler", err)
+		return
+	}
+	defer ws.Close()
+
+	ticker := time.NewTicker(time.Duration(TIME_REPUTATION) * time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		nodes := make(map[string]dtype.NodeInfo)
+		h.mutex.Lock()
+		for k, n := range h.Nodes {
+			nodes[k] = n
+		}
+		h.mutex.Unlock()
+
+		var reports [][]dtype.Reputation
+		for _, n := range nodes {
+			reports = append(reports, queryReputation(&n))
+		}
+
+		if err := ws.WriteJSON(aggregateReputation(nodes, reports)); err != nil {
+			log.Printf("Write json error : %v", err)
+			return
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package testmgrsrv
 
 import (
+	"encoding/hex"
 	"fmt"
 	"log"
 	"net/http"
@@ -34,14 +35,17 @@ type Test struct {
 
 type Handler struct {
 	http.Handler
-	db    dbagent.DBAgent
-	Nodes map[string](dtype.NodeInfo)
-	bcsim *simulation.Handler
-	TC    *TestConfig
-	Ready bool
-	el    *listener.EventListener
-	cand  *datalib.CandidateBlocks
-	mutex sync.Mutex
+	db        dbagent.DBAgent
+	Nodes     map[string](dtype.NodeInfo)
+	bcsim     *simulation.Handler
+	TC        *TestConfig
+	Ready     bool
+	el        *listener.EventListener
+	cand      *datalib.CandidateBlocks
+	mutex     sync.Mutex
+	running   bool // a test is started, so a new node has to start as soon as it joins
+	consensus string
+	signers   [][]byte // public keys of PoA signers fixed at the start of test
 }
 
 func (h *Handler) registerHandler(w http.ResponseWriter, r *http.Request) {
@@ -58,6 +62,11 @@ func (h *Handler) registerHandler(w http.ResponseWriter, r *http.Request) {
 		log.Printf("Read json error : %v", err)
 	}
 
+	if err := node.Verify(); err != nil {
+		log.Printf("Register node error : %v", err)
+		return
+	}
+
 	log.Printf("ws remote addr : %v", ws.RemoteAddr().String())
 	ip := strings.Split(ws.RemoteAddr().String(), ":")
 	node.IP = ip[0]
@@ -68,15 +77,42 @@ func (h *Handler) registerHandler(w http.ResponseWriter, r *http.Request) {
 	ws.WriteJSON(node)
 	log.Printf("From client : %v", node)
 
+	// All nodes run with the config of the simulator
+	ws.WriteJSON(config.ConfigInst())
+
+	// A node joining in the middle of test starts after its server is ready
+	h.mutex.Lock()
+	running := h.running
+	h.mutex.Unlock()
+	if running {
+		go func(node dtype.NodeInfo) {
+			time.Sleep(time.Duration(config.ConfigInst().BlockCreatePeriod) * time.Second)
+			h.mutex.Lock()
+			signers := h.signers
+			h.mutex.Unlock()
+			h.sendCommand(dtype.Command{Cmd: "SET", Subcmd: "Test", Arg1: "Start", Signers: signers}, node.IP, node.Port)
+		}(node)
+	}
+
+	// The node signs its information again with the IP address and sends it
+	hash := node.Hash
 	for {
 		if err := ws.ReadJSON(&node); err != nil {
 			// log.Printf("Node is disconnected : %v, %v", err, h.Nodes)
 			h.mutex.Lock()
-			delete(h.Nodes, node.Hash)
+			delete(h.Nodes, hash)
 			h.mutex.Unlock()
 			// log.Printf("Client node list : %v", h.Nodes)
 			break
 		}
+
+		if err := node.Verify(); err != nil || node.Hash != hash {
+			log.Printf("Update node error : %v", err)
+			continue
+		}
+		h.mutex.Lock()
+		h.Nodes[hash] = node
+		h.mutex.Unlock()
 	}
 }
 
@@ -166,7 +202,14 @@ func (h *Handler) commandProc(cmd *dtype.Command) {
 	if cmd.Cmd == "SET" {
 		switch cmd.Subcmd {
 		case "Test":
+			h.mutex.Lock()
+			h.running = cmd.Arg1 == "Start"
+			h.mutex.Unlock()
 			if cmd.Arg1 == "Start" {
+				// Simulator only verifies blocks, so it does not need its wallet
+				if h.consensus == "POA" {
+					blockchain.SetConsensus(blockchain.NewPoA(cmd.Signers, nil))
+				}
 				h.el.Notify("Start")
 			} else if cmd.Arg1 == "Stop" {
 				h.el.Notify("Stop")
@@ -226,6 +269,9 @@ func (h *Handler) commandHandler(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 
+			if cmd.Cmd == "SET" && cmd.Subcmd == "Test" && cmd.Arg1 == "Start" {
+				cmd.Signers = h.setSigners()
+			}
 			h.broadcastCommand(cmd)
 			log.Printf("Test command receive : %v", cmd)
 
@@ -255,6 +301,12 @@ func (h *Handler) newBlockHandler(w http.ResponseWriter, r *http.Request) {
 	var block blockchain.Block
 	if err := ws.ReadJSON(&block); err != nil {
 		log.Printf("Read json error : %v", err)
+		return
+	}
+
+	if err := h.cand.Validate(&block); err != nil {
+		log.Printf("Reject block(%v) %v : %v, total rejected %v", block.Header.Height, hex.EncodeToString(block.Header.Hash), err, h.cand.GetInvalidBlocks())
+		return
 	}
 
 	// log.Printf("Rcv new block(%v) : %v-%v", block.Header.Height, hex.EncodeToString(block.Header.Hash), hex.EncodeToString(block.Header.PrvHash))
@@ -296,7 +348,7 @@ func (h *Handler) SimulateAccessPatternProc() {
 					h.bcsim.SimulateAccessPattern(&id)
 					time.Sleep(time.Second)
 				} else {
-					time.Sleep(time.Duration(config.BLOCK_CREATE_PERIOD) * time.Second)
+					time.Sleep(time.Duration(config.ConfigInst().BlockCreatePeriod) * time.Second)
 				}
 			}
 		}
@@ -337,7 +389,7 @@ func (h *Handler) SimulateTransactionProc() {
 				}
 			default:
 				if status == "Running" {
-					if id < config.TOTAL_TRANSACTIONS {
+					if id < config.ConfigInst().TotalTransactions {
 						h.bcsim.SimulateTransaction(id)
 						id++
 						time.Sleep(time.Second)
@@ -352,25 +404,51 @@ func (h *Handler) SimulateTransactionProc() {
 						log.Printf("sendiing stop")
 					}
 				} else {
-					time.Sleep(time.Duration(config.BLOCK_CREATE_PERIOD) * time.Second)
+					time.Sleep(time.Duration(config.ConfigInst().BlockCreatePeriod) * time.Second)
 				}
 			}
 		}
 	}(command)
 }
 
+// SetConsensus sets the consensus of blocks to be verified, POW or POA
+func (h *Handler) SetConsensus(consensus string) {
+	h.consensus = consensus
+}
+
+// setSigners fixes PoA signers to the registered nodes when the test starts
+// Public keys come from the signed information of nodes, so nodes which join later are not signers.
+func (h *Handler) setSigners() [][]byte {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.signers = nil
+	if h.consensus != "POA" {
+		return nil
+	}
+	for _, node := range h.Nodes {
+		h.signers = append(h.signers, node.PubKey)
+	}
+	log.Printf("PoA signers : %v", len(h.signers))
+
+	return h.signers
+}
+
 func NewHandler(mode string, path string) *Handler {
 	m := mux.NewRouter()
 	h := &Handler{
-		Handler: m,
-		db:      dbagent.NewDBAgent(path), // simulator use storage class 100
-		Nodes:   make(map[string]dtype.NodeInfo),
-		bcsim:   nil,
-		TC:      nil,
-		Ready:   false,
-		el:      nil,
-		cand:    datalib.NewCandidateBlocks(),
-		mutex:   sync.Mutex{},
+		Handler:   m,
+		db:        dbagent.NewDBAgent(path), // simulator use storage class 100
+		Nodes:     make(map[string]dtype.NodeInfo),
+		bcsim:     nil,
+		TC:        nil,
+		Ready:     false,
+		el:        nil,
+		cand:      datalib.NewCandidateBlocks(),
+		mutex:     sync.Mutex{},
+		running:   false,
+		consensus: "POW",
+		signers:   nil,
 	}
 
 	fs := http.FileServer(http.Dir("./static"))
@@ -383,6 +461,7 @@ func NewHandler(mode string, path string) *Handler {
 	m.HandleFunc("/ping", h.pingHandler)
 	m.HandleFunc("/command", h.commandHandler)
 	m.HandleFunc("/broadcastnewblock", h.newBlockHandler)
+	m.HandleFunc("/reputation", h.reputationHandler)
 
 	h.el = listener.EventListenerInst()
 
@@ -1,7 +1,6 @@
 package blockchain
 
 import (
-	"bytes"
 	"crypto/sha256"
 	"time"
 
@@ -16,6 +15,7 @@ type BlockHeader struct {
 	Difficulty int
 	Nonce      int
 	Height     int
+	Signature  []byte // seal of PoA, empty for PoW
 }
 
 type Block struct {
@@ -24,9 +24,12 @@ type Block struct {
 }
 
 func CreateBlock(trs []*Transaction, prevhash []byte, height int) *Block {
-	h := BlockHeader{nil, prevhash, nil, time.Now().UnixNano(), 0, 0, height}
-	block := &Block{h, trs}
-	block.Header.MerkleRoot = block.MerkleRoot()
+	return CreateBlockWithDifficulty(trs, prevhash, height, DIFFICULTY)
+}
+
+// CreateBlockWithDifficulty creates a block sealed with PoW
+func CreateBlockWithDifficulty(trs []*Transaction, prevhash []byte, height int, difficulty int) *Block {
+	block := NewBlock(trs, prevhash, height, difficulty)
 
 	difficulty, nonce, hash := ProofWork(block)
 
@@ -37,6 +40,15 @@ func CreateBlock(trs []*Transaction, prevhash []byte, height int) *Block {
 	return block
 }
 
+// NewBlock creates a block without seal, Consensus.Seal has to be called
+func NewBlock(trs []*Transaction, prevhash []byte, height int, difficulty int) *Block {
+	h := BlockHeader{nil, prevhash, nil, time.Now().UnixNano(), difficulty, 0, height, nil}
+	block := &Block{h, trs}
+	block.Header.MerkleRoot = block.MerkleRoot()
+
+	return block
+}
+
 func genesis(t *Transaction) *Block {
 	return CreateBlock([]*Transaction{t}, []byte{}, 0)
 }
@@ -46,19 +58,10 @@ func CreateGenesis(w *wallet.Wallet) *Block {
 	return genesis(tr)
 }
 
+// GetHash returns sha256 of the canonical encoding of the header object
+// Hash, Nonce and Signature are included, so the header object is bound to the seal.
 func (bh *BlockHeader) GetHash() []byte {
-	data := bytes.Join(
-		[][]byte{
-			bh.Hash,
-			bh.PrvHash,
-			bh.MerkleRoot,
-			toHex(bh.Timestamp),
-			toHex(int64(bh.Difficulty)),
-			toHex(int64(bh.Nonce)),
-			toHex(int64(bh.Height)),
-		},
-		[]byte{},
-	)
+	data, _ := bh.MarshalBinary()
 
 	hash := sha256.Sum256(data)
 	return hash[:]
@@ -76,6 +79,17 @@ func (b *Block) MerkleRoot() []byte {
 	return root
 }
 
+// MerkleProof returns the proof that the index-th transaction is included in the block
+func (b *Block) MerkleProof(index int) *MerkleProof {
+	var hashes [][]byte
+
+	for _, tr := range b.Transactions {
+		hashes = append(hashes, tr.Hash)
+	}
+
+	return BuildMerkleProof(hashes, index)
+}
+
 func (b *Block) PoW() {
 
 }
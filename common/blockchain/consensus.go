@@ -0,0 +1,44 @@
+package blockchain
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Consensus seals blocks and verifies seals of received blocks.
+// PoW is used by default, SetConsensus changes it before the test starts.
+type Consensus interface {
+	// Seal fills Hash, Nonce and Signature of the header, it stops if ctx is cancelled
+	Seal(ctx context.Context, b *Block) error
+	// VerifySeal checks the seal with transactions of the block
+	VerifySeal(b *Block) error
+	// VerifyHeader checks the seal only with the header for header-first sync
+	VerifyHeader(h *BlockHeader) error
+	// IsProducer returns true if the owner of pubkey may produce the block at the height
+	IsProducer(height int, pubkey []byte) bool
+	// NextDifficulty returns the difficulty of the child of parent, parent is nil for the genesis
+	// first is the block at RetargetAncestor(parent.Height+1)
+	NextDifficulty(parent *BlockHeader, first *BlockHeader) int
+	// Delay is the wait before broadcasting a sealed block
+	Delay() time.Duration
+}
+
+var (
+	engine      Consensus = &PoW{}
+	engineMutex sync.Mutex
+)
+
+func SetConsensus(c Consensus) {
+	engineMutex.Lock()
+	defer engineMutex.Unlock()
+
+	engine = c
+}
+
+func GetConsensus() Consensus {
+	engineMutex.Lock()
+	defer engineMutex.Unlock()
+
+	return engine
+}
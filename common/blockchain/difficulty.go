@@ -0,0 +1,56 @@
+package blockchain
+
+import (
+	"math"
+
+	"github.com/junwookheo/bcsos/common/config"
+)
+
+// Range of difficulty in bits
+const MIN_DIFFICULTY = 4
+const MAX_DIFFICULTY = 32
+
+// Max change of difficulty at once in bits, 2 bits mean 4 times harder or easier
+const MAX_RETARGET_STEP = 2
+
+// RetargetAncestor returns the height of the first block of the window
+// which is needed to compute the difficulty of the block at the height, -1 if the difficulty is not changed
+func RetargetAncestor(height int) int {
+	window := config.ConfigInst().RetargetWindow
+	if height < window || height%window != 0 {
+		return -1
+	}
+
+	return height - window
+}
+
+// NextDifficulty returns the expected difficulty of the child of parent.
+// first is the block at RetargetAncestor(parent.Height+1), it is ignored if the difficulty is not changed.
+// Difficulty is in bits, so it is adjusted by log2 of expected time / actual time of the window
+func NextDifficulty(parent *BlockHeader, first *BlockHeader) int {
+	if RetargetAncestor(parent.Height+1) == -1 || first == nil || first.Height >= parent.Height {
+		return parent.Difficulty
+	}
+
+	expected := float64(parent.Height-first.Height) * float64(config.ConfigInst().BlockCreatePeriod) * 1e9
+	actual := float64(parent.Timestamp - first.Timestamp)
+	if actual < 1 {
+		actual = 1
+	}
+
+	step := int(math.Round(math.Log2(expected / actual)))
+	if MAX_RETARGET_STEP < step {
+		step = MAX_RETARGET_STEP
+	} else if step < -MAX_RETARGET_STEP {
+		step = -MAX_RETARGET_STEP
+	}
+
+	difficulty := parent.Difficulty + step
+	if difficulty < MIN_DIFFICULTY {
+		difficulty = MIN_DIFFICULTY
+	} else if MAX_DIFFICULTY < difficulty {
+		difficulty = MAX_DIFFICULTY
+	}
+
+	return difficulty
+}
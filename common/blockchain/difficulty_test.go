@@ -0,0 +1,39 @@
+package blockchain
+
+import (
+	"testing"
+
+	"github.com/junwookheo/bcsos/common/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNextDifficulty(t *testing.T) {
+	const second = int64(1e9)
+	period := int64(config.ConfigInst().BlockCreatePeriod) * second
+	w := config.ConfigInst().RetargetWindow
+
+	first := BlockHeader{Height: 0, Timestamp: 0, Difficulty: DIFFICULTY}
+	parent := BlockHeader{Height: w - 1, Difficulty: DIFFICULTY}
+
+	// Not a retarget height
+	assert.Equal(t, -1, RetargetAncestor(w-1))
+	assert.Equal(t, 0, RetargetAncestor(w))
+	parent.Height = w - 2
+	assert.Equal(t, DIFFICULTY, NextDifficulty(&parent, &first))
+
+	parent.Height = w - 1
+	parent.Timestamp = int64(w-1) * period
+	assert.Equal(t, DIFFICULTY, NextDifficulty(&parent, &first))
+
+	// 2 times slower
+	parent.Timestamp = int64(w-1) * period * 2
+	assert.Equal(t, DIFFICULTY-1, NextDifficulty(&parent, &first))
+
+	// Too fast, the change is limited
+	parent.Timestamp = second
+	assert.Equal(t, DIFFICULTY+MAX_RETARGET_STEP, NextDifficulty(&parent, &first))
+
+	parent.Difficulty = MIN_DIFFICULTY
+	parent.Timestamp = int64(w-1) * period * 100
+	assert.Equal(t, MIN_DIFFICULTY, NextDifficulty(&parent, &first))
+}
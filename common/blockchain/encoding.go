@@ -0,0 +1,258 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+)
+
+// Canonical binary encoding of Transaction, BlockHeader and Block
+//
+// Every value starts with ENCODING_MARKER, ENCODING_VERSION and the kind of the value.
+// gob never writes 0x00 as the first byte, so rows encoded with gob before can be distinguished.
+// []byte : uint32 length + bytes
+// int    : int64
+// All integers are big endian.
+//
+// Transaction : Hash, Timestamp, Data, Signature, PubKey
+// BlockHeader : Hash, PrvHash, MerkleRoot, Timestamp, Difficulty, Nonce, Height, Signature
+// Block       : BlockHeader as []byte, the number of transactions as uint32, Transactions as []byte
+const ENCODING_MARKER byte = 0x00
+const ENCODING_VERSION byte = 1
+
+const (
+	KIND_TRANSACTION byte = 1
+	KIND_BLOCKHEADER byte = 2
+	KIND_BLOCK       byte = 3
+)
+
+var ErrEncoding = errors.New("invalid canonical encoding")
+
+// Types without methods to decode gob rows written before the canonical encoding
+type gobTransaction Transaction
+type gobBlockHeader BlockHeader
+type gobBlock struct {
+	Header       gobBlockHeader
+	Transactions []*gobTransaction
+}
+
+// IsCanonical returns false for data encoded with gob
+func IsCanonical(data []byte) bool {
+	return len(data) != 0 && data[0] == ENCODING_MARKER
+}
+
+type encoder struct {
+	buf bytes.Buffer
+}
+
+func newEncoder(kind byte) *encoder {
+	e := encoder{}
+	e.buf.Write([]byte{ENCODING_MARKER, ENCODING_VERSION, kind})
+	return &e
+}
+
+func (e *encoder) putBytes(b []byte) {
+	var l [4]byte
+	binary.BigEndian.PutUint32(l[:], uint32(len(b)))
+	e.buf.Write(l[:])
+	e.buf.Write(b)
+}
+
+func (e *encoder) putInt(n int64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(n))
+	e.buf.Write(b[:])
+}
+
+// decoder keeps the first error, so fields can be read without checking error every time
+type decoder struct {
+	data []byte
+	err  error
+}
+
+func newDecoder(data []byte, kind byte) *decoder {
+	d := decoder{data: data}
+	if len(data) < 3 || data[0] != ENCODING_MARKER || data[1] != ENCODING_VERSION || data[2] != kind {
+		d.err = ErrEncoding
+		return &d
+	}
+	d.data = data[3:]
+
+	return &d
+}
+
+func (d *decoder) getUint32() uint32 {
+	if d.err != nil || len(d.data) < 4 {
+		d.err = ErrEncoding
+		return 0
+	}
+
+	n := binary.BigEndian.Uint32(d.data)
+	d.data = d.data[4:]
+	return n
+}
+
+// getBytes returns nil for an empty slice like gob
+func (d *decoder) getBytes() []byte {
+	l := d.getUint32()
+	if d.err != nil || uint32(len(d.data)) < l {
+		d.err = ErrEncoding
+		return nil
+	}
+
+	var b []byte
+	if l != 0 {
+		b = append(b, d.data[:l]...)
+	}
+	d.data = d.data[l:]
+	return b
+}
+
+func (d *decoder) getInt() int64 {
+	if d.err != nil || len(d.data) < 8 {
+		d.err = ErrEncoding
+		return 0
+	}
+
+	n := int64(binary.BigEndian.Uint64(d.data))
+	d.data = d.data[8:]
+	return n
+}
+
+// finish returns an error if a field is broken or data is left
+func (d *decoder) finish() error {
+	if d.err == nil && len(d.data) != 0 {
+		d.err = ErrEncoding
+	}
+
+	return d.err
+}
+
+func decodeGob(data []byte, out interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(out)
+}
+
+func (t *Transaction) MarshalBinary() ([]byte, error) {
+	e := newEncoder(KIND_TRANSACTION)
+	e.putBytes(t.Hash)
+	e.putInt(t.Timestamp)
+	e.putBytes(t.Data)
+	e.putBytes(t.Signature)
+	e.putBytes(t.PubKey)
+
+	return e.buf.Bytes(), nil
+}
+
+// UnmarshalBinary decodes the canonical encoding or gob for old rows
+func (t *Transaction) UnmarshalBinary(data []byte) error {
+	if !IsCanonical(data) {
+		return decodeGob(data, (*gobTransaction)(t))
+	}
+
+	d := newDecoder(data, KIND_TRANSACTION)
+	tr := Transaction{}
+	tr.Hash = d.getBytes()
+	tr.Timestamp = d.getInt()
+	tr.Data = d.getBytes()
+	tr.Signature = d.getBytes()
+	tr.PubKey = d.getBytes()
+	if err := d.finish(); err != nil {
+		return err
+	}
+
+	*t = tr
+	return nil
+}
+
+func (bh *BlockHeader) MarshalBinary() ([]byte, error) {
+	e := newEncoder(KIND_BLOCKHEADER)
+	e.putBytes(bh.Hash)
+	e.putBytes(bh.PrvHash)
+	e.putBytes(bh.MerkleRoot)
+	e.putInt(bh.Timestamp)
+	e.putInt(int64(bh.Difficulty))
+	e.putInt(int64(bh.Nonce))
+	e.putInt(int64(bh.Height))
+	e.putBytes(bh.Signature)
+
+	return e.buf.Bytes(), nil
+}
+
+// UnmarshalBinary decodes the canonical encoding or gob for old rows
+func (bh *BlockHeader) UnmarshalBinary(data []byte) error {
+	if !IsCanonical(data) {
+		return decodeGob(data, (*gobBlockHeader)(bh))
+	}
+
+	d := newDecoder(data, KIND_BLOCKHEADER)
+	h := BlockHeader{}
+	h.Hash = d.getBytes()
+	h.PrvHash = d.getBytes()
+	h.MerkleRoot = d.getBytes()
+	h.Timestamp = d.getInt()
+	h.Difficulty = int(d.getInt())
+	h.Nonce = int(d.getInt())
+	h.Height = int(d.getInt())
+	h.Signature = d.getBytes()
+	if err := d.finish(); err != nil {
+		return err
+	}
+
+	*bh = h
+	return nil
+}
+
+func (b *Block) MarshalBinary() ([]byte, error) {
+	e := newEncoder(KIND_BLOCK)
+	header, _ := b.Header.MarshalBinary()
+	e.putBytes(header)
+
+	var l [4]byte
+	binary.BigEndian.PutUint32(l[:], uint32(len(b.Transactions)))
+	e.buf.Write(l[:])
+	for _, t := range b.Transactions {
+		tr, _ := t.MarshalBinary()
+		e.putBytes(tr)
+	}
+
+	return e.buf.Bytes(), nil
+}
+
+// UnmarshalBinary decodes the canonical encoding or gob for old rows
+func (b *Block) UnmarshalBinary(data []byte) error {
+	if !IsCanonical(data) {
+		old := gobBlock{}
+		if err := decodeGob(data, &old); err != nil {
+			return err
+		}
+
+		b.Header = BlockHeader(old.Header)
+		b.Transactions = nil
+		for _, t := range old.Transactions {
+			b.Transactions = append(b.Transactions, (*Transaction)(t))
+		}
+		return nil
+	}
+
+	d := newDecoder(data, KIND_BLOCK)
+	block := Block{}
+	if err := block.Header.UnmarshalBinary(d.getBytes()); err != nil {
+		return err
+	}
+
+	cnt := d.getUint32()
+	for i := uint32(0); i < cnt && d.err == nil; i++ {
+		t := Transaction{}
+		if err := t.UnmarshalBinary(d.getBytes()); err != nil {
+			return err
+		}
+		block.Transactions = append(block.Transactions, &t)
+	}
+	if err := d.finish(); err != nil {
+		return err
+	}
+
+	*b = block
+	return nil
+}
@@ -0,0 +1,60 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/gob"
+	"os"
+	"testing"
+
+	"github.com/junwookheo/bcsos/common/serial"
+	"github.com/junwookheo/bcsos/common/wallet"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCanonicalEncoding(t *testing.T) {
+	wallet_path := "./wallet_test.wallet"
+	w := wallet.NewWallet(wallet_path)
+	defer os.Remove(wallet_path)
+
+	var trs []*Transaction
+	for _, s := range []string{"1111111111", "2222222222", "3333333333"} {
+		trs = append(trs, CreateTransaction(w, []byte(s)))
+	}
+	b1 := CreateBlock(trs, []byte("prv"), 1)
+
+	data := serial.Serialize(b1)
+	assert.True(t, IsCanonical(data))
+	b2 := Block{}
+	serial.Deserialize(data, &b2)
+	assert.Equal(t, *b1, b2)
+
+	// Same value, same bytes
+	data2, _ := b2.MarshalBinary()
+	assert.Equal(t, data, data2)
+
+	h := BlockHeader{}
+	assert.Nil(t, h.UnmarshalBinary(serial.Serialize(&b1.Header)))
+	assert.Equal(t, b1.Header, h)
+
+	// Fields are length prefixed, so moving bytes between fields changes the hash
+	t1 := Transaction{Timestamp: 1, Data: []byte("ab"), Signature: []byte("c")}
+	t2 := Transaction{Timestamp: 1, Data: []byte("a"), Signature: []byte("bc")}
+	assert.NotEqual(t, t1.GetHash(), t2.GetHash())
+	h1 := b1.Header
+	h1.Signature = []byte("seal")
+	assert.NotEqual(t, b1.Header.GetHash(), h1.GetHash())
+
+	// Broken data
+	assert.ErrorIs(t, h.UnmarshalBinary(data), ErrEncoding)
+	tr := Transaction{}
+	assert.ErrorIs(t, tr.UnmarshalBinary(serial.Serialize(trs[0])[:20]), ErrEncoding)
+
+	// Old rows encoded with gob
+	var buf bytes.Buffer
+	gob.NewEncoder(&buf).Encode(gobBlock{gobBlockHeader(b1.Header), []*gobTransaction{(*gobTransaction)(trs[0])}})
+	assert.False(t, IsCanonical(buf.Bytes()))
+	b3 := Block{}
+	assert.Nil(t, b3.UnmarshalBinary(buf.Bytes()))
+	assert.Equal(t, b1.Header, b3.Header)
+	assert.Equal(t, trs[0], b3.Transactions[0])
+}
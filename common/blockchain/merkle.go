@@ -1,6 +1,9 @@
 package blockchain
 
-import "crypto/sha256"
+import (
+	"bytes"
+	"crypto/sha256"
+)
 
 func CalHashSha256(d []byte) []byte {
 	hash := sha256.Sum256(d)
@@ -48,3 +51,61 @@ func CalMerkleRootHash(d [][]byte) []byte {
 
 	return mtns[0]
 }
+
+// MerkleProof is the sibling path from a leaf to the root.
+// Left[i] is true if Siblings[i] is the left node at the level i.
+type MerkleProof struct {
+	Siblings [][]byte `json:"Siblings"`
+	Left     []bool   `json:"Left"`
+}
+
+// BuildMerkleProof returns the proof of hashes[index] with the same rule as CalMerkleRootHash,
+// the last node is duplicated if the number of nodes is odd.
+// Return nil if index is out of range
+func BuildMerkleProof(hashes [][]byte, index int) *MerkleProof {
+	if index < 0 || len(hashes) <= index {
+		return nil
+	}
+
+	proof := MerkleProof{}
+	mtns := hashes
+	for {
+		if len(mtns)%2 == 1 {
+			mtns = append(mtns[:len(mtns):len(mtns)], mtns[len(mtns)-1])
+		}
+
+		if index%2 == 0 {
+			proof.Siblings = append(proof.Siblings, mtns[index+1])
+			proof.Left = append(proof.Left, false)
+		} else {
+			proof.Siblings = append(proof.Siblings, mtns[index-1])
+			proof.Left = append(proof.Left, true)
+		}
+
+		mtns = CalMerkleUpperHashs(mtns)
+		index /= 2
+		if len(mtns) == 1 {
+			break
+		}
+	}
+
+	return &proof
+}
+
+// VerifyMerkleProof checks leaf is included in the tree of root
+func VerifyMerkleProof(root []byte, leaf []byte, proof *MerkleProof) bool {
+	if proof == nil || len(proof.Siblings) == 0 || len(proof.Siblings) != len(proof.Left) {
+		return false
+	}
+
+	node := leaf
+	for i, sibling := range proof.Siblings {
+		if proof.Left[i] {
+			node = CalMerkleNodeHash(sibling, node)
+		} else {
+			node = CalMerkleNodeHash(node, sibling)
+		}
+	}
+
+	return bytes.Equal(node, root)
+}
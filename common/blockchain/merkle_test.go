@@ -1,6 +1,7 @@
 package blockchain
 
 import (
+	"fmt"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -99,3 +100,21 @@ func TestNewMerkleNode3(t *testing.T) {
 
 	assert.Equal(t, root, root2, "Merkle node root has is equal")
 }
+
+func TestMerkleProof(t *testing.T) {
+	for n := 1; n < 10; n++ {
+		var hashes [][]byte
+		for i := 0; i < n; i++ {
+			hashes = append(hashes, CalHashSha256([]byte(fmt.Sprintf("node%v", i))))
+		}
+		root := CalMerkleRootHash(hashes)
+
+		for i := 0; i < n; i++ {
+			proof := BuildMerkleProof(hashes, i)
+			assert.True(t, VerifyMerkleProof(root, hashes[i], proof), "leaf %v of %v", i, n)
+			assert.False(t, VerifyMerkleProof(root, CalHashSha256([]byte("fake")), proof))
+		}
+		assert.Equal(t, root, CalMerkleRootHash(hashes), "hashes must not be changed")
+		assert.Nil(t, BuildMerkleProof(hashes, n))
+	}
+}
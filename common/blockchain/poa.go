@@ -0,0 +1,118 @@
+package blockchain
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"math/big"
+	"sort"
+	"time"
+
+	"github.com/junwookheo/bcsos/common/wallet"
+)
+
+var ErrNotProducer = errors.New("not the producer of the height")
+
+// PoA is round-robin Proof of Authority.
+// The block at height h is produced by signers[h % len(signers)], so no fork happens.
+// The seal is the signature of the block hash, difficulty is always 0 so the longest chain is the heaviest.
+type PoA struct {
+	signers [][]byte // public keys of wallets
+	w       *wallet.Wallet
+}
+
+func (c *PoA) producer(height int) []byte {
+	if len(c.signers) == 0 {
+		return nil
+	}
+
+	return c.signers[height%len(c.signers)]
+}
+
+func (c *PoA) Seal(ctx context.Context, b *Block) error {
+	if c.w == nil || !c.IsProducer(b.Header.Height, c.w.PublicKey) {
+		return ErrNotProducer
+	}
+
+	b.Header.Difficulty = 0
+	b.Header.Nonce = 0
+	data, _ := initData(b, 0)
+	hash := sha256.Sum256(data)
+	b.Header.Hash = hash[:]
+
+	r, s, err := ecdsa.Sign(rand.Reader, c.w.PrivateKey, b.Header.Hash)
+	if err != nil {
+		return err
+	}
+
+	buf1 := make([]byte, 32)
+	buf2 := make([]byte, 32)
+	b.Header.Signature = append(r.FillBytes(buf1), s.FillBytes(buf2)...)
+
+	return nil
+}
+
+func (c *PoA) VerifySeal(b *Block) error {
+	data, _ := initData(b, b.Header.Nonce)
+	hash := sha256.Sum256(data)
+	if !bytes.Equal(hash[:], b.Header.Hash) {
+		return ErrBadSeal
+	}
+
+	return c.VerifyHeader(&b.Header)
+}
+
+func (c *PoA) VerifyHeader(h *BlockHeader) error {
+	if h.Difficulty != 0 {
+		return ErrBadDifficulty
+	}
+
+	pubkey := c.producer(h.Height)
+	if len(pubkey) == 0 || len(h.Signature) != 64 {
+		return ErrBadSeal
+	}
+
+	x := big.Int{}
+	y := big.Int{}
+	x.SetBytes(pubkey[:(len(pubkey) / 2)])
+	y.SetBytes(pubkey[(len(pubkey) / 2):])
+
+	r := big.Int{}
+	s := big.Int{}
+	r.SetBytes(h.Signature[:32])
+	s.SetBytes(h.Signature[32:])
+
+	rawPubKey := ecdsa.PublicKey{Curve: elliptic.P256(), X: &x, Y: &y}
+	if !ecdsa.Verify(&rawPubKey, h.Hash, &r, &s) {
+		return ErrBadSeal
+	}
+
+	return nil
+}
+
+func (c *PoA) IsProducer(height int, pubkey []byte) bool {
+	return bytes.Equal(c.producer(height), pubkey)
+}
+
+func (c *PoA) NextDifficulty(parent *BlockHeader, first *BlockHeader) int {
+	return 0
+}
+
+func (c *PoA) Delay() time.Duration {
+	return 0
+}
+
+// NewPoA creates PoA with public keys of signers, w is the local wallet to sign blocks
+// The signers are sorted so that all nodes have the same order
+func NewPoA(signers [][]byte, w *wallet.Wallet) *PoA {
+	keys := append([][]byte{}, signers...)
+	sort.Slice(keys, func(i, j int) bool {
+		return bytes.Compare(keys[i], keys[j]) < 0
+	})
+
+	return &PoA{signers: keys, w: w}
+}
@@ -0,0 +1,51 @@
+package blockchain
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/junwookheo/bcsos/common/wallet"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPoA(t *testing.T) {
+	dir := t.TempDir()
+	var ws []*wallet.Wallet
+	for _, name := range []string{"1.wallet", "2.wallet"} {
+		ws = append(ws, wallet.NewWallet(filepath.Join(dir, name)))
+	}
+
+	signers := [][]byte{ws[0].PublicKey, ws[1].PublicKey}
+	if 0 < bytes.Compare(signers[0], signers[1]) {
+		signers[0], signers[1] = signers[1], signers[0]
+	}
+	assert.Equal(t, signers, NewPoA([][]byte{signers[1], signers[0]}, nil).signers)
+
+	c0 := NewPoA(signers, ws[0])
+	c1 := NewPoA(signers, ws[1])
+	assert.True(t, c0.IsProducer(0, signers[0]) && c0.IsProducer(1, signers[1]))
+
+	// Only the producer of the height can seal
+	height := 0
+	if !c0.IsProducer(height, ws[0].PublicKey) {
+		height = 1
+	}
+	b := NewBlock([]*Transaction{CreateTransaction(ws[0], []byte("poa"))}, nil, height, 0)
+	assert.ErrorIs(t, c1.Seal(context.Background(), b), ErrNotProducer)
+	assert.Nil(t, c0.Seal(context.Background(), b))
+	assert.Nil(t, c1.VerifySeal(b))
+	assert.Nil(t, c1.VerifyHeader(&b.Header))
+
+	SetConsensus(c1)
+	defer SetConsensus(&PoW{})
+	assert.Nil(t, ValidateBlockBody(b))
+
+	b.Header.Height++
+	assert.ErrorIs(t, c1.VerifySeal(b), ErrBadSeal)
+	b.Header.Height--
+
+	b.Header.Signature[0] ^= 0xff
+	assert.ErrorIs(t, c1.VerifyHeader(&b.Header), ErrBadSeal)
+}
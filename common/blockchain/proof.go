@@ -2,81 +2,211 @@ package blockchain
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/binary"
 	"log"
 	"math"
 	"math/big"
-
-	"github.com/junwookheo/bcsos/common/serial"
+	"math/rand"
+	"runtime"
+	"sync"
+	"time"
 )
 
+// Initial difficulty, it is retargeted by NextDifficulty
 const DIFFICULTY = 12
 
-func getTarget() *big.Int {
+func getTarget(difficulty int) *big.Int {
 	target := big.NewInt(1)
-	target.Lsh(target, uint(256-DIFFICULTY))
+	target.Lsh(target, uint(256-difficulty))
 
 	return target
 }
 
-func initData(b *Block, nonce int) []byte {
-	data := bytes.Join(
-		[][]byte{
-			b.Header.PrvHash,
-			b.Header.MerkleRoot,
-			toHex(b.Header.Timestamp),
-			toHex(int64(DIFFICULTY)),
-			toHex(int64(nonce)),
-			toHex(int64(b.Header.Height)),
-		},
-		[]byte{},
-	)
-	var bs []byte
-	for _, t := range b.Transactions {
-		bs = append(bs, t.Hash...)
-		bs = append(bs, serial.Serialize(t.Timestamp)...)
-		bs = append(bs, t.Data...)
-	}
+// initData returns the canonical encoding of the block to be sealed and the position of the nonce in it
+// Hash and Signature are made by the seal, so they are empty in the data.
+func initData(b *Block, nonce int) ([]byte, int) {
+	sb := Block{Header: b.Header, Transactions: b.Transactions}
+	sb.Header.Hash, sb.Header.Signature, sb.Header.Nonce = nil, nil, nonce
+	data, _ := sb.MarshalBinary()
 
-	data = append(data, bs...)
+	// Block prefix, header length, header prefix, Hash, PrvHash, MerkleRoot, Timestamp, Difficulty
+	pos := 3 + 4 + 3 + 4 + 4 + len(b.Header.PrvHash) + 4 + len(b.Header.MerkleRoot) + 8 + 8
 
-	return data
+	return data, pos
 }
 
 func ProofWork(b *Block) (int, int, []byte) {
-	var intHash big.Int
-	var hash [32]byte
-
-	nonce := 0
-	target := getTarget()
+	difficulty, nonce, hash, _ := ProofWorkContext(context.Background(), b, 1)
 
-	for nonce < math.MaxInt64 {
-		data := initData(b, nonce)
-		hash = sha256.Sum256(data)
+	return difficulty, nonce, hash
+}
 
-		intHash.SetBytes(hash[:])
-		if intHash.Cmp(target) == -1 {
-			break
-		} else {
-			nonce++
+// meetDifficulty returns true if hash < 2^(256-difficulty), that is the first difficulty bits are zero
+func meetDifficulty(hash []byte, difficulty int) bool {
+	for i := 0; i < difficulty/8; i++ {
+		if hash[i] != 0 {
+			return false
 		}
 	}
 
-	return DIFFICULTY, nonce, hash[:]
+	if difficulty%8 == 0 {
+		return true
+	}
+
+	return hash[difficulty/8] < 1<<(8-difficulty%8)
+}
+
+// ProofWorkContext splits the nonce space to workers, i-th worker tries i, i+workers, i+2*workers, ...
+// The data except the nonce is built once, so only the nonce is replaced for each try.
+// It returns ctx.Err() if ctx is cancelled before the nonce is found, for example a new block is received.
+// With 1 worker, the nonce is the smallest one.
+func ProofWorkContext(ctx context.Context, b *Block, workers int) (int, int, []byte, error) {
+	type result struct {
+		nonce int
+		hash  []byte
+	}
+
+	if workers < 1 {
+		workers = 1
+	}
+
+	difficulty := b.Header.Difficulty
+	data, pos := initData(b, 0)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	found := make(chan result, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(start int, buf []byte) {
+			defer wg.Done()
+
+			for nonce := start; nonce <= math.MaxInt64-workers; nonce += workers {
+				// Checking every try is too slow
+				if (nonce/workers)%1024 == 0 && ctx.Err() != nil {
+					return
+				}
+
+				binary.BigEndian.PutUint64(buf[pos:], uint64(nonce))
+				hash := sha256.Sum256(buf)
+				if meetDifficulty(hash[:], difficulty) {
+					found <- result{nonce, hash[:]}
+					return
+				}
+			}
+		}(i, append([]byte{}, data...))
+	}
+
+	go func() {
+		wg.Wait()
+		close(found)
+	}()
+
+	select {
+	case r, ok := <-found:
+		if !ok {
+			if ctx.Err() != nil {
+				return difficulty, 0, nil, ctx.Err()
+			}
+			return difficulty, 0, nil, ErrBadPoW
+		}
+		return difficulty, r.nonce, r.hash, nil
+	case <-ctx.Done():
+		return difficulty, 0, nil, ctx.Err()
+	}
 }
 
 func Validate(b *Block) bool {
 	var intHash big.Int
-	target := getTarget()
+	target := getTarget(b.Header.Difficulty)
 
-	data := initData(b, b.Header.Nonce)
+	data, _ := initData(b, b.Header.Nonce)
 	hash := sha256.Sum256(data)
 	intHash.SetBytes(hash[:])
 
 	return intHash.Cmp(target) == -1
 }
 
+// PoW is Proof of Work, the difficulty is retargeted every RETARGET_WINDOW blocks
+type PoW struct{}
+
+// Seal uses all CPUs and stops if ctx is cancelled
+func (c *PoW) Seal(ctx context.Context, b *Block) error {
+	difficulty, nonce, hash, err := ProofWorkContext(ctx, b, runtime.NumCPU())
+	if err != nil {
+		return err
+	}
+
+	b.Header.Hash = hash[:]
+	b.Header.Difficulty = difficulty
+	b.Header.Nonce = nonce
+
+	return nil
+}
+
+func (c *PoW) VerifySeal(b *Block) error {
+	var intHash big.Int
+
+	if b.Header.Difficulty < MIN_DIFFICULTY || MAX_DIFFICULTY < b.Header.Difficulty {
+		return ErrBadDifficulty
+	}
+
+	data, _ := initData(b, b.Header.Nonce)
+	hash := sha256.Sum256(data)
+	intHash.SetBytes(hash[:])
+	if !bytes.Equal(hash[:], b.Header.Hash) || intHash.Cmp(getTarget(b.Header.Difficulty)) != -1 {
+		return ErrBadPoW
+	}
+
+	return nil
+}
+
+// VerifyHeader can not recompute the hash without transactions, so only the hash is checked with the target.
+func (c *PoW) VerifyHeader(h *BlockHeader) error {
+	var intHash big.Int
+
+	if h.Difficulty < MIN_DIFFICULTY || MAX_DIFFICULTY < h.Difficulty {
+		return ErrBadDifficulty
+	}
+
+	intHash.SetBytes(h.Hash)
+	if len(h.Hash) != sha256.Size || intHash.Cmp(getTarget(h.Difficulty)) != -1 {
+		return ErrBadPoW
+	}
+
+	return nil
+}
+
+// Anyone can mine a block
+func (c *PoW) IsProducer(height int, pubkey []byte) bool {
+	return true
+}
+
+func (c *PoW) NextDifficulty(parent *BlockHeader, first *BlockHeader) int {
+	if parent == nil {
+		return DIFFICULTY
+	}
+
+	return NextDifficulty(parent, first)
+}
+
+// Too much forks happen so add random delay
+func (c *PoW) Delay() time.Duration {
+	return time.Millisecond * time.Duration(rand.Intn(100)*10)
+}
+
+// Work is the expected number of hashes to find the block, 2^Difficulty
+func (bh *BlockHeader) Work() *big.Int {
+	work := big.NewInt(1)
+	work.Lsh(work, uint(bh.Difficulty))
+
+	return work
+}
+
 func toHex(n int64) []byte {
 	buf := new(bytes.Buffer)
 	err := binary.Write(buf, binary.BigEndian, n)
@@ -0,0 +1,49 @@
+package blockchain
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"math/big"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/junwookheo/bcsos/common/wallet"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProofWorkContext(t *testing.T) {
+	wallet_path := "./wallet_test.wallet"
+	w := wallet.NewWallet(wallet_path)
+	defer os.Remove(wallet_path)
+
+	b := NewBlock([]*Transaction{CreateTransaction(w, []byte("pow"))}, []byte("prv"), 1, DIFFICULTY)
+
+	// The smallest nonce with 1 worker
+	_, nonce, hash := ProofWork(b)
+	var intHash big.Int
+	for i := 0; i < nonce; i++ {
+		data, _ := initData(b, i)
+		h := sha256.Sum256(data)
+		intHash.SetBytes(h[:])
+		assert.NotEqual(t, -1, intHash.Cmp(getTarget(DIFFICULTY)))
+	}
+	data, pos := initData(b, nonce)
+	assert.Equal(t, uint64(nonce), binary.BigEndian.Uint64(data[pos:]))
+	h := sha256.Sum256(data)
+	assert.Equal(t, h[:], hash)
+
+	pow := PoW{}
+	assert.Nil(t, pow.Seal(context.Background(), b))
+	assert.Nil(t, pow.VerifySeal(b))
+
+	// Difficulty too high to be found before the timeout
+	b.Header.Difficulty = MAX_DIFFICULTY
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, _, _, err := ProofWorkContext(ctx, b, 4)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), time.Second)
+}
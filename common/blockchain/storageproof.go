@@ -0,0 +1,62 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+)
+
+// Proof of Storage with Merkle proofs
+// The challenger selects transactions of a block from the block hash, the prover address and a nonce.
+// The prover returns the transactions with Merkle paths, so the challenger only needs the block header.
+
+// PoSIndices selects num distinct indices of a block with ntx transactions
+func PoSIndices(blockhash []byte, addr []byte, nonce int64, ntx int, num int) []int {
+	if ntx < num {
+		num = ntx
+	}
+
+	seed := sha256.Sum256(bytes.Join([][]byte{blockhash, addr, toHex(nonce)}, []byte{}))
+	selected := map[int]bool{}
+	indices := []int{}
+	for c := int64(0); len(indices) < num; c++ {
+		h := sha256.Sum256(append(seed[:], toHex(c)...))
+		idx := int(binary.BigEndian.Uint64(h[:8]) % uint64(ntx))
+		if !selected[idx] {
+			selected[idx] = true
+			indices = append(indices, idx)
+		}
+	}
+
+	return indices
+}
+
+// merkleDepth is the length of Merkle paths of a tree with n leaves
+func merkleDepth(n int) int {
+	depth := 1
+	for w := 2; w < n; w *= 2 {
+		depth++
+	}
+
+	return depth
+}
+
+// VerifyPoSLeaf checks the transaction is the index-th leaf of the tree of root with ntx leaves
+func VerifyPoSLeaf(root []byte, ntx int, index int, t *Transaction, proof *MerkleProof) bool {
+	if t == nil || proof == nil || index < 0 || ntx <= index || len(proof.Left) != merkleDepth(ntx) {
+		return false
+	}
+
+	// The path should go to the position of the index
+	for i, left := range proof.Left {
+		if left != ((index>>i)&1 == 1) {
+			return false
+		}
+	}
+
+	if !bytes.Equal(t.Hash, t.GetHash()) {
+		return false
+	}
+
+	return VerifyMerkleProof(root, t.Hash, proof)
+}
@@ -0,0 +1,52 @@
+package blockchain
+
+import (
+	"os"
+	"testing"
+
+	"github.com/junwookheo/bcsos/common/wallet"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPoSIndices(t *testing.T) {
+	indices := PoSIndices([]byte("block"), []byte("addr"), 1, 10, 4)
+	assert.Equal(t, 4, len(indices))
+	assert.Equal(t, indices, PoSIndices([]byte("block"), []byte("addr"), 1, 10, 4))
+	assert.NotEqual(t, indices, PoSIndices([]byte("block"), []byte("addr2"), 1, 10, 4))
+
+	selected := map[int]bool{}
+	for _, idx := range PoSIndices([]byte("block"), []byte("addr"), 1, 3, 4) {
+		assert.False(t, selected[idx])
+		assert.Less(t, idx, 3)
+		selected[idx] = true
+	}
+	assert.Equal(t, 3, len(selected))
+}
+
+func TestVerifyPoSLeaf(t *testing.T) {
+	wallet_path := "./wallet_test.wallet"
+	w := wallet.NewWallet(wallet_path)
+	defer os.Remove(wallet_path)
+
+	for n := 1; n <= 9; n++ {
+		var trs []*Transaction
+		var hashes [][]byte
+		for i := 0; i < n; i++ {
+			tr := CreateTransaction(w, []byte{byte(n), byte(i)})
+			trs = append(trs, tr)
+			hashes = append(hashes, tr.Hash)
+		}
+		root := CalMerkleRootHash(hashes)
+
+		for i := 0; i < n; i++ {
+			proof := BuildMerkleProof(hashes, i)
+			assert.True(t, VerifyPoSLeaf(root, n, i, trs[i], proof))
+			assert.False(t, VerifyPoSLeaf(root, n+8, i, trs[i], proof))
+		}
+
+		// The leaf at another position
+		if 1 < n {
+			assert.False(t, VerifyPoSLeaf(root, n, 0, trs[1], BuildMerkleProof(hashes, 1)))
+		}
+	}
+}
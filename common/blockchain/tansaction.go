@@ -1,7 +1,6 @@
 package blockchain
 
 import (
-	"bytes"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
@@ -22,16 +21,12 @@ type Transaction struct {
 	PubKey    []byte
 }
 
+// GetHash returns sha256 of the canonical encoding without Hash
+// The signature is included, it is empty when the signed data is built
 func (t *Transaction) GetHash() []byte {
-	data := bytes.Join(
-		[][]byte{
-			toHex(t.Timestamp),
-			t.Data[:],
-			t.Signature[:],
-			t.PubKey[:],
-		},
-		[]byte{},
-	)
+	tr := *t
+	tr.Hash = nil
+	data, _ := tr.MarshalBinary()
 
 	hash := sha256.Sum256(data)
 	return hash[:]
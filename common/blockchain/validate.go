@@ -0,0 +1,91 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Allowed clock drift between nodes, a block from further in the future is rejected
+const MAX_FUTURE_BLOCK_TIME = 60 // Second
+
+var (
+	ErrBadPoW          = errors.New("bad proof of work")
+	ErrBadMerkleRoot   = errors.New("bad merkle root")
+	ErrBadSignature    = errors.New("bad transaction signature")
+	ErrUnknownParent   = errors.New("unknown parent block")
+	ErrHeightMismatch  = errors.New("block height mismatch")
+	ErrFutureTimestamp = errors.New("block timestamp in the future")
+	ErrBadDifficulty   = errors.New("unexpected difficulty")
+	ErrBadSeal         = errors.New("bad seal")
+)
+
+// ValidateBlockBody checks everything that can be checked without the parent block
+// Seal, Merkle root, signature of transactions and timestamp
+func ValidateBlockBody(b *Block) error {
+	if err := GetConsensus().VerifySeal(b); err != nil {
+		return err
+	}
+
+	if len(b.Transactions) == 0 || !bytes.Equal(b.MerkleRoot(), b.Header.MerkleRoot) {
+		return ErrBadMerkleRoot
+	}
+
+	for i, t := range b.Transactions {
+		if !bytes.Equal(t.Hash, t.GetHash()) || !t.Verify() {
+			return fmt.Errorf("%w : %v-th transaction", ErrBadSignature, i)
+		}
+	}
+
+	if time.Now().UnixNano()+int64(MAX_FUTURE_BLOCK_TIME)*int64(time.Second) < b.Header.Timestamp {
+		return ErrFutureTimestamp
+	}
+
+	return nil
+}
+
+// ValidateBlock checks the block and its connection to the parent header.
+// parent == nil is only allowed for the genesis block
+func ValidateBlock(b *Block, parent *BlockHeader) error {
+	if parent == nil {
+		if b.Header.Height != 0 || len(b.Header.PrvHash) != 0 {
+			return ErrUnknownParent
+		}
+		return ValidateBlockBody(b)
+	}
+
+	if !bytes.Equal(b.Header.PrvHash, parent.Hash) {
+		return ErrUnknownParent
+	}
+
+	if b.Header.Height != parent.Height+1 {
+		return fmt.Errorf("%w : %v, parent %v", ErrHeightMismatch, b.Header.Height, parent.Height)
+	}
+
+	return ValidateBlockBody(b)
+}
+
+// ValidateHeader checks a header without transactions for header-first sync.
+// parent == nil is only allowed for the genesis block
+func ValidateHeader(h *BlockHeader, parent *BlockHeader) error {
+	if parent == nil {
+		if h.Height != 0 || len(h.PrvHash) != 0 {
+			return ErrUnknownParent
+		}
+	} else if !bytes.Equal(h.PrvHash, parent.Hash) {
+		return ErrUnknownParent
+	} else if h.Height != parent.Height+1 {
+		return fmt.Errorf("%w : %v, parent %v", ErrHeightMismatch, h.Height, parent.Height)
+	}
+
+	if err := GetConsensus().VerifyHeader(h); err != nil {
+		return err
+	}
+
+	if time.Now().UnixNano()+int64(MAX_FUTURE_BLOCK_TIME)*int64(time.Second) < h.Timestamp {
+		return ErrFutureTimestamp
+	}
+
+	return nil
+}
@@ -0,0 +1,61 @@
+package blockchain
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/junwookheo/bcsos/common/wallet"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateBlock(t *testing.T) {
+	wallet_path := "./wallet_test.wallet"
+	w := wallet.NewWallet(wallet_path)
+	defer os.Remove(wallet_path)
+
+	crbl := func(pre string, prv []byte, height int) *Block {
+		var trs []*Transaction
+		for _, s := range []string{pre + "1111111111", pre + "2222222222", pre + "3333333333"} {
+			trs = append(trs, CreateTransaction(w, []byte(s)))
+		}
+		return CreateBlock(trs, prv, height)
+	}
+
+	b0 := crbl("aaaaa-", nil, 0)
+	assert.Nil(t, ValidateBlock(b0, nil))
+
+	b1 := crbl("bbbbb-", b0.Header.Hash, 1)
+	assert.Nil(t, ValidateBlock(b1, &b0.Header))
+	assert.True(t, errors.Is(ValidateBlock(b1, nil), ErrUnknownParent))
+	assert.True(t, errors.Is(ValidateBlock(b1, &b1.Header), ErrUnknownParent))
+
+	b2 := crbl("ccccc-", b0.Header.Hash, 2)
+	assert.True(t, errors.Is(ValidateBlock(b2, &b0.Header), ErrHeightMismatch))
+
+	b1.Header.Nonce++
+	assert.True(t, errors.Is(ValidateBlock(b1, &b0.Header), ErrBadPoW))
+	b1.Header.Nonce--
+
+	b1.Header.MerkleRoot = b0.Header.MerkleRoot
+	assert.True(t, errors.Is(ValidateBlockBody(b1), ErrBadPoW))
+	b1.Header.MerkleRoot = b1.MerkleRoot()
+
+	// Data is tampered and mined again, so only the signature is broken
+	b3 := crbl("ddddd-", b0.Header.Hash, 1)
+	b3.Transactions[1].Data = []byte("tampered")
+	b3.Transactions[1].Hash = b3.Transactions[1].GetHash()
+	b3 = CreateBlock(b3.Transactions, b0.Header.Hash, 1)
+	assert.True(t, errors.Is(ValidateBlock(b3, &b0.Header), ErrBadSignature))
+
+	b4 := crbl("eeeee-", b0.Header.Hash, 1)
+	b4.Header.MerkleRoot = b0.Header.MerkleRoot
+	_, b4.Header.Nonce, b4.Header.Hash = ProofWork(b4)
+	assert.True(t, errors.Is(ValidateBlock(b4, &b0.Header), ErrBadMerkleRoot))
+
+	b5 := crbl("fffff-", b0.Header.Hash, 1)
+	b5.Header.Timestamp = time.Now().Add(time.Hour).UnixNano()
+	_, b5.Header.Nonce, b5.Header.Hash = ProofWork(b5)
+	assert.True(t, errors.Is(ValidateBlock(b5, &b0.Header), ErrFutureTimestamp))
+}
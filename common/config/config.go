@@ -1,72 +1,25 @@
 package config
 
-// Total transactions
-const TOTAL_TRANSACTIONS int = 40000
-
-// Block create period
-const BLOCK_CREATE_PERIOD int = 5
-
-// The number of transaction in a block
-// IF NUM_TRANSACTION_BLOCK == 0, choose random between 3 to 6
-const NUM_TRANSACTION_BLOCK int = 6
+// Experiment parameters are in Config of runtimeconfig.go, they can be changed without rebuilding
 
 const (
 	RANDOM_ACCESS_PATTERN      string = "Random_Distribution"
 	EXPONENTIAL_ACCESS_PATTERN string = "Exponential_Distribution"
 )
 
-//const ACCESS_FREQUENCY_PATTERN string = RANDOM_ACCESS_PATTERN
-
-const ACCESS_FREQUENCY_PATTERN string = EXPONENTIAL_ACCESS_PATTERN
-
-// P = 1 - e^(-lambda*t)
-// Example : Probability of event occure to be 50%
-// T = 0.69/Lambda
-// Lambda	Time
-//   1       0.69
-//   0.5     1.38
-//   0.2     3.45
-//   0.1     6.9
-/////////////////////////////////////////////////
-// P	Lambda	Time
-// 0.5	0.1		6.931471806
-// 0.6	0.1		9.162907319
-// 0.7	0.1		12.03972804
-// 0.8	0.1		16.09437912
-// 0.9	0.1		23.02585093
-// 0.99 0.1 	49.05170186
-
-// The basic unit of time (T)
-const BASIC_UNIT_TIME int = 20                   // 60 seconds
-const PROBABILITY_FACTOR_SC0 float32 = 0.6931472 // P : 0.500000, T : 6.931472
-const PROBABILITY_FACTOR_SC1 float32 = 1.3862944 // P : 0.750000, T : 13.862944
-const PROBABILITY_FACTOR_SC2 float32 = 2.7725887 // P : 0.937500, T : 27.725887
-
-// Time period for Remove data : T x TSC0
-// TSC0 :  After the time, no access data will be removed from local storage.
-// 1 Minuite : The start time for TS20 to remove objects is 23 minuites after starting simulation
-// so about 50 minute is needed for total simulation time
-// IoT+normal_fridge_1.log has 40057 transactions. We generate a block with 6 transactions
-// and create every 5 seconds, so total simulation time will be around 9.3 hours.
-// Thus, 10 minuites is good for 500 minuites(8.3 hours)
-const RATE_TSC int = 10 // x BASIC_UNIT_TIME
-
-// Lambda for Exponential Distribution
-// the number of event in TSC0
-const LAMBDA_ED float32 = 0.1
-
-// TSC0 = RATE_TSC x BASIC_UNIT_TIME * (PROBABILITY_FACTOR / LAMBDA_ED)
-const TSC0I float32 = float32(RATE_TSC*BASIC_UNIT_TIME) * PROBABILITY_FACTOR_SC0 / LAMBDA_ED
-const TSC1I float32 = float32(RATE_TSC*BASIC_UNIT_TIME) * PROBABILITY_FACTOR_SC1 / LAMBDA_ED
-const TSC2I float32 = float32(RATE_TSC*BASIC_UNIT_TIME) * PROBABILITY_FACTOR_SC2 / LAMBDA_ED
-
-// Array for TSC0 ~ 3
-var TSCX = [...]float32{TSC0I, TSC1I, TSC2I, 0}
-
-// Max number of storage class
+// Eviction policies of storage classes
+const (
+	EVICTION_TIME string = "TIME" // remove objects not accessed for TSCX
+	EVICTION_LRU  string = "LRU"  // keep CacheObjects recently used objects
+	EVICTION_LFU  string = "LFU"  // keep CacheObjects frequently used objects
+	EVICTION_ARC  string = "ARC"  // Adaptive Replacement Cache with CacheObjects
+	EVICTION_SIZE string = "SIZE" // remove least recently used objects over CacheBytes
+)
+
+// Max number of storage class, the size of arrays for node lists
 const MAX_SC int = 4
 
-// Max the number of peers for each storage class
+// Max the number of peers for each storage class, the size of arrays for node lists
 const MAX_SC_PEER int = 7
 
 // Simulator Storage class : 100
@@ -76,12 +29,70 @@ const SIM_SC int = 100
 // The number of transactions to be read for access pattern
 const NUM_AP_GEN int = 10
 
+// Verified retrieval mode : a transaction from other nodes is checked
+// with Merkle proof against the block header kept in local storage
+const VERIFY_OBJECT_QUERY bool = true
+
 // The number of time to create accessing transaction for access pattern
 const TIME_AP_GEN int = 10 // Second
 
 // The time to search neighbour nodes to update node info
 const TIME_UPDATE_NEITHBOUR int = 10 //60 // Second
 
+// The number of peers queried in parallel by a node lookup of Kademlia
+const KAD_ALPHA int = 3
+
+// Requests to peers time out after PEER_TIMEOUT
+const PEER_TIMEOUT int = 10 // Second
+
+// A peer sending a message larger than PEER_READ_LIMIT is disconnected
+const PEER_READ_LIMIT int64 = 16 << 20 // Byte
+
+// A peer is redialed after PEER_BACKOFF_MIN doubled for each failure up to PEER_BACKOFF_MAX
+const PEER_BACKOFF_MIN int = 500   // Millisecond
+const PEER_BACKOFF_MAX int = 30000 // Millisecond
+
+// Wire protocol versions, a peer connection is accepted if versions of both nodes overlap
+const PROTOCOL_VERSION uint16 = 1
+const PROTOCOL_MIN_VERSION uint16 = 1
+
+// Codecs of messages between peers
+const (
+	CODEC_JSON   string = "JSON"   // text frames
+	CODEC_BINARY string = "BINARY" // binary frames of the envelope around a JSON payload
+)
+
+// Hashes of blocks and transactions gossiped are remembered for GOSSIP_SEEN_TTL
+const GOSSIP_SEEN_TTL int = 600 // Second
+
+// Provider records of content routing expire after PROVIDER_TTL
+const PROVIDER_TTL int = 600 // Second
+
+// Objects kept in local storage are announced again every PROVIDER_REPUBLISH, before the records expire
+const PROVIDER_REPUBLISH int = 300 // Second
+
+// Routing modes to find objects in other nodes
+const ROUTING_WALK string = "walk"         // query storage classes in order
+const ROUTING_PROVIDER string = "provider" // FIND_VALUE lookup of provider records
+
 const END_TEST string = "END_TEST"
 
-const FINALITY int = 6
+// The number of headers requested at once for initial block download
+const SYNC_HEADER_BATCH int = 100
+
+// Rows of the access log older than ACCESS_LOG_RETENTION are removed every ACCESS_LOG_PRUNE rows
+// Counters of objects are kept in objectstats
+const ACCESS_LOG_RETENTION int = 3600 // Second
+const ACCESS_LOG_PRUNE int = 1000
+
+// Reorg events queued for a listener, further events are dropped until it reads them
+const REORG_QUEUE_SIZE int = 64
+
+// Nodes not closest to a block check its shards after ERASURE_PROBE_DELAY before removing transactions
+const ERASURE_PROBE_DELAY int = 30 // Second
+
+// The number of transactions proven for a challenge of Proof of Storage
+const NUM_POS_LEAVES int = 4
+
+// Peers with lower reputation score of Proof of Storage are queried after others
+const MIN_REPUTATION float64 = 0.4
@@ -0,0 +1,388 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Config has parameters of an experiment.
+// It is loaded from a JSON file, overridden by flags and the simulator pushes its config to nodes at /register,
+// so all nodes in the cluster run with the same parameters.
+type Config struct {
+	// Total transactions
+	TotalTransactions int `json:"total_transactions"`
+	// Block create period, Second
+	BlockCreatePeriod int `json:"block_create_period"`
+	// The number of transaction in a block
+	// IF NumTransactionBlock == 0, choose random between 3 to 6
+	NumTransactionBlock int `json:"num_transaction_block"`
+	// RANDOM_ACCESS_PATTERN or EXPONENTIAL_ACCESS_PATTERN
+	AccessFrequencyPattern string `json:"access_frequency_pattern"`
+	// The basic unit of time (T), Second
+	BasicUnitTime int `json:"basic_unit_time"`
+	// TSCX = RateTSC x BasicUnitTime * (ProbabilityFactors / LambdaED)
+	RateTSC int `json:"rate_tsc"`
+	// Lambda for Exponential Distribution, the number of event in TSC0
+	LambdaED float32 `json:"lambda_ed"`
+	// P = 1 - e^(-lambda*t) for SC0 ~ NumSC-2, the highest storage class keeps everything
+	// Only the first NumSC-1 values are used
+	ProbabilityFactors []float32 `json:"probability_factors"`
+	// The number of storage class, up to MAX_SC
+	NumSC int `json:"num_sc"`
+	// The size of k-buckets of each storage class, up to MAX_SC_PEER
+	NumSCPeer int `json:"num_sc_peer"`
+	Finality  int `json:"finality"`
+	// PoW difficulty is retargeted every RetargetWindow blocks to create a block every BlockCreatePeriod
+	// It should not be larger than Finality*2 so that the first block of the window is in candidate blocks
+	RetargetWindow int `json:"retarget_window"`
+	// Eviction policy for SC0 ~ NumSC-2, EVICTION_TIME, EVICTION_LRU, EVICTION_LFU, EVICTION_ARC or EVICTION_SIZE
+	EvictionPolicy []string `json:"eviction_policy"`
+	// The number of objects kept by LRU, LFU and ARC for SC0 ~ NumSC-2
+	CacheObjects []int `json:"cache_objects"`
+	// The size of objects kept by SIZE for SC0 ~ NumSC-2, Byte
+	CacheBytes []int `json:"cache_bytes"`
+	// The byte quota of a node for SC0 ~ NumSC-1, 0 is unlimited
+	QuotaBytes []int `json:"quota_bytes"`
+	// The highest storage class keeps finalised block bodies as Reed-Solomon shards instead of full copies
+	ErasureCoding bool `json:"erasure_coding"`
+	// The number of data shards(k) and parity shards(m), a block body is reconstructed from any k shards
+	ErasureDataShards   int `json:"erasure_data_shards"`
+	ErasureParityShards int `json:"erasure_parity_shards"`
+	// Each object of the highest storage class is kept by ReplicationFactor closest nodes, 0 keeps it in all nodes
+	ReplicationFactor int `json:"replication_factor"`
+	// Replicas are audited every AuditPeriod, Second
+	AuditPeriod int `json:"audit_period"`
+	// Objects are found by ROUTING_PROVIDER lookups before ROUTING_WALK if it is true
+	ContentRouting bool `json:"content_routing"`
+	// An object is queried to QueryFanout nodes in parallel, each query times out after QueryTimeout, Millisecond
+	QueryFanout  int `json:"query_fanout"`
+	QueryTimeout int `json:"query_timeout"`
+	// The next QueryFanout nodes are queried if no object arrives in HedgeDelay, Millisecond, 0 disables hedging
+	HedgeDelay int `json:"hedge_delay"`
+	// Codec of messages to peers, CODEC_JSON or CODEC_BINARY
+	WireCodec string `json:"wire_codec"`
+	// New blocks and transactions are announced to GossipFanout random peers
+	GossipFanout int `json:"gossip_fanout"`
+
+	// Time period to remove no access data for each storage class, derived from the values above
+	TSCX []float32 `json:"-"`
+}
+
+var (
+	cfg      *Config
+	cfgMutex sync.Mutex
+	cfgPath  *string
+	cfgFlags = map[string]interface{}{}
+)
+
+// DefaultConfig has values used before the config file was introduced
+//
+// P	Lambda	Time
+// 0.5	0.1		6.931471806
+// 0.75	0.1		13.86294361
+// 0.9375	0.1		27.72588722
+//
+// IoT+normal_fridge_1.log has 40057 transactions. We generate a block with 6 transactions
+// and create every 5 seconds, so total simulation time will be around 9.3 hours.
+// Thus, 10 minuites is good for 500 minuites(8.3 hours)
+func DefaultConfig() *Config {
+	c := Config{
+		TotalTransactions:      40000,
+		BlockCreatePeriod:      5,
+		NumTransactionBlock:    6,
+		AccessFrequencyPattern: EXPONENTIAL_ACCESS_PATTERN,
+		BasicUnitTime:          20,
+		RateTSC:                10,
+		LambdaED:               0.1,
+		ProbabilityFactors:     []float32{0.6931472, 1.3862944, 2.7725887},
+		NumSC:                  MAX_SC,
+		NumSCPeer:              MAX_SC_PEER,
+		Finality:               6,
+		RetargetWindow:         6,
+		EvictionPolicy:         []string{EVICTION_TIME, EVICTION_TIME, EVICTION_TIME},
+		CacheObjects:           []int{1000, 2000, 4000},
+		CacheBytes:             []int{1 << 20, 2 << 20, 4 << 20},
+		QuotaBytes:             []int{0, 0, 0, 0},
+		ErasureCoding:          false,
+		ErasureDataShards:      4,
+		ErasureParityShards:    2,
+		ReplicationFactor:      0,
+		AuditPeriod:            30,
+		ContentRouting:         false,
+		QueryFanout:            2,
+		QueryTimeout:           5000,
+		HedgeDelay:             1000,
+		WireCodec:              CODEC_JSON,
+		GossipFanout:           4,
+	}
+	c.derive()
+
+	return &c
+}
+
+// derive computes TSCX, the highest storage class never removes data
+func (c *Config) derive() {
+	c.TSCX = make([]float32, c.NumSC)
+	for i := 0; i < c.NumSC-1 && i < len(c.ProbabilityFactors); i++ {
+		c.TSCX[i] = float32(c.RateTSC*c.BasicUnitTime) * c.ProbabilityFactors[i] / c.LambdaED
+	}
+}
+
+// TSC returns the time period to remove no access data of the storage class, 0 keeps everything
+func (c *Config) TSC(sc int) float32 {
+	if sc < 0 || len(c.TSCX) <= sc {
+		return 0
+	}
+
+	return c.TSCX[sc]
+}
+
+// Quota returns the byte quota of the storage class, 0 is unlimited
+func (c *Config) Quota(sc int) int {
+	if sc < 0 || len(c.QuotaBytes) <= sc {
+		return 0
+	}
+
+	return c.QuotaBytes[sc]
+}
+
+// TransactionsPerBlock returns the average number of transactions in a block
+func (c *Config) TransactionsPerBlock() int {
+	if c.NumTransactionBlock == 0 {
+		return 5 // random between 3 to 6
+	}
+
+	return c.NumTransactionBlock
+}
+
+func (c *Config) Validate() error {
+	switch {
+	case c.TotalTransactions <= 0:
+		return errors.New("total_transactions should be positive")
+	case c.BlockCreatePeriod <= 0:
+		return errors.New("block_create_period should be positive")
+	case c.NumTransactionBlock < 0:
+		return errors.New("num_transaction_block should not be negative")
+	case c.AccessFrequencyPattern != RANDOM_ACCESS_PATTERN && c.AccessFrequencyPattern != EXPONENTIAL_ACCESS_PATTERN:
+		return fmt.Errorf("unknown access_frequency_pattern : %v", c.AccessFrequencyPattern)
+	case c.BasicUnitTime <= 0 || c.RateTSC <= 0:
+		return errors.New("basic_unit_time and rate_tsc should be positive")
+	case c.LambdaED <= 0 || math.IsInf(float64(c.LambdaED), 0):
+		return errors.New("lambda_ed should be positive")
+	case c.NumSC < 1 || MAX_SC < c.NumSC:
+		return fmt.Errorf("num_sc should be 1 to %v", MAX_SC)
+	case c.NumSCPeer < 1 || MAX_SC_PEER < c.NumSCPeer:
+		return fmt.Errorf("num_sc_peer should be 1 to %v", MAX_SC_PEER)
+	case len(c.ProbabilityFactors) < c.NumSC-1:
+		return fmt.Errorf("probability_factors should have %v values at least", c.NumSC-1)
+	case c.Finality <= 0:
+		return errors.New("finality should be positive")
+	case c.RetargetWindow <= 0 || c.Finality*2 < c.RetargetWindow:
+		return fmt.Errorf("retarget_window should be 1 to %v", c.Finality*2)
+	}
+
+	for _, p := range c.ProbabilityFactors {
+		if p <= 0 {
+			return errors.New("probability_factors should be positive")
+		}
+	}
+
+	if len(c.EvictionPolicy) < c.NumSC-1 || len(c.CacheObjects) < c.NumSC-1 || len(c.CacheBytes) < c.NumSC-1 {
+		return fmt.Errorf("eviction_policy, cache_objects and cache_bytes should have %v values at least", c.NumSC-1)
+	}
+
+	for i := 0; i < c.NumSC-1; i++ {
+		switch c.EvictionPolicy[i] {
+		case EVICTION_TIME, EVICTION_LRU, EVICTION_LFU, EVICTION_ARC, EVICTION_SIZE:
+		default:
+			return fmt.Errorf("unknown eviction_policy : %v", c.EvictionPolicy[i])
+		}
+
+		if c.CacheObjects[i] <= 0 || c.CacheBytes[i] <= 0 {
+			return errors.New("cache_objects and cache_bytes should be positive")
+		}
+	}
+
+	if c.ErasureDataShards < 1 || c.ErasureParityShards < 0 || 256 < c.ErasureDataShards+c.ErasureParityShards {
+		return errors.New("erasure_data_shards + erasure_parity_shards should be up to 256")
+	}
+
+	if c.ReplicationFactor < 0 || MAX_SC_PEER < c.ReplicationFactor || c.AuditPeriod <= 0 {
+		return fmt.Errorf("replication_factor should be 0 to %v and audit_period should be positive", MAX_SC_PEER)
+	}
+
+	if c.QueryFanout < 1 || MAX_SC_PEER < c.QueryFanout || c.QueryTimeout <= 0 || c.HedgeDelay < 0 {
+		return fmt.Errorf("query_fanout should be 1 to %v, query_timeout should be positive and hedge_delay should not be negative", MAX_SC_PEER)
+	}
+
+	if c.WireCodec != CODEC_JSON && c.WireCodec != CODEC_BINARY {
+		return fmt.Errorf("unknown wire_codec : %v", c.WireCodec)
+	}
+
+	if c.GossipFanout < 1 || MAX_SC*MAX_SC_PEER < c.GossipFanout {
+		return fmt.Errorf("gossip_fanout should be 1 to %v", MAX_SC*MAX_SC_PEER)
+	}
+
+	if len(c.QuotaBytes) < c.NumSC {
+		return fmt.Errorf("quota_bytes should have %v values at least", c.NumSC)
+	}
+
+	for _, q := range c.QuotaBytes {
+		if q < 0 {
+			return errors.New("quota_bytes should not be negative")
+		}
+	}
+
+	return nil
+}
+
+// LoadConfig reads the JSON file, fields not in the file keep default values
+func LoadConfig(path string) (*Config, error) {
+	c := DefaultConfig()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, err
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	c.derive()
+
+	return c, nil
+}
+
+// SetConfig replaces the config if it is valid.
+// The config should not be changed after it is set because other goroutines read it.
+func SetConfig(c *Config) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+
+	n := *c
+	n.ProbabilityFactors = append([]float32{}, c.ProbabilityFactors...)
+	n.EvictionPolicy = append([]string{}, c.EvictionPolicy...)
+	n.CacheObjects = append([]int{}, c.CacheObjects...)
+	n.CacheBytes = append([]int{}, c.CacheBytes...)
+	n.QuotaBytes = append([]int{}, c.QuotaBytes...)
+	n.derive()
+
+	cfgMutex.Lock()
+	defer cfgMutex.Unlock()
+	cfg = &n
+
+	return nil
+}
+
+// ConfigInst returns the current config, DefaultConfig if it is not set
+func ConfigInst() *Config {
+	cfgMutex.Lock()
+	defer cfgMutex.Unlock()
+
+	if cfg == nil {
+		cfg = DefaultConfig()
+	}
+
+	return cfg
+}
+
+// AddFlags registers flags of the config, it should be called before flag.Parse()
+func AddFlags() {
+	d := DefaultConfig()
+	cfgPath = flag.String("config", "", "Experiment config file(JSON), flags below override it")
+	cfgFlags["total_tx"] = flag.Int("total_tx", d.TotalTransactions, "Total transactions")
+	cfgFlags["block_period"] = flag.Int("block_period", d.BlockCreatePeriod, "Block create period(second)")
+	cfgFlags["tx_per_block"] = flag.Int("tx_per_block", d.NumTransactionBlock, "The number of transactions in a block, 0 for random")
+	cfgFlags["access_pattern"] = flag.String("access_pattern", d.AccessFrequencyPattern, "Random_Distribution or Exponential_Distribution")
+	cfgFlags["lambda"] = flag.Float64("lambda", float64(d.LambdaED), "Lambda for exponential distribution")
+	cfgFlags["num_sc"] = flag.Int("num_sc", d.NumSC, "The number of storage classes")
+	cfgFlags["sc_peers"] = flag.Int("sc_peers", d.NumSCPeer, "The number of peers for each storage class")
+	cfgFlags["finality"] = flag.Int("finality", d.Finality, "Finality in blocks")
+	cfgFlags["erasure"] = flag.Bool("erasure", d.ErasureCoding, "Erasure coding of block bodies in the highest storage class")
+	cfgFlags["replicas"] = flag.Int("replicas", d.ReplicationFactor, "Replication factor of the highest storage class, 0 for all nodes")
+	cfgFlags["routing"] = flag.Bool("routing", d.ContentRouting, "Find objects by provider records before walking storage classes")
+	cfgFlags["fanout"] = flag.Int("fanout", d.QueryFanout, "The number of nodes queried in parallel for an object")
+	cfgFlags["query_timeout"] = flag.Int("query_timeout", d.QueryTimeout, "Timeout of an object query(millisecond)")
+	cfgFlags["hedge_delay"] = flag.Int("hedge_delay", d.HedgeDelay, "Delay to query the next nodes(millisecond), 0 disables hedging")
+	cfgFlags["codec"] = flag.String("codec", d.WireCodec, "Codec of messages to peers, JSON or BINARY(binary envelope around a JSON payload)")
+	cfgFlags["gossip_fanout"] = flag.Int("gossip_fanout", d.GossipFanout, "The number of peers new blocks and transactions are announced to")
+}
+
+// LoadFlags loads the config file and applies flags given explicitly, it should be called after flag.Parse()
+func LoadFlags() error {
+	c := DefaultConfig()
+	if cfgPath != nil && *cfgPath != "" {
+		var err error
+		if c, err = LoadConfig(*cfgPath); err != nil {
+			return err
+		}
+	}
+
+	flag.Visit(func(f *flag.Flag) {
+		v, ok := cfgFlags[f.Name]
+		if !ok {
+			return
+		}
+
+		switch f.Name {
+		case "total_tx":
+			c.TotalTransactions = *v.(*int)
+		case "block_period":
+			c.BlockCreatePeriod = *v.(*int)
+		case "tx_per_block":
+			c.NumTransactionBlock = *v.(*int)
+		case "access_pattern":
+			c.AccessFrequencyPattern = *v.(*string)
+		case "lambda":
+			c.LambdaED = float32(*v.(*float64))
+		case "num_sc":
+			c.NumSC = *v.(*int)
+		case "sc_peers":
+			c.NumSCPeer = *v.(*int)
+		case "finality":
+			c.Finality = *v.(*int)
+		case "erasure":
+			c.ErasureCoding = *v.(*bool)
+		case "replicas":
+			c.ReplicationFactor = *v.(*int)
+		case "routing":
+			c.ContentRouting = *v.(*bool)
+		case "fanout":
+			c.QueryFanout = *v.(*int)
+		case "query_timeout":
+			c.QueryTimeout = *v.(*int)
+		case "hedge_delay":
+			c.HedgeDelay = *v.(*int)
+		case "codec":
+			c.WireCodec = *v.(*string)
+		case "gossip_fanout":
+			c.GossipFanout = *v.(*int)
+		}
+	})
+
+	if err := SetConfig(c); err != nil {
+		return err
+	}
+
+	log.Printf("Config : %v", ConfigInst())
+	return nil
+}
+
+// String is used for logging, access pattern is shorten
+func (c *Config) String() string {
+	return fmt.Sprintf("tx:%v period:%v tx/block:%v pattern:%v lambda:%v sc:%v peers:%v finality:%v tscx:%v",
+		c.TotalTransactions, c.BlockCreatePeriod, c.NumTransactionBlock, strings.Split(c.AccessFrequencyPattern, "_")[0],
+		c.LambdaED, c.NumSC, c.NumSCPeer, c.Finality, c.TSCX)
+}
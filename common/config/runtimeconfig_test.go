@@ -0,0 +1,66 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDefaultConfig(t *testing.T) {
+	c := DefaultConfig()
+	assert.Nil(t, c.Validate())
+
+	// Same values as the constants before
+	assert.Equal(t, MAX_SC, len(c.TSCX))
+	assert.InDelta(t, float32(10*20)*0.6931472/0.1, c.TSCX[0], 0.01)
+	assert.InDelta(t, float32(10*20)*2.7725887/0.1, c.TSCX[2], 0.01)
+	assert.Equal(t, float32(0), c.TSCX[MAX_SC-1])
+	assert.Equal(t, float32(0), c.TSC(MAX_SC))
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	data := `{"block_create_period": 2, "lambda_ed": 0.2, "num_sc": 2, "finality": 3, "retarget_window": 3}`
+	assert.Nil(t, os.WriteFile(path, []byte(data), 0644))
+
+	c, err := LoadConfig(path)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, c.BlockCreatePeriod)
+	assert.Equal(t, 40000, c.TotalTransactions)
+	assert.Equal(t, 2, len(c.TSCX))
+	assert.InDelta(t, float32(10*20)*0.6931472/0.2, c.TSCX[0], 0.01)
+	assert.Equal(t, float32(0), c.TSCX[1])
+
+	// Invalid values are rejected
+	data = `{"num_sc": 5}`
+	assert.Nil(t, os.WriteFile(path, []byte(data), 0644))
+	_, err = LoadConfig(path)
+	assert.NotNil(t, err)
+
+	data = `{"access_frequency_pattern": "Normal"}`
+	assert.Nil(t, os.WriteFile(path, []byte(data), 0644))
+	_, err = LoadConfig(path)
+	assert.NotNil(t, err)
+
+	_, err = LoadConfig(filepath.Join(t.TempDir(), "none.json"))
+	assert.NotNil(t, err)
+}
+
+func TestSetConfig(t *testing.T) {
+	defer SetConfig(DefaultConfig())
+
+	c := DefaultConfig()
+	c.Finality = 2
+	assert.NotNil(t, SetConfig(c)) // retarget window is too long
+	assert.Equal(t, 6, ConfigInst().Finality)
+
+	c.RetargetWindow = 3
+	assert.Nil(t, SetConfig(c))
+	assert.Equal(t, 2, ConfigInst().Finality)
+
+	// The config is copied
+	c.ProbabilityFactors[0] = 1
+	assert.InDelta(t, float32(10*20)*0.6931472/0.1, ConfigInst().TSCX[0], 0.01)
+}
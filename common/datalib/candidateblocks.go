@@ -1,8 +1,11 @@
 package datalib
 
 import (
+	"bytes"
 	"encoding/hex"
+	"fmt"
 	"log"
+	"math/big"
 	"sync"
 
 	"github.com/junwookheo/bcsos/common/blockchain"
@@ -14,72 +17,293 @@ type candblock struct {
 	blocks []*blockchain.Block
 }
 
+// Reorg is emitted when the best tip moves to other branch
+// Detached : blocks removed from the best chain, from the old tip to the fork point
+// Attached : blocks added to the best chain, from the fork point to the new tip
+type Reorg struct {
+	Detached []*blockchain.Block
+	Attached []*blockchain.Block
+}
+
 type CandidateBlocks struct {
 	mutex       sync.Mutex
-	capacity    int
 	maxheight   int
 	savedheight int
-	highest     *blockchain.Block
+	highest     *blockchain.Block // the tip of the heaviest chain
 	cands       []candblock
+	invalid     int                          // the number of rejected blocks
+	work        map[string]*big.Int          // cumulative work by block hash
+	tips        map[string]*blockchain.Block // blocks without child
+	listeners   []chan *Reorg                // queues of listeners
 }
 
+// SaveBlock stores finalised blocks, RemoveBlock is called for saved blocks detached by a reorg deeper than finality
 type SaveBlock interface {
 	AddBlock(b *blockchain.Block) int64
+	RemoveBlock(hash string) bool
+}
+
+// Validate checks the block against its parent in the candidate list.
+// If the node has no candidate yet, the block becomes the anchor and only its body is checked.
+// If the parent is unknown, ErrUnknownParent is returned only when the body is valid,
+// and it is not counted as an invalid block because the parent can be received later.
+func (q *CandidateBlocks) Validate(block *blockchain.Block) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	var err error
+	parent := q.findBlock(block.Header.PrvHash)
+	if parent != nil {
+		err = blockchain.ValidateBlock(block, &parent.Header)
+	} else if block.Header.Height == 0 || q.maxheight == -1 {
+		if block.Header.Height == 0 {
+			err = blockchain.ValidateBlock(block, nil)
+		} else {
+			err = blockchain.ValidateBlockBody(block)
+		}
+	} else if err = blockchain.ValidateBlockBody(block); err == nil {
+		return blockchain.ErrUnknownParent
+	}
+
+	if err == nil {
+		expected := blockchain.GetConsensus().NextDifficulty(nil, nil)
+		known := true
+		if parent != nil {
+			expected, known = q.nextDifficulty(parent)
+		} else if block.Header.Height != 0 {
+			known = false
+		}
+
+		if known && block.Header.Difficulty != expected {
+			err = fmt.Errorf("%w : %v, expected %v", blockchain.ErrBadDifficulty, block.Header.Difficulty, expected)
+		}
+	}
+
+	if err != nil {
+		q.invalid++
+	}
+
+	return err
+}
+
+// nextDifficulty returns the difficulty of the child of parent,
+// false if the first block of the retarget window is not in the candidate list
+func (q *CandidateBlocks) nextDifficulty(parent *blockchain.Block) (int, bool) {
+	height := blockchain.RetargetAncestor(parent.Header.Height + 1)
+	if height == -1 {
+		return parent.Header.Difficulty, true
+	}
+
+	first := parent
+	for first != nil && height < first.Header.Height {
+		first = q.findBlock(first.Header.PrvHash)
+	}
+
+	if first == nil {
+		return parent.Header.Difficulty, false
+	}
+
+	return blockchain.GetConsensus().NextDifficulty(&parent.Header, &first.Header), true
 }
 
+// NextDifficulty returns the difficulty of a new block on the block of the hash
+func (q *CandidateBlocks) NextDifficulty(hash []byte) int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	parent := q.findBlock(hash)
+	if parent == nil {
+		return blockchain.GetConsensus().NextDifficulty(nil, nil)
+	}
+
+	difficulty, _ := q.nextDifficulty(parent)
+	return difficulty
+}
+
+// GetBlock returns the block in the candidate list, nil if not found
+func (q *CandidateBlocks) GetBlock(hash []byte) *blockchain.Block {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return q.findBlock(hash)
+}
+
+func (q *CandidateBlocks) findBlock(hash []byte) *blockchain.Block {
+	for i := len(q.cands); 0 < i; i-- {
+		for _, b := range q.cands[i-1].blocks {
+			if bytes.Equal(b.Header.Hash, hash) {
+				return b
+			}
+		}
+	}
+
+	return nil
+}
+
+// GetInvalidBlocks returns the number of blocks rejected by Validate
+func (q *CandidateBlocks) GetInvalidBlocks() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return q.invalid
+}
+
+// AddReorgListener registers a channel to receive reorg events
+// Events are queued for each listener and delivered in order
+func (q *CandidateBlocks) AddReorgListener(ch chan *Reorg) {
+	queue := make(chan *Reorg, config.REORG_QUEUE_SIZE)
+	go func() {
+		for reorg := range queue {
+			ch <- reorg
+		}
+	}()
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.listeners = append(q.listeners, queue)
+}
+
+// notifyReorg is called with the mutex locked, so the event is dropped if the queue of a listener is full
+func (q *CandidateBlocks) notifyReorg(reorg *Reorg) {
+	for i, queue := range q.listeners {
+		select {
+		case queue <- reorg:
+		default:
+			log.Printf("Reorg queue of listener %v is full, event dropped", i)
+		}
+	}
+}
+
+// Remove the oldest height from the candidate list
+func (q *CandidateBlocks) prune() {
+	for _, b := range q.cands[0].blocks {
+		hash := hex.EncodeToString(b.Header.Hash)
+		delete(q.work, hash)
+		delete(q.tips, hash)
+	}
+	q.cands = q.cands[1:len(q.cands)]
+}
+
+// findFork walks back from two tips to their common ancestor
+// If the common ancestor is out of the candidate list, it stops at the oldest known block
+func (q *CandidateBlocks) findFork(oldtip *blockchain.Block, newtip *blockchain.Block) ([]*blockchain.Block, []*blockchain.Block) {
+	var detached, attached []*blockchain.Block
+
+	for oldtip != nil && newtip != nil && !bytes.Equal(oldtip.Header.Hash, newtip.Header.Hash) {
+		if newtip.Header.Height <= oldtip.Header.Height {
+			detached = append(detached, oldtip)
+			oldtip = q.findBlock(oldtip.Header.PrvHash)
+		} else {
+			attached = append([]*blockchain.Block{newtip}, attached...)
+			newtip = q.findBlock(newtip.Header.PrvHash)
+		}
+	}
+
+	return detached, attached
+}
+
+// PushAndSave adds the block to the candidate list and chooses the heaviest chain.
+// Blocks on the heaviest chain are saved when they are FINALITY deep.
 func (q *CandidateBlocks) PushAndSave(block *blockchain.Block, sb SaveBlock) bool {
-	dif := block.Header.Height - q.maxheight
 	q.mutex.Lock()
 	defer q.mutex.Unlock()
 
-	if q.highest == nil {
-		q.highest = block
-	} else if q.highest.Header.Height < block.Header.Height {
-		q.highest = block
+	hash := hex.EncodeToString(block.Header.Hash)
+	if _, ok := q.work[hash]; ok {
+		return false
 	}
-	// log.Printf("Highest(%v) : %v", q.highest.Header.Height, hex.EncodeToString(q.highest.Header.Hash))
 
-	// Append new block to the end of list.
+	if q.maxheight == -1 {
+		q.maxheight = block.Header.Height - 1
+	}
+
+	// Append new heights to the end of list.
+	dif := block.Header.Height - q.maxheight
 	for i := 0; i < dif; i++ {
-		if len(q.cands) == q.capacity {
-			q.cands = q.cands[1:len(q.cands)]
+		// Finality can be changed by the config from the simulator
+		for 0 < len(q.cands) && config.ConfigInst().Finality*2 <= len(q.cands) {
+			q.prune()
 		}
 
 		q.maxheight++
-		cand := candblock{q.maxheight + i, nil}
-		q.cands = append(q.cands, cand)
+		q.cands = append(q.cands, candblock{q.maxheight, nil})
 	}
 
+	found := false
 	for i := len(q.cands); 0 < i; i-- {
 		if q.cands[i-1].height == block.Header.Height {
 			q.cands[i-1].blocks = append(q.cands[i-1].blocks, block)
+			found = true
 			break
 		}
 	}
 
-	prehash := hex.EncodeToString(block.Header.Hash)
-	savedheight := q.savedheight
-	for i := len(q.cands); 0 < i; i-- {
-		for _, b := range q.cands[i-1].blocks {
-			if hex.EncodeToString(b.Header.Hash) == prehash {
-				prehash = hex.EncodeToString(b.Header.PrvHash)
-				if q.savedheight < b.Header.Height && b.Header.Height <= q.maxheight-config.FINALITY {
-					// log.Printf("Save block(%v) : %v", b.Header.Height, hex.EncodeToString(b.Header.Hash))
-					sb.AddBlock(b)
-					if savedheight < b.Header.Height {
-						savedheight = b.Header.Height
-					}
+	if !found {
+		log.Printf("Too old block(%v) : %v", block.Header.Height, hash)
+		return false
+	}
+
+	work := block.Header.Work()
+	prehash := hex.EncodeToString(block.Header.PrvHash)
+	if pwork, ok := q.work[prehash]; ok {
+		work.Add(work, pwork)
+		delete(q.tips, prehash)
+	}
+	q.work[hash] = work
+	q.tips[hash] = block
+
+	// The first seen block wins if the work is same
+	if q.highest == nil {
+		q.highest = block
+	} else if hwork, ok := q.work[hex.EncodeToString(q.highest.Header.Hash)]; !ok || hwork.Cmp(work) == -1 {
+		old := q.highest
+		q.highest = block
+		if !bytes.Equal(block.Header.PrvHash, old.Header.Hash) {
+			detached, attached := q.findFork(old, block)
+			log.Printf("Reorg(%v) : detached %v, attached %v", block.Header.Height, len(detached), len(attached))
+			// Saved blocks are removed, so the attached blocks are saved instead of them
+			for _, b := range detached {
+				if b.Header.Height <= q.savedheight {
+					log.Printf("Reorg deeper than finality(%v) : %v", b.Header.Height, hex.EncodeToString(b.Header.Hash))
+					sb.RemoveBlock(hex.EncodeToString(b.Header.Hash))
+					q.savedheight = b.Header.Height - 1
 				}
-				break
 			}
+			q.notifyReorg(&Reorg{detached, attached})
+		}
+	}
+	// log.Printf("Highest(%v) : %v", q.highest.Header.Height, hex.EncodeToString(q.highest.Header.Hash))
+
+	// Save blocks of the heaviest chain from the lowest
+	var saves []*blockchain.Block
+	for b := q.highest; b != nil && q.savedheight < b.Header.Height; b = q.findBlock(b.Header.PrvHash) {
+		if b.Header.Height <= q.highest.Header.Height-config.ConfigInst().Finality {
+			saves = append([]*blockchain.Block{b}, saves...)
 		}
 	}
 
-	q.savedheight = savedheight
+	for _, b := range saves {
+		// log.Printf("Save block(%v) : %v", b.Header.Height, hex.EncodeToString(b.Header.Hash))
+		sb.AddBlock(b)
+		q.savedheight = b.Header.Height
+	}
 
 	return true
 }
 
+// GetLowestHeight returns the lowest height kept in the candidate list, -1 if empty
+func (q *CandidateBlocks) GetLowestHeight() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if len(q.cands) == 0 {
+		return -1
+	}
+
+	return q.cands[0].height
+}
+
 func (q *CandidateBlocks) GetHighestBlockHash() (int, string) {
 	q.mutex.Lock()
 	defer q.mutex.Unlock()
@@ -102,57 +326,45 @@ func (q *CandidateBlocks) ShowAll() {
 
 	}
 
+	for hash, b := range q.tips {
+		log.Printf("Tip(%v) : %v - work %v", b.Header.Height, hash, q.work[hash])
+	}
 }
 
 // This is to check whether Finality is long enough.
-// If finality is short, panic will happen.
+// If a competing tip forks deeper than FINALITY from the heaviest chain, it is reported.
 func (q *CandidateBlocks) CheckFinality() {
 	q.mutex.Lock()
 	defer q.mutex.Unlock()
 
-	if len(q.cands) <= config.FINALITY {
-		return
-	}
-
-	cand := q.cands[len(q.cands)-1]
-	highests := cand.blocks
-	saved := ""
-
-	if len(highests) == 1 {
+	if q.highest == nil {
 		return
 	}
 
-	for _, hblock := range highests {
-		// log.Printf("highest hash(%v) : %v", hblock.Header.Height, hex.EncodeToString(hblock.Header.Hash))
-		hash := hex.EncodeToString(hblock.Header.PrvHash)
-		height := hblock.Header.Height
-		for i := len(q.cands) - 1; len(q.cands)-config.FINALITY < i; i-- {
-			for _, b := range q.cands[i-1].blocks {
-				if hex.EncodeToString(b.Header.Hash) == hash {
-					hash = hex.EncodeToString(b.Header.PrvHash)
-					height = b.Header.Height
-					break
-				}
-			}
+	for hash, tip := range q.tips {
+		if tip == q.highest {
+			continue
 		}
-		// log.Printf("hash(%v) : %v", height-1, hash)
-		if saved != "" && saved != hash {
-			log.Panicf("Finality Error(%v-%v) : %v %v", hblock.Header.Height, height, saved, hash)
+
+		detached, _ := q.findFork(q.highest, tip)
+		if config.ConfigInst().Finality < len(detached) {
+			log.Printf("Finality Error(%v-%v) : %v %v", q.highest.Header.Height, tip.Header.Height, hex.EncodeToString(q.highest.Header.Hash), hash)
 		}
-		saved = hash
 	}
-
 }
 
 func NewCandidateBlocks() *CandidateBlocks {
-	capacity := config.FINALITY * 2
+	capacity := config.ConfigInst().Finality * 2
 
 	cbs := CandidateBlocks{
-		capacity:    capacity,
 		maxheight:   -1,
 		savedheight: -1,
 		highest:     nil,
 		cands:       make([]candblock, 0, capacity),
+		invalid:     0,
+		work:        make(map[string]*big.Int),
+		tips:        make(map[string]*blockchain.Block),
+		listeners:   nil,
 	}
 
 	return &cbs
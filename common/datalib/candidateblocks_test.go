@@ -0,0 +1,111 @@
+package datalib
+
+import (
+	"encoding/hex"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/junwookheo/bcsos/common/blockchain"
+	"github.com/junwookheo/bcsos/common/wallet"
+	"github.com/stretchr/testify/assert"
+)
+
+type saveBlockTest struct {
+	blocks  []*blockchain.Block
+	removed []string
+}
+
+func (s *saveBlockTest) AddBlock(b *blockchain.Block) int64 {
+	s.blocks = append(s.blocks, b)
+	return int64(len(s.blocks))
+}
+
+func (s *saveBlockTest) RemoveBlock(hash string) bool {
+	s.removed = append(s.removed, hash)
+	return true
+}
+
+func TestCandidateBlocksReorg(t *testing.T) {
+	wallet_path := "./wallet_test.wallet"
+	w := wallet.NewWallet(wallet_path)
+	defer os.Remove(wallet_path)
+
+	crbl := func(s string, prv *blockchain.Block) *blockchain.Block {
+		trs := []*blockchain.Transaction{blockchain.CreateTransaction(w, []byte(s))}
+		if prv == nil {
+			return blockchain.CreateBlock(trs, nil, 0)
+		}
+		return blockchain.CreateBlock(trs, prv.Header.Hash, prv.Header.Height+1)
+	}
+
+	cand := NewCandidateBlocks()
+	sb := saveBlockTest{}
+	reorgs := make(chan *Reorg)
+	cand.AddReorgListener(reorgs)
+
+	b0 := crbl("genesis", nil)
+	a1 := crbl("a1", b0)
+	a2 := crbl("a2", a1)
+	b1 := crbl("b1", b0)
+	b2 := crbl("b2", b1)
+	b3 := crbl("b3", b2)
+
+	for _, b := range []*blockchain.Block{b0, a1, a2, b1, b2} {
+		assert.Nil(t, cand.Validate(b))
+		assert.True(t, cand.PushAndSave(b, &sb))
+	}
+	assert.False(t, cand.PushAndSave(a2, &sb))
+
+	// Same work, the first seen tip is kept
+	_, hash := cand.GetHighestBlockHash()
+	assert.Equal(t, hex.EncodeToString(a2.Header.Hash), hash)
+
+	assert.Nil(t, cand.Validate(b3))
+	cand.PushAndSave(b3, &sb)
+	height, hash := cand.GetHighestBlockHash()
+	assert.Equal(t, 3, height)
+	assert.Equal(t, hex.EncodeToString(b3.Header.Hash), hash)
+
+	// Heaviest chain is saved after FINALITY
+	var cs []*blockchain.Block
+	prv := b3
+	for i := 0; i < 6; i++ {
+		prv = crbl("c", prv)
+		cs = append(cs, prv)
+		cand.PushAndSave(prv, &sb)
+	}
+	assert.Equal(t, []*blockchain.Block{b0, b1, b2, b3}, sb.blocks)
+	assert.Equal(t, 0, cand.GetInvalidBlocks())
+
+	// A reorg deeper than FINALITY removes saved blocks and saves the new chain
+	var ds []*blockchain.Block
+	d := a2
+	for i := 0; i < 8; i++ {
+		d = crbl("d", d)
+		ds = append(ds, d)
+		cand.PushAndSave(d, &sb)
+	}
+	_, hash = cand.GetHighestBlockHash()
+	assert.Equal(t, hex.EncodeToString(d.Header.Hash), hash)
+	assert.Equal(t, []string{hex.EncodeToString(b3.Header.Hash), hex.EncodeToString(b2.Header.Hash), hex.EncodeToString(b1.Header.Hash)}, sb.removed)
+	assert.Equal(t, []*blockchain.Block{a1, a2}, sb.blocks[4:6])
+
+	// Events are delivered in order
+	var detached []*blockchain.Block
+	for i := len(cs); 0 < i; i-- {
+		detached = append(detached, cs[i-1])
+	}
+	expected := []Reorg{
+		{Detached: []*blockchain.Block{a2, a1}, Attached: []*blockchain.Block{b1, b2, b3}},
+		{Detached: append(detached, b3, b2, b1), Attached: append([]*blockchain.Block{a1, a2}, ds...)},
+	}
+	for _, e := range expected {
+		select {
+		case reorg := <-reorgs:
+			assert.Equal(t, e, *reorg)
+		case <-time.After(time.Second):
+			assert.Fail(t, "no reorg event")
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package datalib
+
+import (
+	"bytes"
+	"encoding/hex"
+	"sync"
+
+	"github.com/junwookheo/bcsos/common/blockchain"
+	"github.com/junwookheo/bcsos/common/config"
+)
+
+// OrphanBlocks keeps blocks whose parent is not received yet.
+// If the pool is full, the oldest orphan is dropped.
+type OrphanBlocks struct {
+	mutex    sync.Mutex
+	capacity int // 0 follows Finality*2 of the config
+	orphans  map[string]*blockchain.Block
+	order    []string // hashes in received order
+}
+
+// Add returns false if the block already exists
+func (o *OrphanBlocks) Add(b *blockchain.Block) bool {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	hash := hex.EncodeToString(b.Header.Hash)
+	if _, ok := o.orphans[hash]; ok {
+		return false
+	}
+
+	// Finality can be changed by the config from the simulator
+	capacity := o.capacity
+	if capacity == 0 {
+		capacity = config.ConfigInst().Finality * 2
+	}
+	for 0 < len(o.order) && capacity <= len(o.order) {
+		delete(o.orphans, o.order[0])
+		o.order = o.order[1:]
+	}
+
+	o.orphans[hash] = b
+	o.order = append(o.order, hash)
+
+	return true
+}
+
+// PopChildren removes and returns orphans whose parent is the hash
+func (o *OrphanBlocks) PopChildren(hash []byte) []*blockchain.Block {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	var children []*blockchain.Block
+	order := []string{}
+	for _, h := range o.order {
+		b := o.orphans[h]
+		if bytes.Equal(b.Header.PrvHash, hash) {
+			children = append(children, b)
+			delete(o.orphans, h)
+		} else {
+			order = append(order, h)
+		}
+	}
+	o.order = order
+
+	return children
+}
+
+func (o *OrphanBlocks) Len() int {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	return len(o.order)
+}
+
+// NewOrphanBlocks creates the pool, capacity 0 reads Finality*2 of the config when a block is added
+func NewOrphanBlocks(capacity int) *OrphanBlocks {
+	return &OrphanBlocks{
+		capacity: capacity,
+		orphans:  make(map[string]*blockchain.Block),
+		order:    []string{},
+	}
+}
@@ -0,0 +1,45 @@
+package datalib
+
+import (
+	"testing"
+
+	"github.com/junwookheo/bcsos/common/blockchain"
+	"github.com/junwookheo/bcsos/common/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOrphanBlocks(t *testing.T) {
+	crbl := func(hash string, prv string) *blockchain.Block {
+		return &blockchain.Block{Header: blockchain.BlockHeader{Hash: []byte(hash), PrvHash: []byte(prv)}}
+	}
+
+	o := NewOrphanBlocks(3)
+	assert.True(t, o.Add(crbl("b1", "a")))
+	assert.True(t, o.Add(crbl("c1", "b")))
+	assert.True(t, o.Add(crbl("b2", "a")))
+	assert.False(t, o.Add(crbl("b2", "a")))
+	assert.Equal(t, 3, o.Len())
+
+	children := o.PopChildren([]byte("a"))
+	assert.Equal(t, 2, len(children))
+	assert.Equal(t, []byte("b1"), children[0].Header.Hash)
+	assert.Equal(t, 1, o.Len())
+
+	// The oldest is dropped if full
+	o.Add(crbl("d1", "c"))
+	o.Add(crbl("d2", "c"))
+	o.Add(crbl("d3", "c"))
+	assert.Equal(t, 0, len(o.PopChildren([]byte("b"))))
+	assert.Equal(t, 3, len(o.PopChildren([]byte("c"))))
+
+	// The capacity follows the config changed after the pool is created
+	defer config.SetConfig(config.DefaultConfig())
+	o = NewOrphanBlocks(0)
+	c := config.DefaultConfig()
+	c.Finality, c.RetargetWindow = 1, 2
+	assert.Nil(t, config.SetConfig(c))
+	for _, h := range []string{"e1", "e2", "e3"} {
+		o.Add(crbl(h, "e"))
+	}
+	assert.Equal(t, 2, o.Len())
+}
@@ -4,6 +4,7 @@ import (
 	"time"
 
 	"github.com/junwookheo/bcsos/common/blockchain"
+	"github.com/junwookheo/bcsos/common/dtype"
 )
 
 type DBAgent interface {
@@ -15,16 +16,31 @@ type DBAgent interface {
 	AddTransaction(t *blockchain.Transaction) int64
 	GetTransaction(hash string, t *blockchain.Transaction) int64
 	AddBlock(b *blockchain.Block) int64
+	RemoveBlock(hash string) bool
+	AddBlockIndex(h *blockchain.BlockHeader, trhashes []string, actime int64) int64
+	GetBlockIndex(hash string, h *blockchain.BlockHeader, trhashes *[]string) int64
 	GetBlock(hash string, b *blockchain.Block) int64
+	GetBlockTransactionMatching(bh string, hashes *[]string) int
+	GetBlockHashOfObject(hash string) (string, int)
 	ShowAllObjets() bool
 	GetDBDataSize() uint64
 	GetDBStatus() *DBStatus
 	GetTransactionwithUniform(num int, hashes *[]RemoverbleObj) bool
 	GetTransactionwithExponential(num int, hashes *[]RemoverbleObj) bool
 	DeleteNoAccedObjects()
+	GetCachedObjects(objs *[]CachedObj) bool
+	AddAccessLog(l *AccessLog)
+	AddShard(s *dtype.Shard) int64
+	GetShard(blockhash string, index int, s *dtype.Shard) int64
+	GetObjectData(hash string) (string, []byte)
+	GetHotObjects(num int, stats *[]dtype.ObjectStat) bool
+	GetHitRatio(ratios *[]dtype.SCHitRatio) bool
+	GetRoutingStats(stats *[]dtype.RoutingStat) bool
+	AddPoSAudit(p *PoSAudit)
+	GetReputation(prover string, reps *[]dtype.Reputation) bool
 	UpdateDBNetworkQuery(fromqc int, toqc int, totalqc int)
 	UpdateDBNetworkDelay(addtime int, hop int)
-	ProofStorage(tidx [32]byte, timestamp int64, tsc int) []byte
+	ProofStorage(blockhash string, indices []int, leaves *[]dtype.PoSLeaf) int
 	ProofStorage2()
 }
 
@@ -62,6 +78,44 @@ type DBStatus struct {
 	Hop3              int
 }
 
+// CachedObj has access information of an object for eviction policies
+type CachedObj struct {
+	Type   string
+	Hash   string
+	Size   int
+	ACTime int64 // the latest access time
+	Count  int   // the number of access
+}
+
+// AccessLog is an access to an object
+// A local access is written when local storage is read, and a remote access follows if it is queried to other nodes.
+type AccessLog struct {
+	Timestamp int64
+	Hash      string
+	Type      string
+	Hit       bool   // found in local storage or other nodes for a remote access
+	Remote    bool   // queried to other nodes after a miss
+	SC        int    // the storage class served the object, -1 if not found
+	Hop       int    // 0 for a local access
+	Requester string // address of the node requested the object
+	Routing   string // routing mode of a remote access
+	Messages  int    // the number of nodes queried for a remote access including relays
+	Peer      string // hash of the node answered a remote access
+	Latency   int64  // nanosecond from the request to the peer to its answer
+}
+
+// PoSAudit is a result of Proof of Storage requested by the challenger
+type PoSAudit struct {
+	Timestamp  int64
+	Challenger string
+	Prover     string
+	SC         int
+	BlockHash  string
+	Result     bool
+	Latency    int64  // nanosecond from the challenge to the response
+	Reason     string // error of the proof if it failed
+}
+
 type RemoverbleObj struct {
 	HashType int // blockheader == 0 otherwise transaction
 	Hash     string
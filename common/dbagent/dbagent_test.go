@@ -1,12 +1,16 @@
 package dbagent
 
 import (
+	"bytes"
+	"encoding/gob"
 	"encoding/hex"
 	"log"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/junwookheo/bcsos/common/blockchain"
+	"github.com/junwookheo/bcsos/common/dtype"
 	"github.com/junwookheo/bcsos/common/wallet"
 	"github.com/stretchr/testify/assert"
 )
@@ -84,6 +88,162 @@ func TestDBSqliteAdd(t *testing.T) {
 	os.Remove(wallet_path)
 }
 
+func TestDBSqliteMigrate(t *testing.T) {
+	path := "test_migrate.db"
+	wallet_path := "./wallet_test.wallet"
+	defer os.Remove(path)
+	defer os.Remove(wallet_path)
+
+	w := wallet.NewWallet(wallet_path)
+	tr := blockchain.CreateTransaction(w, []byte("gob transaction"))
+	hash := hex.EncodeToString(tr.Hash)
+
+	// A row written with gob before the canonical encoding
+	type oldTransaction struct {
+		Hash      []byte
+		Timestamp int64
+		Data      []byte
+		Signature []byte
+		PubKey    []byte
+	}
+	var buf bytes.Buffer
+	gob.NewEncoder(&buf).Encode(oldTransaction{tr.Hash, tr.Timestamp, tr.Data, tr.Signature, tr.PubKey})
+
+	dba := NewDBAgent(path)
+	dba.(*dbagent).db.Exec("INSERT INTO bcobjects (type, hash, timestamp, data) VALUES (?, ?, ?, ?)", "transaction", hash, tr.Timestamp, buf.Bytes())
+	// A corrupt row is skipped
+	dba.(*dbagent).db.Exec("INSERT INTO bcobjects (type, hash, timestamp, data) VALUES (?, ?, ?, ?)", "transaction", "corrupt", tr.Timestamp, []byte("corrupt"))
+
+	tr2 := blockchain.Transaction{}
+	assert.NotEqual(t, int64(0), dba.GetTransaction(hash, &tr2))
+	assert.Equal(t, *tr, tr2)
+	assert.Equal(t, 1, dba.(*dbagent).migrateObjects())
+	assert.Equal(t, 0, dba.(*dbagent).migrateObjects())
+
+	var data []byte
+	dba.(*dbagent).db.QueryRow("SELECT data FROM bcobjects WHERE hash = ?", hash).Scan(&data)
+	assert.True(t, blockchain.IsCanonical(data))
+
+	tr2 = blockchain.Transaction{}
+	dba.GetTransaction(hash, &tr2)
+	assert.Equal(t, *tr, tr2)
+	dba.Close()
+}
+
+func TestDBSqliteRemoveBlock(t *testing.T) {
+	path := "removeblock_test.db"
+	wallet_path := "./wallet_test.wallet"
+	defer os.Remove(path)
+	defer os.Remove(wallet_path)
+
+	w := wallet.NewWallet(wallet_path)
+	dba := NewDBAgent(path)
+	defer dba.Close()
+
+	var trs []*blockchain.Transaction
+	for _, s := range []string{"detached", "shared", "kept"} {
+		trs = append(trs, blockchain.CreateTransaction(w, []byte(s)))
+	}
+	detached := blockchain.CreateBlock(trs[:2], nil, 1)
+	kept := blockchain.CreateBlock(trs[1:], []byte("other"), 1)
+	dba.AddBlock(detached)
+	dba.AddBlock(kept)
+
+	// Transactions of the other block are kept
+	assert.True(t, dba.RemoveBlock(hex.EncodeToString(detached.Header.Hash)))
+	b := blockchain.Block{}
+	assert.Equal(t, int64(0), dba.GetBlock(hex.EncodeToString(detached.Header.Hash), &b))
+	assert.NotEqual(t, int64(0), dba.GetBlock(hex.EncodeToString(kept.Header.Hash), &b))
+	tr := blockchain.Transaction{}
+	assert.Equal(t, int64(0), dba.GetTransaction(hex.EncodeToString(trs[0].Hash), &tr))
+	assert.NotEqual(t, int64(0), dba.GetTransaction(hex.EncodeToString(trs[1].Hash), &tr))
+}
+
+func TestDBSqliteAccessLog(t *testing.T) {
+	path := "accesslog_test.db"
+	wallet_path := "./wallet_test.wallet"
+	defer os.Remove(path)
+	defer os.Remove(wallet_path)
+
+	w := wallet.NewWallet(wallet_path)
+	dba := NewDBAgent(path)
+	defer dba.Close()
+
+	tr := blockchain.CreateTransaction(w, []byte("accesslog"))
+	hash := hex.EncodeToString(tr.Hash)
+	dba.AddTransaction(tr)
+
+	// Adding does not count as an access
+	stats := []dtype.ObjectStat{}
+	assert.True(t, dba.GetHotObjects(10, &stats))
+	assert.Equal(t, 0, len(stats))
+
+	// Internal reads are not logged, accesses are logged by the query path
+	tr2 := blockchain.Transaction{}
+	dba.GetTransaction(hash, &tr2)
+	assert.True(t, dba.GetHotObjects(10, &stats))
+	assert.Equal(t, 0, len(stats))
+
+	sc := dba.(*dbagent).SClass
+	now := time.Now().UnixNano()
+	dba.AddAccessLog(&AccessLog{Timestamp: now, Hash: hash, Type: "transaction", Hit: true, SC: sc})
+	dba.AddAccessLog(&AccessLog{Timestamp: now, Hash: hash, Type: "transaction", Hit: true, SC: sc})
+	dba.AddAccessLog(&AccessLog{Timestamp: now, Hash: "none", Type: "transaction", Hit: false, SC: -1})
+	dba.AddAccessLog(&AccessLog{Hash: "none", Type: "transaction", Hit: true, Remote: true, SC: sc + 1, Hop: 1})
+
+	assert.True(t, dba.GetHotObjects(1, &stats))
+	assert.Equal(t, 1, len(stats))
+	assert.Equal(t, hash, stats[0].Hash)
+	assert.Equal(t, 2, stats[0].Hits)
+
+	stats = []dtype.ObjectStat{}
+	dba.GetHotObjects(10, &stats)
+	assert.Equal(t, 2, len(stats))
+	assert.Equal(t, 1, stats[1].Misses)
+	assert.Equal(t, 1, stats[1].Remote)
+	assert.Equal(t, sc+1, stats[1].LastSC)
+
+	ratios := []dtype.SCHitRatio{}
+	assert.True(t, dba.GetHitRatio(&ratios))
+	assert.Equal(t, []dtype.SCHitRatio{{SC: sc, Hits: 2, Total: 3, Ratio: 2.0 / 3}, {SC: sc + 1, Hits: 1, Total: 3, Ratio: 1.0 / 3}}, ratios)
+
+	// Remote accesses are compared by routing modes
+	dba.AddAccessLog(&AccessLog{Hash: "none", Type: "transaction", Hit: false, Remote: true, SC: -1, Routing: "provider", Messages: 4})
+	dba.AddAccessLog(&AccessLog{Hash: hash, Type: "transaction", Hit: true, Remote: true, SC: sc + 1, Routing: "provider", Messages: 2})
+	routing := []dtype.RoutingStat{}
+	assert.True(t, dba.GetRoutingStats(&routing))
+	assert.Equal(t, []dtype.RoutingStat{{Routing: "", Queries: 1, Found: 1, Messages: 0}, {Routing: "provider", Queries: 2, Found: 1, Messages: 3}}, routing)
+
+	// Old rows are removed and counters of objects are kept
+	assert.Equal(t, int64(3), dba.(*dbagent).pruneAccessLog(now))
+	assert.Equal(t, int64(3), dba.(*dbagent).pruneAccessLog(now+1))
+	stats = []dtype.ObjectStat{}
+	dba.GetHotObjects(10, &stats)
+	assert.Equal(t, 2, stats[0].Hits)
+}
+
+func TestDBSqlitePoSAudit(t *testing.T) {
+	path := "posaudit_test.db"
+	defer os.Remove(path)
+
+	dba := NewDBAgent(path)
+	defer dba.Close()
+
+	dba.AddPoSAudit(&PoSAudit{Timestamp: 1, Challenger: "c1", Prover: "p1", SC: 0, BlockHash: "b1", Result: true, Latency: 100})
+	dba.AddPoSAudit(&PoSAudit{Timestamp: 2, Challenger: "c1", Prover: "p1", SC: 0, BlockHash: "b2", Result: false, Latency: 300, Reason: "merkle proof error"})
+	dba.AddPoSAudit(&PoSAudit{Timestamp: 3, Challenger: "c1", Prover: "p2", SC: 1, BlockHash: "b3", Result: true, Latency: 200})
+
+	reps := []dtype.Reputation{}
+	assert.True(t, dba.GetReputation("", &reps))
+	assert.Equal(t, 2, len(reps))
+	assert.Equal(t, dtype.Reputation{Prover: "p1", SC: 0, Success: 1, Total: 2, Latency: 200, LastAudit: 2, Score: 0.5}, reps[0])
+
+	reps = []dtype.Reputation{}
+	assert.True(t, dba.GetReputation("p2", &reps))
+	assert.Equal(t, 1, len(reps))
+	assert.Equal(t, 2.0/3, reps[0].Score)
+}
+
 func TestDBSqliteRandom(t *testing.T) {
 	dba := NewDBAgent("../../storagesrv/bc_dev.db")
 	//hashes := dba.GetTransactionwithUniform(50)
@@ -138,12 +298,11 @@ func TestDBAgentProofStorage(t *testing.T) {
 	}
 
 	dba := NewDBAgent(path)
-	tt, _ := hex.DecodeString("0ab51095bf5314967f964422f91fc6b39e7761103875eeafebe1cef430d9f531")
-	var tid [32]byte
-	copy(tid[:], tt)
-	ts := int64(1661228540001266000)
-
-	dba.ProofStorage(tid, ts, 0)
+	hash, _ := dba.GetLatestBlockHash()
+	leaves := []dtype.PoSLeaf{}
+	ntx := dba.ProofStorage(hash, []int{0}, &leaves)
+	assert.Less(t, 0, ntx)
+	assert.Equal(t, 1, len(leaves))
 }
 
 func TestDBAgentTestQuery(t *testing.T) {
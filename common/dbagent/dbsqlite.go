@@ -3,6 +3,7 @@ package dbagent
 import (
 	"crypto/sha256"
 	"database/sql"
+	"encoding"
 	"encoding/hex"
 	"fmt"
 	"log"
@@ -15,6 +16,7 @@ import (
 	"github.com/junwookheo/bcsos/blockchainnode/network"
 	"github.com/junwookheo/bcsos/common/blockchain"
 	"github.com/junwookheo/bcsos/common/config"
+	"github.com/junwookheo/bcsos/common/dtype"
 	"github.com/junwookheo/bcsos/common/serial"
 	_ "github.com/mattn/go-sqlite3"
 )
@@ -87,7 +89,7 @@ func (a *dbagent) RemoveObject(hash string) bool {
 func (a *dbagent) updateACTimeObject(hash string) bool {
 	a.mutex.Lock()
 	defer a.mutex.Unlock()
-	st, err := a.db.Prepare("UPDATE blocktrtbl SET actime=?, aflevel=? WHERE transactionhash=?")
+	st, err := a.db.Prepare("UPDATE blocktrtbl SET actime=?, aflevel=?, accnt=accnt+1 WHERE transactionhash=?")
 	if err != nil {
 		log.Panicf("Update error id(%v) : %v", hash, err)
 		return false
@@ -106,7 +108,14 @@ func (a *dbagent) updateACTimeObject(hash string) bool {
 	return cnt > 0
 }
 
+// GetObject reads an object and updates its access time
+// Accesses are logged by the query path with AddAccessLog, so internal reads are not counted
 func (a *dbagent) GetObject(obj *StorageObj) int64 {
+	return a.getObject(obj, true)
+}
+
+// getObject reads an object, access time is updated only if access is true
+func (a *dbagent) getObject(obj *StorageObj, access bool) int64 {
 	var data []byte
 	var id int64 = 0
 	switch err := a.db.QueryRow("SELECT id, type, hash, timestamp, data FROM bcobjects WHERE hash=?",
@@ -116,7 +125,9 @@ func (a *dbagent) GetObject(obj *StorageObj) int64 {
 		break
 	case nil:
 		serial.Deserialize(data, obj.Data)
-		a.updateACTimeObject(obj.Hash)
+		if access {
+			a.updateACTimeObject(obj.Hash)
+		}
 		return id
 	default:
 		log.Printf("Get object error : %v", err)
@@ -125,8 +136,24 @@ func (a *dbagent) GetObject(obj *StorageObj) int64 {
 	return id
 }
 
+// GetObjectData returns the type and stored bytes of an object without the access log, empty if not found
+func (a *dbagent) GetObjectData(hash string) (string, []byte) {
+	var t string
+	var data []byte
+	switch err := a.db.QueryRow("SELECT type, data FROM bcobjects WHERE hash=?", hash).Scan(&t, &data); err {
+	case sql.ErrNoRows:
+		break
+	case nil:
+		return t, data
+	default:
+		log.Printf("Get object data error : %v", err)
+	}
+
+	return "", nil
+}
+
 func (a *dbagent) AddObject(obj *StorageObj) int64 {
-	if id := a.GetObject(obj); id != 0 {
+	if id := a.getObject(obj, true); id != 0 {
 		// log.Printf("Replicatoin exists : %v - %v", id, obj)
 		return id
 	}
@@ -177,14 +204,31 @@ func (a *dbagent) GetBlockTransactionMatching(bh string, hashes *[]string) int {
 		}
 		*hashes = append(*hashes, th)
 		cnt++
-		log.Printf("transactions : %d, %v", index, th)
+		// log.Printf("transactions : %d, %v", index, th)
 	}
 
 	return cnt
 }
 
-func (a *dbagent) AddBlockTransactionMatching(bh string, index int, th string) int64 {
-	obj := StorageBLTR{bh, index, th, time.Now().UnixNano(), a.SClass}
+// GetBlockHashOfObject returns the hash of block including the object and its index in the block
+// index 0 is the header and n-th transaction is n
+func (a *dbagent) GetBlockHashOfObject(hash string) (string, int) {
+	var bh string
+	var index int = -1
+	switch err := a.db.QueryRow("SELECT blockhash, idx FROM blocktrtbl WHERE transactionhash=?", hash).Scan(&bh, &index); err {
+	case sql.ErrNoRows:
+		break
+	case nil:
+		return bh, index
+	default:
+		log.Printf("Get block hash of object error : %v", err)
+	}
+
+	return "", -1
+}
+
+func (a *dbagent) AddBlockTransactionMatching(bh string, index int, th string, actime int64) int64 {
+	obj := StorageBLTR{bh, index, th, actime, a.SClass}
 	a.mutex.Lock()
 	defer a.mutex.Unlock()
 	st, err := a.db.Prepare("INSERT INTO blocktrtbl (blockhash, idx, transactionhash, actime, aflevel) VALUES (?, ?, ?, ?, ?)")
@@ -205,10 +249,216 @@ func (a *dbagent) AddBlockTransactionMatching(bh string, index int, th string) i
 	return id
 }
 
+// AddAccessLog writes an access to the access log and updates counters of the object
+func (a *dbagent) AddAccessLog(l *AccessLog) {
+	b2i := func(b bool) int {
+		if b {
+			return 1
+		}
+		return 0
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	rst, err := a.db.Exec(`INSERT INTO accesslog (timestamp, hash, type, hit, remote, sc, hop, requester, routing, messages, peer, latency) 
+							VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		l.Timestamp, l.Hash, l.Type, b2i(l.Hit), b2i(l.Remote), l.SC, l.Hop, l.Requester, l.Routing, l.Messages, l.Peer, l.Latency)
+	if err != nil {
+		log.Printf("Add access log error : %v", err)
+		return
+	}
+
+	// Old rows are removed every ACCESS_LOG_PRUNE rows, objectstats keeps their counters
+	if id, _ := rst.LastInsertId(); id%int64(config.ACCESS_LOG_PRUNE) == 0 {
+		a.pruneAccessLog(time.Now().UnixNano() - int64(config.ACCESS_LOG_RETENTION)*int64(time.Second))
+	}
+
+	var hits, misses, remote, hops int
+	if l.Remote {
+		remote, hops = b2i(l.Hit), l.Hop
+	} else if l.Hit {
+		hits = 1
+	} else {
+		misses = 1
+	}
+
+	_, err = a.db.Exec(`INSERT INTO objectstats (hash, type, hits, misses, remote, hops, lastsc, lastaccess) VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+						ON CONFLICT(hash) DO UPDATE SET hits = hits + excluded.hits, misses = misses + excluded.misses, 
+						remote = remote + excluded.remote, hops = hops + excluded.hops, lastsc = excluded.lastsc, lastaccess = excluded.lastaccess;`,
+		l.Hash, l.Type, hits, misses, remote, hops, l.SC, l.Timestamp)
+	if err != nil {
+		log.Printf("Update object stats error : %v", err)
+	}
+}
+
+// pruneAccessLog removes rows of the access log older than before, the caller holds the mutex
+func (a *dbagent) pruneAccessLog(before int64) int64 {
+	rst, err := a.db.Exec("DELETE FROM accesslog WHERE timestamp < ?;", before)
+	if err != nil {
+		log.Printf("Prune access log error : %v", err)
+		return 0
+	}
+
+	cnt, _ := rst.RowsAffected()
+	return cnt
+}
+
+// AddPoSAudit writes a result of Proof of Storage
+func (a *dbagent) AddPoSAudit(p *PoSAudit) {
+	result := 0
+	if p.Result {
+		result = 1
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	_, err := a.db.Exec("INSERT INTO posaudit (timestamp, challenger, prover, sc, blockhash, result, latency, reason) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		p.Timestamp, p.Challenger, p.Prover, p.SC, p.BlockHash, result, p.Latency, p.Reason)
+	if err != nil {
+		log.Printf("Add PoS audit error : %v", err)
+	}
+}
+
+// GetReputation returns audit results aggregated for each prover, prover is empty for all provers
+func (a *dbagent) GetReputation(prover string, reps *[]dtype.Reputation) bool {
+	rows, err := a.db.Query(`SELECT prover, MAX(sc), SUM(result), COUNT(*), CAST(AVG(latency) AS INTEGER), MAX(timestamp) FROM posaudit 
+								WHERE ? = '' OR prover = ? GROUP BY prover ORDER BY prover;`, prover, prover)
+	if err != nil {
+		log.Printf("Get reputation error : %v", err)
+		return false
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		r := dtype.Reputation{}
+		if err := rows.Scan(&r.Prover, &r.SC, &r.Success, &r.Total, &r.Latency, &r.LastAudit); err != nil {
+			log.Printf("Read rows Error : %v", err)
+			return false
+		}
+		r.Score = dtype.ReputationScore(r.Success, r.Total)
+		*reps = append(*reps, r)
+	}
+
+	return true
+}
+
+// GetHotObjects returns num objects accessed most
+func (a *dbagent) GetHotObjects(num int, stats *[]dtype.ObjectStat) bool {
+	rows, err := a.db.Query(`SELECT hash, type, hits, misses, remote, hops, lastsc, lastaccess FROM objectstats 
+								ORDER BY hits + misses DESC, lastaccess DESC LIMIT ?;`, num)
+	if err != nil {
+		log.Printf("Get hot objects error : %v", err)
+		return false
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		s := dtype.ObjectStat{}
+		if err := rows.Scan(&s.Hash, &s.Type, &s.Hits, &s.Misses, &s.Remote, &s.Hops, &s.LastSC, &s.LastAccess); err != nil {
+			log.Printf("Read rows Error : %v", err)
+			return false
+		}
+		*stats = append(*stats, s)
+	}
+
+	return true
+}
+
+// GetHitRatio returns the ratio of local accesses served by each storage class within ACCESS_LOG_RETENTION
+// The local storage class has the local hit ratio, others have the ratio found by remote accesses
+func (a *dbagent) GetHitRatio(ratios *[]dtype.SCHitRatio) bool {
+	var total int
+	var hits sql.NullInt64
+	if err := a.db.QueryRow("SELECT COUNT(*), SUM(hit) FROM accesslog WHERE remote = 0;").Scan(&total, &hits); err != nil {
+		log.Printf("Get hit ratio error : %v", err)
+		return false
+	}
+
+	served := map[int]int{a.SClass: int(hits.Int64)}
+	rows, err := a.db.Query("SELECT sc, COUNT(*) FROM accesslog WHERE remote = 1 AND hit = 1 GROUP BY sc;")
+	if err != nil {
+		log.Printf("Get hit ratio error : %v", err)
+		return false
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		var sc, cnt int
+		if err := rows.Scan(&sc, &cnt); err != nil {
+			log.Printf("Read rows Error : %v", err)
+			return false
+		}
+		served[sc] += cnt
+	}
+
+	for sc := 0; sc < config.MAX_SC; sc++ {
+		cnt, ok := served[sc]
+		if !ok {
+			continue
+		}
+
+		r := dtype.SCHitRatio{SC: sc, Hits: cnt, Total: total}
+		if total != 0 {
+			r.Ratio = float64(cnt) / float64(total)
+		}
+		*ratios = append(*ratios, r)
+	}
+
+	return true
+}
+
+// GetRoutingStats returns the average number of messages of remote accesses for each routing mode within ACCESS_LOG_RETENTION
+func (a *dbagent) GetRoutingStats(stats *[]dtype.RoutingStat) bool {
+	rows, err := a.db.Query(`SELECT routing, COUNT(*), SUM(hit), AVG(messages) FROM accesslog 
+								WHERE remote = 1 GROUP BY routing ORDER BY routing;`)
+	if err != nil {
+		log.Printf("Get routing stats error : %v", err)
+		return false
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		s := dtype.RoutingStat{}
+		if err := rows.Scan(&s.Routing, &s.Queries, &s.Found, &s.Messages); err != nil {
+			log.Printf("Read rows Error : %v", err)
+			return false
+		}
+		*stats = append(*stats, s)
+	}
+
+	return true
+}
+
+// GetCachedObjects returns objects which can be removed with access information for eviction policies
+// Blocks are not included, an object in several blocks has the latest access time and the largest count
+func (a *dbagent) GetCachedObjects(objs *[]CachedObj) bool {
+	rows, err := a.db.Query(`SELECT o.type, o.hash, length(o.hash) + length(o.data), MAX(t.actime), MAX(t.accnt) 
+								FROM bcobjects o JOIN blocktrtbl t ON o.hash = t.transactionhash 
+								WHERE o.type != 'block' GROUP BY o.hash;`)
+	if err != nil {
+		log.Printf("Get cached objects error : %v", err)
+		return false
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		obj := CachedObj{}
+		if err := rows.Scan(&obj.Type, &obj.Hash, &obj.Size, &obj.ACTime, &obj.Count); err != nil {
+			log.Printf("Read rows Error : %v", err)
+			return false
+		}
+		*objs = append(*objs, obj)
+	}
+
+	return true
+}
+
 // DeleteNoAccedObjects will delete transaction if there is no access more than a hour
 func (a *dbagent) DeleteNoAccedObjects() {
 	//log.Printf("%v", config.TSC0I)
-	ts := time.Now().UnixNano() - int64(config.TSCX[a.SClass]*float32(1e9)) // no access for if one hour, delete it
+	ts := time.Now().UnixNano() - int64(config.ConfigInst().TSC(a.SClass)*float32(1e9)) // no access for if one hour, delete it
 	//rows, err := a.db.Query(`SELECT transactionhash FROM blocktrtbl WHERE actime >= ? AND actime < ?;`, a.latestts, ts)
 	rows, err := a.db.Query(`SELECT hash FROM bcobjects WHERE type != 'block' AND hash 
 								IN (SELECT transactionhash FROM blocktrtbl WHERE actime < ?) ;`, ts)
@@ -231,7 +481,8 @@ func (a *dbagent) DeleteNoAccedObjects() {
 }
 
 func (a *dbagent) GetTransactionwithUniform(num int, hashes *[]RemoverbleObj) bool {
-	w := config.TOTAL_TRANSACTIONS + config.TOTAL_TRANSACTIONS/config.NUM_TRANSACTION_BLOCK
+	c := config.ConfigInst()
+	w := c.TotalTransactions + c.TotalTransactions/c.TransactionsPerBlock()
 
 	ids := func(w int, num int) string {
 		ids := []string{}
@@ -273,12 +524,13 @@ func (a *dbagent) GetTransactionwithUniform(num int, hashes *[]RemoverbleObj) bo
 // It just select rows by exponentially generated numbers
 // without considering access time.
 func (a *dbagent) GetTransactionwithExponential(num int, hashes *[]RemoverbleObj) bool {
-	w := float64(config.BASIC_UNIT_TIME*config.RATE_TSC*(config.NUM_TRANSACTION_BLOCK+1.)) / float64(config.BLOCK_CREATE_PERIOD)
+	c := config.ConfigInst()
+	w := float64(c.BasicUnitTime*c.RateTSC*(c.TransactionsPerBlock()+1.)) / float64(c.BlockCreatePeriod)
 
 	ids := func(w float64, num int) string {
 		ids := []string{}
 		for i := 0; i < num; i++ {
-			f := rand.ExpFloat64() / float64(config.LAMBDA_ED)
+			f := rand.ExpFloat64() / float64(c.LambdaED)
 			l := int(f * w)
 			ids = append(ids, strconv.Itoa(l))
 		}
@@ -338,6 +590,23 @@ func (a *dbagent) AddTransaction(t *blockchain.Transaction) int64 {
 	return a.AddObject(&obj)
 }
 
+// ShardHash is the content address of a shard
+func ShardHash(blockhash string, index int) string {
+	h := sha256.Sum256([]byte(fmt.Sprintf("%v:%v", blockhash, index)))
+	return hex.EncodeToString(h[:])
+}
+
+func (a *dbagent) AddShard(s *dtype.Shard) int64 {
+	obj := StorageObj{"shard", ShardHash(s.BlockHash, s.Index), time.Now().UnixNano(), s}
+	return a.AddObject(&obj)
+}
+
+// GetShard reads a shard without the access log, shards are not cached objects
+func (a *dbagent) GetShard(blockhash string, index int, s *dtype.Shard) int64 {
+	obj := StorageObj{"shard", ShardHash(blockhash, index), 0, s}
+	return a.getObject(&obj, false)
+}
+
 func (a *dbagent) GetBlock(hash string, b *blockchain.Block) int64 {
 	if hash == "" {
 		return 0
@@ -369,28 +638,87 @@ func (a *dbagent) GetBlock(hash string, b *blockchain.Block) int64 {
 }
 
 func (a *dbagent) AddBlock(b *blockchain.Block) int64 {
+	var height int
 	hash := hex.EncodeToString(b.Header.Hash)
-	obj := StorageObj{"block", hash, b.Header.Timestamp, b.Header.Height} // store height in data field.
+	obj := StorageObj{"block", hash, b.Header.Timestamp, &height} // store height in data field.
 	if id := a.GetObject(&obj); id != 0 {
 		log.Printf("Replicatoin exists : %v - %v", id, hex.EncodeToString(b.Header.Hash))
 		return id
 	}
 
-	bhash := b.Header.GetHash()
+	var trhashes []string
+	for _, t := range b.Transactions {
+		trhashes = append(trhashes, hex.EncodeToString(t.Hash))
+		a.AddTransaction(t)
+	}
+
+	return a.AddBlockIndex(&b.Header, trhashes, time.Now().UnixNano())
+}
+
+// RemoveBlock removes a block detached from the best chain with its header and transactions not included in other blocks
+func (a *dbagent) RemoveBlock(hash string) bool {
+	var hashes []string = []string{}
+	a.GetBlockTransactionMatching(hash, &hashes)
+
+	a.mutex.Lock()
+	_, err := a.db.Exec("DELETE FROM blocktrtbl WHERE blockhash=?", hash)
+	a.mutex.Unlock()
+	if err != nil {
+		log.Printf("Remove block error : %v", err)
+		return false
+	}
+
+	for _, h := range hashes {
+		if bh, _ := a.GetBlockHashOfObject(h); bh == "" {
+			a.RemoveObject(h)
+		}
+	}
+
+	return a.RemoveObject(hash)
+}
+
+// GetBlockIndex reads the header and transaction hashes of a block without updating access time
+// so serving other nodes does not change the access statistics
+func (a *dbagent) GetBlockIndex(hash string, h *blockchain.BlockHeader, trhashes *[]string) int64 {
+	var hashes []string = []string{}
+	if a.GetBlockTransactionMatching(hash, &hashes) == 0 {
+		return 0
+	}
+
+	obj := StorageObj{"blockheader", hashes[0], h.Timestamp, h}
+	id := a.getObject(&obj, false)
+	if id != 0 {
+		*trhashes = append(*trhashes, hashes[1:]...)
+	}
+
+	return id
+}
+
+// AddBlockIndex adds the header and block - transactions list of a block without transactions.
+// actime is the access time of objects, initial block download uses the timestamp of block
+func (a *dbagent) AddBlockIndex(h *blockchain.BlockHeader, trhashes []string, actime int64) int64 {
+	var height int
+	hash := hex.EncodeToString(h.Hash)
+	obj := StorageObj{"block", hash, h.Timestamp, &height}
+	if id := a.GetObject(&obj); id != 0 {
+		log.Printf("Replicatoin exists : %v - %v", id, hash)
+		return id
+	}
+
+	bhash := h.GetHash()
 	header_hash := hex.EncodeToString(bhash[:])
-	a.AddBlockHeader(header_hash, &b.Header)
+	a.AddBlockHeader(header_hash, h)
 
 	// Add block - transactions list in the table
-	a.AddBlockTransactionMatching(hash, 0, header_hash)
+	a.AddBlockTransactionMatching(hash, 0, header_hash, actime)
 	cnt := 0
-	for i, t := range b.Transactions {
-		a.AddBlockTransactionMatching(hash, i+1, hex.EncodeToString(t.Hash))
-		a.AddTransaction(t)
+	for i, th := range trhashes {
+		a.AddBlockTransactionMatching(hash, i+1, th, actime)
 		cnt++
 	}
 
 	// Add only block information without data, the data is stored in block-transaction matching table
-	obj = StorageObj{"block", hex.EncodeToString(b.Header.Hash), b.Header.Timestamp, b.Header.Height}
+	obj = StorageObj{"block", hash, h.Timestamp, h.Height}
 
 	if id := a.AddObject(&obj); id != 0 {
 		a.mutex.Lock()
@@ -501,6 +829,8 @@ func (a *dbagent) updateRemoveDBStatus(hash string) {
 		case "blockheader":
 			status.Headers -= 1
 			status.Size -= size
+		case "shard":
+			status.Size -= size
 		default:
 			log.Printf("Type error %s", obj.Type)
 		}
@@ -537,6 +867,8 @@ func (a *dbagent) updateAddDBStatus(id int64) {
 		case "blockheader":
 			status.Headers += 1
 			status.Size += size
+		case "shard":
+			status.Size += size
 		default:
 			log.Printf("Type error %s", obj.Type)
 		}
@@ -664,59 +996,106 @@ func (a *dbagent) ProofStorage2() {
 	}
 }
 
-// Proof of Storage
-func (a *dbagent) ProofStorage(tidx [32]byte, timestamp int64, tsc int) []byte {
-	match := hex.EncodeToString(tidx[:])
-	log.Printf("match : %v", match)
+// ProofStorage returns transactions of indices in the block with Merkle paths to the root of the block
+// Return the number of transactions in the block, 0 if the block or a selected transaction is not found
+func (a *dbagent) ProofStorage(blockhash string, indices []int, leaves *[]dtype.PoSLeaf) int {
+	hashes := []string{}
+	if a.GetBlockTransactionMatching(blockhash, &hashes) < 2 {
+		return 0
+	}
 
-	a.mutex.Lock()
-	defer a.mutex.Unlock()
+	// hashes[0] is the header
+	var mhashes [][]byte
+	for _, th := range hashes[1:] {
+		leaf, _ := hex.DecodeString(th)
+		mhashes = append(mhashes, leaf)
+	}
 
-	query := fmt.Sprintf(`SELECT hash, timestamp, data FROM bcobjects WHERE type = "transaction" and hash LIKE "%%%s";`, match[len(match)-1:])
-	rows, err := a.db.Query(query)
-	if err != nil {
-		log.Printf("Show latest db status Error : %v", err)
-		return nil
+	for _, idx := range indices {
+		proof := blockchain.BuildMerkleProof(mhashes, idx)
+		if proof == nil {
+			return 0
+		}
+
+		// Proof of Storage is not an access of the object
+		leaf := dtype.PoSLeaf{Index: idx, Proof: *proof}
+		obj := StorageObj{"transaction", hashes[idx+1], 0, &leaf.Transaction}
+		if a.getObject(&obj, false) == 0 {
+			log.Printf("Proof of Storage, not found transaction : %v", hashes[idx+1])
+			return 0
+		}
+		*leaves = append(*leaves, leaf)
 	}
 
-	defer rows.Close()
+	return len(mhashes)
+}
 
-	var data []byte
-	i := 0
-	tr := blockchain.Transaction{}
-	var hash string
-	var ts int64
-	var hashes [][]byte
+func (a *dbagent) GetDBStatus() *DBStatus {
+	a.dbstatus.Timestamp = time.Now()
+	return &a.dbstatus
+}
+
+// migrateObjects rewrites transactions and headers encoded with gob to the canonical encoding.
+// gob rows can be still read, but the canonical encoding is readable from other languages.
+func (a *dbagent) migrateObjects() int {
+	rows, err := a.db.Query(`SELECT id, type, data FROM bcobjects WHERE (type = 'transaction' OR type = 'blockheader') AND hex(substr(data, 1, 1)) != '00';`)
+	if err != nil {
+		log.Printf("Migrate objects error : %v", err)
+		return 0
+	}
 
-	// Guard Time : 60 sec
-	th_lower := timestamp - int64(config.TSCX[tsc]*float32(1e9)) + int64(60*float32(1e9))
-	th_upper := timestamp - int64(60*float32(1e9))
-	// log.Printf("threshold : %v, %v, %v", th_lower, th_upper, timestamp)
+	type row struct {
+		id   int64
+		data []byte
+	}
 
+	var olds []row
 	for rows.Next() {
-		err := rows.Scan(&hash, &ts, &data)
-		if err != nil {
+		var id int64
+		var objtype string
+		var data []byte
+		if err := rows.Scan(&id, &objtype, &data); err != nil {
 			break
 		}
 
-		serial.Deserialize(data, &tr)
-		if th_lower < tr.Timestamp && tr.Timestamp < th_upper {
-			log.Printf("match %v : %v - %v", i, time.Unix((ts/1000)/1e6, ((ts/1000)%1e6)*1e3), hex.EncodeToString(tr.Hash))
-			tr.Timestamp = timestamp
-			hashes = append(hashes, tr.GetHash())
-			i++
-		} else {
-			log.Printf("not match %v : %v - %v", i, time.Unix((ts/1000)/1e6, ((ts/1000)%1e6)*1e3), hex.EncodeToString(tr.Hash))
+		var obj interface {
+			encoding.BinaryMarshaler
+			encoding.BinaryUnmarshaler
+		} = &blockchain.Transaction{}
+		if objtype == "blockheader" {
+			obj = &blockchain.BlockHeader{}
+		}
+		// A corrupt row is left as it is, reading it fails later like before the migration
+		if err := obj.UnmarshalBinary(data); err != nil {
+			log.Printf("Migrate objects skip row(%v) : %v", id, err)
+			continue
+		}
+		enc, _ := obj.MarshalBinary()
+		olds = append(olds, row{id, enc})
+	}
+	rows.Close()
 
+	if len(olds) == 0 {
+		return 0
+	}
+
+	tx, err := a.db.Begin()
+	if err != nil {
+		log.Printf("Migrate objects error : %v", err)
+		return 0
+	}
+
+	for _, r := range olds {
+		if _, err := tx.Exec("UPDATE bcobjects SET data = ? WHERE id = ?", r.data, r.id); err != nil {
+			log.Printf("Migrate objects error : %v", err)
+			tx.Rollback()
+			return 0
 		}
 	}
-	log.Printf("MerkleRoot : %v - %v", i, hex.EncodeToString(blockchain.CalMerkleRootHash(hashes)))
-	return blockchain.CalMerkleRootHash(hashes)
-}
+	tx.Commit()
+	log.Printf("Migrate objects : %v rows from gob", len(olds))
 
-func (a *dbagent) GetDBStatus() *DBStatus {
-	a.dbstatus.Timestamp = time.Now()
-	return &a.dbstatus
+	return len(olds)
 }
 
 func newDBSqlite(path string) DBAgent {
@@ -749,7 +1128,8 @@ func newDBSqlite(path string) DBAgent {
 		idx				INTEGER,
 		transactionhash TEXT,
 		actime			INTEGER,
-		aflevel			INTEGER
+		aflevel			INTEGER,
+		accnt			INTEGER DEFAULT 0
 	);`
 
 	st, err = db.Prepare(create_blocktrtbl)
@@ -760,6 +1140,9 @@ func newDBSqlite(path string) DBAgent {
 
 	st.Exec()
 
+	// accnt : the number of access for eviction policies, added to db created before
+	db.Exec("ALTER TABLE blocktrtbl ADD COLUMN accnt INTEGER DEFAULT 0;")
+
 	// totalquery : query objects including local storage
 	// queryfrom : the number of received queries to get deleted transactions
 	// queryto : the number of send queries to get deleted transactions
@@ -790,10 +1173,83 @@ func newDBSqlite(path string) DBAgent {
 
 	st.Exec()
 
+	// Access log of objects
+	// hit : found in local storage, or found in other nodes for a remote access
+	// remote : queried to other nodes after a miss
+	// sc : the storage class served the object, -1 if not found
+	// routing : routing mode of a remote access, messages : the number of nodes queried including relays
+	// peer : the node answered a remote access, latency : nanosecond from the request to the peer to its answer
+	create_accesslogtbl := `CREATE TABLE IF NOT EXISTS accesslog (
+		id      		INTEGER  PRIMARY KEY AUTOINCREMENT,
+		timestamp		INTEGER,
+		hash			TEXT,
+		type			TEXT,
+		hit				INTEGER,
+		remote			INTEGER,
+		sc				INTEGER,
+		hop				INTEGER,
+		requester		TEXT,
+		routing			TEXT,
+		messages		INTEGER,
+		peer			TEXT,
+		latency			INTEGER
+	);`
+
+	st, err = db.Prepare(create_accesslogtbl)
+	if err != nil {
+		log.Panicf("create_accesslogtbl error %v", err)
+	}
+	defer st.Close()
+
+	st.Exec()
+
+	// Aggregated counters of accesslog for each object
+	create_objectstatstbl := `CREATE TABLE IF NOT EXISTS objectstats (
+		hash			TEXT PRIMARY KEY,
+		type			TEXT,
+		hits			INTEGER,
+		misses			INTEGER,
+		remote			INTEGER,
+		hops			INTEGER,
+		lastsc			INTEGER,
+		lastaccess		INTEGER
+	);`
+
+	st, err = db.Prepare(create_objectstatstbl)
+	if err != nil {
+		log.Panicf("create_objectstatstbl error %v", err)
+	}
+	defer st.Close()
+
+	st.Exec()
+
+	// Results of Proof of Storage requested by the node
+	// result : 1 if the proof is verified, latency : nanosecond from the challenge to the response
+	create_posaudittbl := `CREATE TABLE IF NOT EXISTS posaudit (
+		id      		INTEGER  PRIMARY KEY AUTOINCREMENT,
+		timestamp		INTEGER,
+		challenger		TEXT,
+		prover			TEXT,
+		sc				INTEGER,
+		blockhash		TEXT,
+		result			INTEGER,
+		latency			INTEGER,
+		reason			TEXT
+	);`
+
+	st, err = db.Prepare(create_posaudittbl)
+	if err != nil {
+		log.Panicf("create_posaudittbl error %v", err)
+	}
+	defer st.Close()
+
+	st.Exec()
+
 	ni := network.NodeInfoInst()
 	local := ni.GetLocalddr()
 
 	dba := dbagent{db: db, SClass: local.SC, dbstatus: DBStatus{Timestamp: time.Now()}, mutex: sync.Mutex{}}
+	dba.migrateObjects()
 	dba.getLatestDBStatus(&dba.dbstatus)
 	go dba.updateDBStatus()
 	return &dba
@@ -1,11 +1,134 @@
 package dtype
 
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/junwookheo/bcsos/common/blockchain"
+	"github.com/junwookheo/bcsos/common/wallet"
+)
+
+var ErrNodeIdentity = errors.New("unverifiable node identity")
+
+// NodeInfo is signed by the node, Hash is derived from PubKey
+// Nonce is the time of signing, so a newer announcement of a node replaces older ones.
 type NodeInfo struct {
-	Mode string `json:"mode"`
-	SC   int    `json:"storage_class"`
-	IP   string `json:"ip"`
-	Port int    `json:"port"`
-	Hash string `json:"hash"`
+	Mode      string `json:"mode"`
+	SC        int    `json:"storage_class"`
+	IP        string `json:"ip"`
+	Port      int    `json:"port"`
+	Hash      string `json:"hash"`
+	PubKey    []byte `json:"pubkey,omitempty"`
+	Nonce     int64  `json:"nonce,omitempty"`
+	Signature []byte `json:"signature,omitempty"`
+}
+
+func (n *NodeInfo) digest() []byte {
+	data := fmt.Sprintf("%v|%v|%v|%v|%v|%x|%v", n.Mode, n.SC, n.IP, n.Port, n.Hash, n.PubKey, n.Nonce)
+	hash := sha256.Sum256([]byte(data))
+
+	return hash[:]
+}
+
+// Sign sets the identity of the wallet and signs the fields with a new nonce
+func (n *NodeInfo) Sign(w *wallet.Wallet) error {
+	n.PubKey = w.PublicKey
+	n.Hash = wallet.NodeHash(w.PublicKey)
+	n.Nonce = time.Now().UnixNano()
+
+	sig, err := w.Sign(n.digest())
+	if err != nil {
+		return err
+	}
+	n.Signature = sig
+
+	return nil
+}
+
+// Verify checks Hash is derived from PubKey and the signature of the fields
+func (n *NodeInfo) Verify() error {
+	if n.Hash == "" || n.Hash != wallet.NodeHash(n.PubKey) || !wallet.VerifySignature(n.PubKey, n.digest(), n.Signature) {
+		return fmt.Errorf("%w : %v:%v %v", ErrNodeIdentity, n.IP, n.Port, n.Hash)
+	}
+
+	return nil
+}
+
+// Message is an envelope of messages between peers
+// A reply has the ID of its request and Error if the request failed, a notification has ID 0.
+type Message struct {
+	Version uint16          `json:"Version"`
+	Type    string          `json:"Type"`
+	ID      uint64          `json:"ID"`
+	Payload json.RawMessage `json:"Payload,omitempty"`
+	Error   string          `json:"Error,omitempty"`
+}
+
+// Handshake is the first message of a peer connection
+// The dialer sends versions it supports and the codec it prefers, the reply has the version and the codec negotiated.
+// Each node signs the random challenge of the other node to prove it owns the key of Node,
+// so the dialer sends a third message with the signature of the challenge of the reply.
+type Handshake struct {
+	MinVersion uint16   `json:"MinVersion"`
+	MaxVersion uint16   `json:"MaxVersion"`
+	Codec      string   `json:"Codec"`
+	Node       NodeInfo `json:"Node"`
+	Challenge  []byte   `json:"Challenge,omitempty"`
+	Signature  []byte   `json:"Signature,omitempty"` // signature of the challenge of the other node
+}
+
+// Inventory announces hashes of new objects of the type, the receiver requests ones it lacks to Sender by ReqGetData
+type Inventory struct {
+	Sender NodeInfo `json:"Sender"`
+	Type   string   `json:"Type"`
+	Hashes []string `json:"Hashes"`
+}
+
+// ReqGetData requests objects announced, the response has objects by hash
+type ReqGetData struct {
+	Type   string   `json:"Type"`
+	Hashes []string `json:"Hashes"`
+}
+
+// GossipStat counts gossip of a node, Bytes are objects received including duplicates
+type GossipStat struct {
+	InvSent        int   `json:"InvSent"`
+	InvReceived    int   `json:"InvReceived"`
+	InvDuplicates  int   `json:"InvDuplicates"` // hashes announced which were seen before
+	Requested      int   `json:"Requested"`
+	Received       int   `json:"Received"`
+	Duplicates     int   `json:"Duplicates"` // objects received which were seen before
+	Bytes          int64 `json:"Bytes"`
+	DuplicateBytes int64 `json:"DuplicateBytes"`
+}
+
+// ReqFindNode asks peers of the storage class closest to Target, Sender is added to the routing table
+type ReqFindNode struct {
+	Sender NodeInfo `json:"Sender"`
+	SC     int      `json:"storage_class"`
+	Target string   `json:"Target"`
+}
+
+// Provider announces Node keeps the object of Hash
+type Provider struct {
+	Hash      string   `json:"Hash"`
+	Node      NodeInfo `json:"Node"`
+	Timestamp int64    `json:"Timestamp"`
+}
+
+// ReqFindValue asks providers of Target, Sender is added to the routing table
+type ReqFindValue struct {
+	Sender NodeInfo `json:"Sender"`
+	Target string   `json:"Target"`
+}
+
+// ResFindValue has providers of the target and the closest nodes to continue the lookup
+type ResFindValue struct {
+	Providers []Provider `json:"Providers"`
+	Nodes     []NodeInfo `json:"Nodes"`
 }
 
 type ReqData struct {
@@ -15,23 +138,175 @@ type ReqData struct {
 	Hop       int    `json:"Hop"`
 	ObjType   string `json:"ObjType"`
 	ObjHash   string `json:"ObjHash"`
+	Verify    bool   `json:"Verify"` // if true, ResObjectProof follows the object
+}
+
+// ResObjectProof anchors a transaction to the block header kept by the requester
+type ResObjectProof struct {
+	BlockHash string                 `json:"BlockHash"`
+	Index     int                    `json:"Index"`
+	Proof     blockchain.MerkleProof `json:"Proof"`
+}
+
+// ResObject is an object answered to ReqData with the proof if Verify is set
+// NotFound is set without the object if neither the node nor higher storage classes have it
+type ResObject struct {
+	Data     ReqData         `json:"Data"`
+	Object   json.RawMessage `json:"Object"`
+	Proof    ResObjectProof  `json:"Proof"`
+	NotFound bool            `json:"NotFound"`
 }
 
 type Command struct {
-	Cmd    string `json:"cmd"`
-	Subcmd string `json:"subcmd"`
-	Arg1   string `json:"arg1"`
-	Arg2   string `json:"arg2"`
-	Arg3   string `json:"arg3"`
+	Cmd     string   `json:"cmd"`
+	Subcmd  string   `json:"subcmd"`
+	Arg1    string   `json:"arg1"`
+	Arg2    string   `json:"arg2"`
+	Arg3    string   `json:"arg3"`
+	Signers [][]byte `json:"signers,omitempty"` // public keys of PoA signers, sent with the start of test
 }
 
+type ReqBlock struct {
+	Hash string `json:"Hash"`
+}
+
+// ReqHeaders requests Count headers from Hash to the genesis
+// If Hash is empty, it starts from the latest block
+type ReqHeaders struct {
+	Hash  string `json:"Hash"`
+	Count int    `json:"Count"`
+}
+
+// ResHeaders has headers and transaction hashes of each block in descending order of height
+type ResHeaders struct {
+	Headers  []blockchain.BlockHeader `json:"Headers"`
+	TrHashes [][]string               `json:"TrHashes"`
+}
+
+// ReqPoStorage challenges Num transactions of the block, Timestamp is the nonce of the challenge
 type ReqPoStorage struct {
 	Hash      string `json:"Hash"`
 	Timestamp int64  `json:"Timestamp"`
+	Num       int    `json:"Num"`
+}
+
+// PoSLeaf is a transaction selected by the challenge with its Merkle path
+type PoSLeaf struct {
+	Index       int                    `json:"Index"`
+	Transaction blockchain.Transaction `json:"Transaction"`
+	Proof       blockchain.MerkleProof `json:"Proof"`
 }
 
+// ResPoStorage has the number of transactions of the block and selected leaves, empty if the block is not found
 type ResPoStorage struct {
+	Addr   string    `json:"Address"`
+	SC     int       `json:"storage_class"`
+	NumTx  int       `json:"NumTx"`
+	Leaves []PoSLeaf `json:"Leaves"`
+}
+
+// ObjectStat has aggregated access counters of an object
+type ObjectStat struct {
+	Hash       string `json:"Hash"`
+	Type       string `json:"Type"`
+	Hits       int    `json:"Hits"`   // found in local storage
+	Misses     int    `json:"Misses"` // not found in local storage
+	Remote     int    `json:"Remote"` // served by other nodes after a miss
+	Hops       int    `json:"Hops"`   // the sum of hops of remote accesses
+	LastSC     int    `json:"LastSC"` // the storage class served last, -1 if not found
+	LastAccess int64  `json:"LastAccess"`
+}
+
+// SCHitRatio is the ratio of accesses found in the storage class
+type SCHitRatio struct {
+	SC    int     `json:"storage_class"`
+	Hits  int     `json:"Hits"`
+	Total int     `json:"Total"`
+	Ratio float64 `json:"Ratio"`
+}
+
+// ReqObjectStats requests Num hot objects
+type ReqObjectStats struct {
+	Num int `json:"Num"`
+}
+
+// RoutingStat compares the cost to find objects by routing modes
+type RoutingStat struct {
+	Routing  string  `json:"Routing"`
+	Queries  int     `json:"Queries"`
+	Found    int     `json:"Found"`
+	Messages float64 `json:"Messages"` // the average number of nodes queried including relays
+}
+
+type ResObjectStats struct {
+	Objects  []ObjectStat  `json:"Objects"`
+	HitRatio []SCHitRatio  `json:"HitRatio"`
+	Routing  []RoutingStat `json:"Routing"`
+}
+
+// Shard is a Reed-Solomon shard of a block body
+// K, M and Size are needed to reconstruct the block body from K shards
+type Shard struct {
+	BlockHash string `json:"BlockHash"`
+	Index     int    `json:"Index"`
+	K         int    `json:"K"`
+	M         int    `json:"M"`
+	Size      int    `json:"Size"`
+	Data      []byte `json:"Data"`
+}
+
+type ReqShard struct {
+	BlockHash string `json:"BlockHash"`
+	Index     int    `json:"Index"`
+}
+
+// ReqAudit challenges a holder of an object, the proof is sha256(Nonce + stored object)
+type ReqAudit struct {
+	Hash  string `json:"Hash"`
+	Nonce string `json:"Nonce"`
+}
+
+type ResAudit struct {
 	Addr  string `json:"Address"`
-	SC    int    `json:"storage_class"`
 	Proof string `json:"Proof"`
 }
+
+// Replica is an object sent to a holder which lost it
+type Replica struct {
+	Type string `json:"Type"`
+	Hash string `json:"Hash"`
+	Data []byte `json:"Data"`
+}
+
+// UnderReplicated is an object which has less replicas than the replication factor
+type UnderReplicated struct {
+	Hash     string   `json:"Hash"`
+	Type     string   `json:"Type"`
+	Replicas int      `json:"Replicas"`
+	Holders  []string `json:"Holders"` // nodes passed the last audit
+}
+
+type ResReplicationStatus struct {
+	Factor          int               `json:"Factor"`
+	Audited         int               `json:"Audited"`
+	Repaired        int               `json:"Repaired"`
+	Dropped         int               `json:"Dropped"`
+	UnderReplicated []UnderReplicated `json:"UnderReplicated"`
+}
+
+// Reputation aggregates results of Proof of Storage of a prover
+type Reputation struct {
+	Prover    string  `json:"Prover"`
+	SC        int     `json:"storage_class"`
+	Success   int     `json:"Success"`
+	Total     int     `json:"Total"`
+	Latency   int64   `json:"Latency"` // average, nanosecond
+	LastAudit int64   `json:"LastAudit"`
+	Score     float64 `json:"Score"`
+}
+
+// ReputationScore is the ratio of success with a prior of one success and one failure,
+// so a node not audited yet has 0.5
+func ReputationScore(success int, total int) float64 {
+	return float64(success+1) / float64(total+2)
+}
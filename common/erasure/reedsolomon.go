@@ -0,0 +1,255 @@
+package erasure
+
+import (
+	"errors"
+)
+
+// Reed-Solomon erasure coding over GF(2^8)
+//
+// Data is split into k data shards and m parity shards are computed.
+// The data can be reconstructed from any k shards of k+m.
+// The encoding matrix is a Vandermonde matrix multiplied by the inverse of its top k rows,
+// so the top k rows are the identity and data shards are the data itself(systematic code).
+
+var (
+	ErrInvalidParam = errors.New("invalid number of shards")
+	ErrTooFewShards = errors.New("too few shards to reconstruct")
+	ErrShardSize    = errors.New("shards have different sizes")
+	ErrSingular     = errors.New("matrix is singular")
+)
+
+// The primitive polynomial x^8 + x^4 + x^3 + x^2 + 1
+const gfPoly int = 0x11d
+
+var (
+	gfExp [512]byte
+	gfLog [256]byte
+)
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfLog[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= gfPoly
+		}
+	}
+	for i := 255; i < 512; i++ {
+		gfExp[i] = gfExp[i-255]
+	}
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+func gfInv(a byte) byte {
+	return gfExp[255-int(gfLog[a])]
+}
+
+func gfPow(a byte, n int) byte {
+	if n == 0 {
+		return 1
+	}
+	if a == 0 {
+		return 0
+	}
+	return gfExp[(int(gfLog[a])*n)%255]
+}
+
+type matrix [][]byte
+
+func newMatrix(rows, cols int) matrix {
+	m := make(matrix, rows)
+	for r := range m {
+		m[r] = make([]byte, cols)
+	}
+	return m
+}
+
+func (a matrix) mul(b matrix) matrix {
+	c := newMatrix(len(a), len(b[0]))
+	for r := range a {
+		for col := range b[0] {
+			var v byte
+			for i := range b {
+				v ^= gfMul(a[r][i], b[i][col])
+			}
+			c[r][col] = v
+		}
+	}
+	return c
+}
+
+// invert returns the inverse of a square matrix with Gauss-Jordan elimination
+func (a matrix) invert() (matrix, error) {
+	n := len(a)
+	work := newMatrix(n, n*2)
+	for r := 0; r < n; r++ {
+		copy(work[r], a[r])
+		work[r][n+r] = 1
+	}
+
+	for c := 0; c < n; c++ {
+		pivot := -1
+		for r := c; r < n; r++ {
+			if work[r][c] != 0 {
+				pivot = r
+				break
+			}
+		}
+		if pivot == -1 {
+			return nil, ErrSingular
+		}
+		work[c], work[pivot] = work[pivot], work[c]
+
+		inv := gfInv(work[c][c])
+		for i := range work[c] {
+			work[c][i] = gfMul(work[c][i], inv)
+		}
+
+		for r := 0; r < n; r++ {
+			if r == c || work[r][c] == 0 {
+				continue
+			}
+			f := work[r][c]
+			for i := range work[r] {
+				work[r][i] ^= gfMul(f, work[c][i])
+			}
+		}
+	}
+
+	inv := newMatrix(n, n)
+	for r := 0; r < n; r++ {
+		copy(inv[r], work[r][n:])
+	}
+	return inv, nil
+}
+
+type Encoder struct {
+	k      int
+	m      int
+	matrix matrix // (k+m) x k
+}
+
+// NewEncoder returns an encoder with k data shards and m parity shards, k+m should be up to 256
+func NewEncoder(k, m int) (*Encoder, error) {
+	if k <= 0 || m < 0 || 256 < k+m {
+		return nil, ErrInvalidParam
+	}
+
+	vm := newMatrix(k+m, k)
+	for r := 0; r < k+m; r++ {
+		for c := 0; c < k; c++ {
+			vm[r][c] = gfPow(byte(r), c)
+		}
+	}
+
+	top, err := vm[:k].invert()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Encoder{k: k, m: m, matrix: vm.mul(top)}, nil
+}
+
+func (e *Encoder) DataShards() int {
+	return e.k
+}
+
+func (e *Encoder) ParityShards() int {
+	return e.m
+}
+
+// Split splits data into k data shards padded with zero and computes m parity shards
+func (e *Encoder) Split(data []byte) [][]byte {
+	size := (len(data) + e.k - 1) / e.k
+	if size == 0 {
+		size = 1
+	}
+
+	padded := make([]byte, size*e.k)
+	copy(padded, data)
+
+	shards := make([][]byte, e.k+e.m)
+	for i := 0; i < e.k; i++ {
+		shards[i] = padded[i*size : (i+1)*size]
+	}
+
+	for i := e.k; i < e.k+e.m; i++ {
+		shards[i] = make([]byte, size)
+		for c := 0; c < e.k; c++ {
+			f := e.matrix[i][c]
+			if f == 0 {
+				continue
+			}
+			for j := 0; j < size; j++ {
+				shards[i][j] ^= gfMul(f, shards[c][j])
+			}
+		}
+	}
+
+	return shards
+}
+
+// Join reconstructs data of size from shards, nil is a missing shard
+// Any k shards of k+m are enough
+func (e *Encoder) Join(shards [][]byte, size int) ([]byte, error) {
+	if len(shards) != e.k+e.m {
+		return nil, ErrInvalidParam
+	}
+
+	var rows []int
+	shardsize := -1
+	for i, shard := range shards {
+		if shard == nil {
+			continue
+		}
+		if shardsize == -1 {
+			shardsize = len(shard)
+		} else if shardsize != len(shard) {
+			return nil, ErrShardSize
+		}
+
+		if len(rows) < e.k {
+			rows = append(rows, i)
+		}
+	}
+
+	if len(rows) < e.k {
+		return nil, ErrTooFewShards
+	}
+	if size < 0 || e.k*shardsize < size {
+		return nil, ErrShardSize
+	}
+
+	sub := newMatrix(e.k, e.k)
+	for i, r := range rows {
+		copy(sub[i], e.matrix[r])
+	}
+	dec, err := sub.invert()
+	if err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, e.k*shardsize)
+	for c := 0; c < e.k; c++ {
+		out := data[c*shardsize : (c+1)*shardsize]
+		for i, r := range rows {
+			f := dec[c][i]
+			if f == 0 {
+				continue
+			}
+			for j := 0; j < shardsize; j++ {
+				out[j] ^= gfMul(f, shards[r][j])
+			}
+		}
+	}
+
+	return data[:size], nil
+}
@@ -0,0 +1,65 @@
+package erasure
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGF(t *testing.T) {
+	for a := 1; a < 256; a++ {
+		assert.Equal(t, byte(1), gfMul(byte(a), gfInv(byte(a))))
+	}
+	assert.Equal(t, byte(0), gfMul(0, 7))
+	assert.Equal(t, gfMul(3, gfMul(3, 3)), gfPow(3, 3))
+}
+
+func TestReedSolomon(t *testing.T) {
+	_, err := NewEncoder(0, 2)
+	assert.Equal(t, ErrInvalidParam, err)
+	_, err = NewEncoder(200, 57)
+	assert.Equal(t, ErrInvalidParam, err)
+
+	e, err := NewEncoder(4, 2)
+	assert.Nil(t, err)
+
+	data := make([]byte, 1001)
+	rand.Read(data)
+	shards := e.Split(data)
+	assert.Equal(t, 6, len(shards))
+	assert.Equal(t, 251, len(shards[0]))
+
+	// Data shards are the data itself
+	assert.Equal(t, data[:251], shards[0])
+
+	// Any 4 shards reconstruct the data
+	for a := 0; a < 6; a++ {
+		for b := a + 1; b < 6; b++ {
+			lost := make([][]byte, 6)
+			copy(lost, shards)
+			lost[a], lost[b] = nil, nil
+
+			joined, err := e.Join(lost, len(data))
+			assert.Nil(t, err)
+			assert.True(t, bytes.Equal(data, joined), "lost %v, %v", a, b)
+		}
+	}
+
+	lost := make([][]byte, 6)
+	copy(lost, shards)
+	lost[0], lost[1], lost[2] = nil, nil, nil
+	_, err = e.Join(lost, len(data))
+	assert.Equal(t, ErrTooFewShards, err)
+
+	lost[3] = lost[3][:10]
+	_, err = e.Join(lost, len(data))
+	assert.Equal(t, ErrShardSize, err)
+
+	// Empty data
+	shards = e.Split(nil)
+	joined, err := e.Join(shards, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(joined))
+}
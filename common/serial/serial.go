@@ -2,11 +2,19 @@ package serial
 
 import (
 	"bytes"
+	"encoding"
 	"encoding/gob"
 	"log"
 )
 
+// Serialize uses the canonical encoding if v implements encoding.BinaryMarshaler, otherwise gob
 func Serialize(v interface{}) []byte {
+	if m, ok := v.(encoding.BinaryMarshaler); ok {
+		data, err := m.MarshalBinary()
+		handle(err)
+		return data
+	}
+
 	var buffer bytes.Buffer
 	encode := gob.NewEncoder(&buffer)
 	err := encode.Encode(v)
@@ -14,7 +22,14 @@ func Serialize(v interface{}) []byte {
 	return buffer.Bytes()
 }
 
+// Deserialize leaves the data to out if out implements encoding.BinaryUnmarshaler,
+// so it can decode both the canonical encoding and gob written before.
 func Deserialize(data []byte, out interface{}) {
+	if u, ok := out.(encoding.BinaryUnmarshaler); ok {
+		handle(u.UnmarshalBinary(data))
+		return
+	}
+
 	decode := gob.NewDecoder(bytes.NewReader(data))
 	err := decode.Decode(out)
 	handle(err)
@@ -1,16 +1,52 @@
 package wallet
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"hash/fnv"
 	"math/big"
 )
 
-func DistanceXor(h1 string, h2 string) uint64 {
-	n1, _ := new(big.Int).SetString(h1, 16)
-	n2, _ := new(big.Int).SetString(h2, 16)
+// The size of content addresses in bits, sha256
+const ADDR_BITS int = 256
+
+// NodeHash returns the content address of a node, the hash of its Bitcoin address
+func NodeHash(pubKey []byte) string {
+	if len(pubKey) == 0 {
+		return ""
+	}
+
+	hash := sha256.Sum256(AddressOf(pubKey))
+	return hex.EncodeToString(hash[:])
+}
+
+// DistanceXor returns the XOR distance of two content addresses with all 256 bits
+func DistanceXor(h1 string, h2 string) *big.Int {
+	n1, ok := new(big.Int).SetString(h1, 16)
+	if !ok {
+		n1 = new(big.Int)
+	}
+	n2, ok := new(big.Int).SetString(h2, 16)
+	if !ok {
+		n2 = new(big.Int)
+	}
+
+	return new(big.Int).Xor(n1, n2)
+}
+
+// CloserXor returns true if h1 is closer to target than h2
+func CloserXor(target string, h1 string, h2 string) bool {
+	return DistanceXor(target, h1).Cmp(DistanceXor(target, h2)) < 0
+}
+
+// PrefixLen returns the number of leading bits shared by two content addresses, ADDR_BITS if they are the same
+func PrefixLen(h1 string, h2 string) int {
+	l := ADDR_BITS - DistanceXor(h1, h2).BitLen()
+	if l < 0 {
+		return 0
+	}
 
-	x := new(big.Int).Xor(n1, n2)
-	return x.Uint64()
+	return l
 }
 
 func DistanceXor2(h1 string, h2 string) uint64 {
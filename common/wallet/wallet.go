@@ -107,6 +107,45 @@ func (w *Wallet) GetAddress() []byte {
 	return address
 }
 
+// AddressOf returns the address of the public key without logs
+func AddressOf(pubKey []byte) []byte {
+	verPayload := append([]byte{version}, HashPubKey(pubKey)...)
+
+	return Base58Encode(append(verPayload, getChecksum(verPayload)...))
+}
+
+// Sign returns the signature of data, r and s of 32 bytes each
+func (w *Wallet) Sign(data []byte) ([]byte, error) {
+	r, s, err := ecdsa.Sign(rand.Reader, w.PrivateKey, data)
+	if err != nil {
+		return nil, err
+	}
+
+	buf1 := make([]byte, 32)
+	buf2 := make([]byte, 32)
+	return append(r.FillBytes(buf1), s.FillBytes(buf2)...), nil
+}
+
+// VerifySignature checks the signature of data by the public key
+func VerifySignature(pubKey []byte, data []byte, sig []byte) bool {
+	if len(pubKey) != 64 || len(sig) != 64 {
+		return false
+	}
+
+	x := big.Int{}
+	y := big.Int{}
+	x.SetBytes(pubKey[:32])
+	y.SetBytes(pubKey[32:])
+
+	r := big.Int{}
+	s := big.Int{}
+	r.SetBytes(sig[:32])
+	s.SetBytes(sig[32:])
+
+	rawPubKey := ecdsa.PublicKey{Curve: elliptic.P256(), X: &x, Y: &y}
+	return ecdsa.Verify(&rawPubKey, data, &r, &s)
+}
+
 func getPayload(addr []byte) (byte, []byte, []byte) {
 	fullPayload := Base58Decode(addr)
 	checksum := fullPayload[len(fullPayload)-checksumLength:]
@@ -39,3 +39,14 @@ func TestValidateAddress(t *testing.T) {
 	assert.Equal(t, "1e99423a4ed27608a15a2616a2b0e9e52ced330ac530edcc32c8ffc6a526aedd01", fmt.Sprintf("%x", payload))
 	assert.Equal(t, uint32(2339607926), binary.LittleEndian.Uint32(checksum))
 }
+
+func TestDistanceXor(t *testing.T) {
+	h1 := "8000000000000000000000000000000000000000000000000000000000000001"
+	h2 := "00000000000000000000000000000000000000000000000000000000000000ff"
+
+	// All 256 bits are compared
+	assert.True(t, CloserXor("00", h2, h1))
+	assert.Equal(t, 0, PrefixLen(h1, h2))
+	assert.Equal(t, 248, PrefixLen("00", h2))
+	assert.Equal(t, ADDR_BITS, PrefixLen(h1, h1))
+}
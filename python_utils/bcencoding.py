@@ -0,0 +1,55 @@
+import struct
+import sqlite3
+
+# Decoder of the canonical encoding in common/blockchain/encoding.go
+# [0x00, version, kind] + fields, bytes : uint32 length + data, int : int64, big endian
+ENCODING_MARKER = 0
+ENCODING_VERSION = 1
+KIND_TRANSACTION = 1
+KIND_BLOCKHEADER = 2
+
+
+class Decoder:
+    def __init__(self, data, kind):
+        if len(data) < 3 or data[0] != ENCODING_MARKER or data[1] != ENCODING_VERSION or data[2] != kind:
+            raise ValueError('invalid canonical encoding')
+        self.data = data
+        self.pos = 3
+
+    def get_bytes(self):
+        (length,) = struct.unpack_from('>I', self.data, self.pos)
+        self.pos += 4
+        b = self.data[self.pos:self.pos + length]
+        self.pos += length
+        return b
+
+    def get_int(self):
+        (n,) = struct.unpack_from('>q', self.data, self.pos)
+        self.pos += 8
+        return n
+
+
+def decode_transaction(data):
+    d = Decoder(data, KIND_TRANSACTION)
+    return {'Hash': d.get_bytes().hex(), 'Timestamp': d.get_int(), 'Data': d.get_bytes(),
+            'Signature': d.get_bytes().hex(), 'PubKey': d.get_bytes().hex()}
+
+
+def decode_blockheader(data):
+    d = Decoder(data, KIND_BLOCKHEADER)
+    return {'Hash': d.get_bytes().hex(), 'PrvHash': d.get_bytes().hex(), 'MerkleRoot': d.get_bytes().hex(),
+            'Timestamp': d.get_int(), 'Difficulty': d.get_int(), 'Nonce': d.get_int(), 'Height': d.get_int(),
+            'Signature': d.get_bytes().hex()}
+
+
+def read_objects(path, objtype):
+    decode = {'transaction': decode_transaction, 'blockheader': decode_blockheader}[objtype]
+    con = sqlite3.connect(path)
+    rows = con.execute('SELECT hash, data FROM bcobjects WHERE type = ?', (objtype,)).fetchall()
+    con.close()
+    return [decode(data) for _, data in rows if len(data) != 0 and data[0] == ENCODING_MARKER]
+
+
+if __name__ == "__main__":
+    for header in read_objects('../blockchainnode/db_nodes/7001.db', 'blockheader'):
+        print(header['Height'], header['Hash'])